@@ -0,0 +1,160 @@
+// ********************************************************************************
+// scalesec-import: import a file of secrets into a ScaleSec secret store mount
+//
+// The file is sent to the importer path of the mount, with the address and token of the
+// vault client environment (VAULT_ADDR, VAULT_TOKEN, ...), and the report is printed.
+//
+//   scalesec-import -mount scalesecsecrets -format kv-json -prefix legacy -conflict version kv-dump.json
+//   scalesec-import -mount scalesecsecrets -format env -prefix app/web -dry-run web.env
+//
+// The format defaults from the extension of the file: .json, .yaml/.yml or .env.
+// ********************************************************************************
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// options are the flags and the file of the command line
+type options struct {
+	mount       string
+	format      string
+	prefix      string
+	conflict    string
+	previousTTL string
+	dryRun      bool
+	file        string
+}
+
+func main() {
+	opts, err := parseArgs(os.Args[1:], os.Stderr)
+	if err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	content, err := ioutil.ReadFile(opts.file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading %s failed: %s\n", opts.file, err)
+		os.Exit(1)
+	}
+
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "creating the vault client failed: %s\n", err)
+		os.Exit(1)
+	}
+
+	secret, err := client.Logical().Write(strings.Trim(opts.mount, "/")+"/importer", opts.requestData(string(content)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "importing %s failed: %s\n", opts.file, err)
+		os.Exit(1)
+	}
+	if secret == nil {
+		fmt.Fprintln(os.Stderr, "the importer returned no report")
+		os.Exit(1)
+	}
+
+	if opts.dryRun {
+		fmt.Println("dry run, nothing was written")
+	}
+	failed := printReport(os.Stdout, secret.Data)
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// parseArgs returns the options of the command line arguments.  The usage is written to
+// output when the arguments are invalid.
+func parseArgs(args []string, output io.Writer) (*options, error) {
+	opts := &options{}
+
+	flags := flag.NewFlagSet("scalesec-import", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Usage = func() {
+		fmt.Fprintln(output, "usage: scalesec-import [flags] <file>")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&opts.mount, "mount", "scalesecsecrets", "Path of the secret store mount")
+	flags.StringVar(&opts.format, "format", "", "Format of the file: kv-json, yaml or env.  Defaults from the file extension")
+	flags.StringVar(&opts.prefix, "prefix", "", "Path prefix the secrets are written under.  The path of the secret of an env file")
+	flags.StringVar(&opts.conflict, "conflict", "skip", "What to do when there is already a secret at a path: skip, overwrite or version")
+	flags.StringVar(&opts.previousTTL, "previous-ttl", "", "With -conflict version, how long the replaced data stays readable")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "Only report what the import would do")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return nil, fmt.Errorf("one file must be given, got %d", flags.NArg())
+	}
+	opts.file = flags.Arg(0)
+
+	if opts.format == "" {
+		opts.format = formatFromExtension(opts.file)
+		if opts.format == "" {
+			return nil, fmt.Errorf("the format of %s can not be guessed, use -format", opts.file)
+		}
+	}
+	return opts, nil
+}
+
+// requestData returns the data of the importer request for the content of the file
+func (opts *options) requestData(content string) map[string]interface{} {
+	data := map[string]interface{}{
+		"format":   opts.format,
+		"content":  content,
+		"prefix":   opts.prefix,
+		"conflict": opts.conflict,
+		"dry_run":  opts.dryRun,
+	}
+	if opts.previousTTL != "" {
+		data["previous_ttl"] = opts.previousTTL
+	}
+	return data
+}
+
+// formatFromExtension returns the format of a file from its extension
+func formatFromExtension(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return "kv-json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".env":
+		return "env"
+	}
+	if strings.HasPrefix(filepath.Base(file), ".env") {
+		return "env"
+	}
+	return ""
+}
+
+// printReport writes the paths of each outcome to w and returns whether some failed
+func printReport(w io.Writer, report map[string]interface{}) bool {
+	failed := false
+	for _, outcome := range []string{"created", "updated", "skipped", "unchanged", "failed"} {
+		paths, _ := report[outcome].([]interface{})
+		fmt.Fprintf(w, "%s: %d\n", outcome, len(paths))
+		for _, path := range paths {
+			fmt.Fprintf(w, "  %v\n", path)
+		}
+		if outcome == "failed" && len(paths) > 0 {
+			failed = true
+		}
+	}
+	return failed
+}
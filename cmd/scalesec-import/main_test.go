@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The flags and the file are parsed, and the format defaults from the extension
+func TestParseArgs(t *testing.T) {
+
+	var output bytes.Buffer
+	opts, err := parseArgs([]string{"-mount", "secrets", "-prefix", "legacy", "-conflict", "version", "-previous-ttl", "1h", "-dry-run", "kv-dump.json"}, &output)
+	assert.Nil(t, err)
+	assert.Equal(t, &options{
+		mount:       "secrets",
+		format:      "kv-json",
+		prefix:      "legacy",
+		conflict:    "version",
+		previousTTL: "1h",
+		dryRun:      true,
+		file:        "kv-dump.json",
+	}, opts)
+	assert.Equal(t, map[string]interface{}{
+		"format":       "kv-json",
+		"content":      "{}",
+		"prefix":       "legacy",
+		"conflict":     "version",
+		"dry_run":      true,
+		"previous_ttl": "1h",
+	}, opts.requestData("{}"))
+
+	// the defaults, and -format over the extension
+	opts, err = parseArgs([]string{"web.env"}, &output)
+	assert.Nil(t, err)
+	assert.Equal(t, "scalesecsecrets", opts.mount)
+	assert.Equal(t, "env", opts.format)
+	assert.Equal(t, "skip", opts.conflict)
+	assert.NotContains(t, opts.requestData("KEY=value"), "previous_ttl")
+
+	opts, err = parseArgs([]string{"-format", "yaml", "secrets.txt"}, &output)
+	assert.Nil(t, err)
+	assert.Equal(t, "yaml", opts.format)
+	assert.Empty(t, output.String())
+}
+
+// A missing file, several files, an unknown extension and an unknown flag are rejected
+func TestParseArgsInvalid(t *testing.T) {
+
+	for _, args := range [][]string{
+		{},
+		{"a.json", "b.json"},
+		{"secrets.txt"},
+		{"-unknown", "a.json"},
+	} {
+		var output bytes.Buffer
+		_, err := parseArgs(args, &output)
+		assert.NotNil(t, err, "args %v", args)
+	}
+
+	var output bytes.Buffer
+	_, err := parseArgs([]string{"-h"}, &output)
+	assert.Equal(t, flag.ErrHelp, err)
+	assert.Contains(t, output.String(), "usage: scalesec-import [flags] <file>")
+}
+
+func TestFormatFromExtension(t *testing.T) {
+
+	for file, format := range map[string]string{
+		"dump.json":    "kv-json",
+		"dump.YAML":    "yaml",
+		"dump.yml":     "yaml",
+		"web.env":      "env",
+		"config/.env":  "env",
+		".env.local":   "env",
+		"secrets.txt":  "",
+		"no-extension": "",
+	} {
+		assert.Equal(t, format, formatFromExtension(file), "file %s", file)
+	}
+}
+
+// The report lists the paths of each outcome and tells whether some failed
+func TestPrintReport(t *testing.T) {
+
+	var output bytes.Buffer
+	failed := printReport(&output, map[string]interface{}{
+		"created":   []interface{}{"app/api", "app/db"},
+		"updated":   []interface{}{},
+		"skipped":   []interface{}{"app/web"},
+		"unchanged": []interface{}{},
+		"failed":    []interface{}{},
+	})
+	assert.False(t, failed)
+	assert.Equal(t, "created: 2\n  app/api\n  app/db\nupdated: 0\nskipped: 1\n  app/web\nunchanged: 0\nfailed: 0\n", output.String())
+
+	output.Reset()
+	failed = printReport(&output, map[string]interface{}{
+		"failed": []interface{}{"db/main: missing password"},
+	})
+	assert.True(t, failed)
+	assert.Contains(t, output.String(), "failed: 1\n  db/main: missing password\n")
+}
@@ -190,7 +190,8 @@ deploy () {
 
     # enable
     # -options : used to provide a sample config_key and config_value.  Refere tothe scalesecSecretStore.go to see how it can be used.
-    vault secrets enable -options=config_key=config_value -description="ScaleSec Secret Store Plugin Example" -path=scalesecsecrets scalesecSecretStorePlugin
+    # -allowed-response-headers : lets the Retry-After header of a rate limited request reach the caller
+    vault secrets enable -options=config_key=config_value -allowed-response-headers=Retry-After -description="ScaleSec Secret Store Plugin Example" -path=scalesecsecrets scalesecSecretStorePlugin
 
     # Vault display plugin information
     vault plugin info secret/scalesecSecretStorePlugin
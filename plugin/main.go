@@ -10,6 +10,10 @@ import (
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/sdk/plugin"
 	scaleSecPlugin "scalesec.com/scalesec-secret-store"
+
+	// SQL drivers for the sql rotation hook:  hook_driver=postgres or hook_driver=mysql
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 )
 
 var (
@@ -34,6 +38,9 @@ func main() {
 	hclogger.Default().Info(fmt.Sprintf("Plugin Built Information: %s ", pluginBuildInfo))
 	hclogger.Default().Info("*********************************")
 
+	// The info path of the plugin returns the build metadata
+	scaleSecPlugin.SetBuildInfo(pluginBuildDate, pluginBuildVersion, pluginBuildInfo)
+
 	// The main function is a very standard function and follow HashiCorp example recomendation for
 	// a custom plugin.
 
@@ -16,13 +16,22 @@ package scalesecSecretStore
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
-	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const scalesecSecretStoreBackendHelp = `
@@ -44,6 +53,83 @@ type scalesecSecretStoreBackend struct {
 	// You can add additional vars here that you want to keep for the running
 	// of the plugin .. Like configuration arguments or plugin name
 	pluginName string
+
+	// now returns the current time.  Tests replace it to control the clock.
+	now func() time.Time
+
+	// accessChecker checks the caller can read the secrets referenced by a template
+	accessChecker accessChecker
+
+	// schemas are the compiled schemas registered against path prefixes.  nil until they
+	// are loaded from storage and reset when a schema changes.
+	schemas    []*compiledSchema
+	schemaLock sync.RWMutex
+
+	// secretLocks serialize the changes to a secret.  Use b.secretLock with the path.
+	secretLocks []*locksutil.LockEntry
+
+	// httpClient is used to call upstream systems IE: the rotation generator hook
+	httpClient *http.Client
+
+	// hookFileDir is the directory the file rotation hooks write in.  File hooks are refused
+	// when it is empty.
+	hookFileDir string
+
+	// totpLock serializes the validation of TOTP codes so a code can only be used once
+	totpLock sync.Mutex
+
+	// config is the configuration of the mount.  nil until it is loaded from storage and
+	// reset when it is written.
+	config     *mountConfig
+	configLock sync.RWMutex
+
+	// upgradeCancel stops the storage migrations started by initialize and upgradeDone is
+	// closed when they end.  nil when no migration was started.
+	upgradeCancel context.CancelFunc
+	upgradeDone   chan struct{}
+	upgradeLock   sync.Mutex
+
+	// readCache keeps the stored secrets in memory.  nil until the first read and when the
+	// cache is off.
+	readCache     *secretCache
+	readCacheLock sync.RWMutex
+
+	// fieldACLs are the field ACL rules.  nil until they are loaded from storage and reset
+	// when a rule changes.
+	fieldACLs    []*fieldACLEntry
+	fieldACLLock sync.RWMutex
+
+	// rateLimits are the rate limit rules.  nil until they are loaded from storage and reset
+	// when a rule changes.  buckets are the token buckets of the rules by rule and entity.
+	rateLimits    []*rateLimitEntry
+	rateLimitLock sync.RWMutex
+	buckets       map[string]*tokenBucket
+	bucketLock    sync.Mutex
+
+	// quotas are the storage quotas.  nil until they are loaded from storage and reset when a
+	// quota changes.  quotaUsageLocks serialize the changes of the usage of a quota, use
+	// b.quotaUsageLocksFor with the quotas.  quotaSetLock is held for writing while a quota is
+	// written or deleted and for reading while the usage of the quotas changes.
+	quotas          []*quotaEntry
+	quotaLock       sync.RWMutex
+	quotaUsageLocks []*locksutil.LockEntry
+	quotaSetLock    sync.RWMutex
+
+	// access counts the reads of the secrets until the periodic function writes them
+	access accessTracker
+
+	// metrics are the counters and histograms of the handlers and the providers
+	metrics *metricsRegistry
+
+	// tracer creates the spans of the handlers and the providers.  tracerProvider exports
+	// them and is nil when tracing is off.
+	tracer         trace.Tracer
+	tracerProvider *sdktrace.TracerProvider
+
+	// vaultLogLevel is the log level set by vault, restored when log_level of the config is
+	// cleared.  It is read once, before the config first changes the level.
+	vaultLogLevel hclog.Level
+	logLevelOnce  sync.Once
 }
 
 var _ logical.Factory = Factory
@@ -62,7 +148,7 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 		return nil, fmt.Errorf("configuration passed into backend is nil")
 	}
 
-	// https://pkg.go.dev/github.com/hashicorp/vault/sdk@v0.3.0/logical#BackendConfig
+	// https://pkg.go.dev/github.com/hashicorp/vault/sdk@v0.6.0/logical#BackendConfig
 	// The BackendConfig.Config map is set by the vault secrets enable command.
 	// plugin_name and plugin_type are automatically set by vault framework
 	// custom config items are passed using the -options and passing key value pair:  -options=config_key=config_value
@@ -72,6 +158,23 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 	conf.Logger.Debug("scalesecSecretStore.Factory:-> ", "conf.Config[plugin_name]:", conf.Config["plugin_name"])
 	conf.Logger.Debug("scalesecSecretStore.Factory:-> ", "conf.Config[plugin_type]:", conf.Config["plugin_type"])
 	conf.Logger.Debug("scalesecSecretStore.Factory:-> ", "conf.Config[config_key]:", conf.Config["config_key"])
+	conf.Logger.Debug("scalesecSecretStore.Factory:-> ", "conf.Config[vault_addr]:", conf.Config["vault_addr"])
+
+	// -options=vault_addr=https://vault:8200 sets the address the plugin uses to call back into
+	// vault to check the capabilities of a caller.  Defaults to VAULT_ADDR.  The token it
+	// calls with is access_check_token of the config.
+	b.accessChecker = newVaultAccessChecker(conf.Config["vault_addr"], b.accessCheckToken)
+
+	// -options=hook_file_dir=/etc/app/secrets sets the directory the file rotation hooks write
+	// in.  The hook_file_path of a rotation is relative to it.  Without it file hooks are refused.
+	b.hookFileDir = conf.Config["hook_file_dir"]
+
+	// -options=tracing_exporter=otlp|file sets where the spans are exported, see
+	// scalesecSecretStoreTracing.go for the other options
+	if err := b.setupTracing(ctx, conf.Config); err != nil {
+		conf.Logger.Debug("scalesecSecretStore.Factory:-> b.setupTracing error", "Error", err)
+		return nil, err
+	}
 
 	if err := b.Setup(ctx, conf); err != nil {
 		conf.Logger.Debug("scalesecSecretStore.Factory:-> b.Setup error", "Error", err)
@@ -91,6 +194,19 @@ func newBackend(logger hclog.Logger) (*scalesecSecretStoreBackend, error) {
 	b := &scalesecSecretStoreBackend{
 		// if you have additional vars to the backend structure you would init them here
 		pluginName: "scalesecSecretStore",
+		now:        time.Now,
+
+		secretLocks:     locksutil.CreateLocks(),
+		quotaUsageLocks: locksutil.CreateLocks(),
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			// a redirect could take a call to a host that is not in upstream_hosts
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		metrics: newMetricsRegistry(),
+		tracer:  trace.NewNoopTracerProvider().Tracer(tracerName),
 	}
 
 	b.Backend = &framework.Backend{
@@ -100,9 +216,51 @@ func newBackend(logger hclog.Logger) (*scalesecSecretStoreBackend, error) {
 		// 1 TypeLogical    = Secret Store Backend
 		// 2 TypeCredential = Authorization Backend
 		BackendType: logical.TypeLogical,
-		Paths: framework.PathAppend(
+		// The version vault shows for the plugin, from the link options of plugin/main.go
+		RunningVersion: runningVersion(pluginBuild.Version),
+		// Called about once a minute by vault to do the background work: rotation, purge,
+		// access tracking
+		PeriodicFunc: b.periodicFunc,
+		// Called by vault to roll back the operations the plugin did not finish
+		WALRollback:       b.walRollback,
+		WALRollbackMinAge: walRollbackMinAge,
+		// Called by vault when the mount is set up to upgrade the storage
+		InitializeFunc: b.initialize,
+		// Called by vault when another node changed a storage entry the backend caches
+		Invalidate: b.invalidate,
+		// Called by vault when the mount is unloaded
+		Clean: b.clean,
+		// The info path can be read without a token.  The rotations and the WAL entries hold
+		// the credentials of the sql hooks so they are seal wrapped.
+		PathsSpecial: &logical.Paths{
+			Unauthenticated: []string{"info"},
+			SealWrapStorage: []string{rotationStoragePrefix, framework.WALPrefix},
+		},
+		// The framework matches the paths in order and the catch all secret path of b.paths
+		// matches every request, so it has to be last and every other path has to be added
+		// before it.  Every request is measured, traced, logged and rate limited.
+		Paths: b.instrumentRequests(b.logRequests(b.limitRate(framework.PathAppend(
+			b.configPaths(logger),
+			b.infoPaths(logger),
+			b.upgradePaths(logger),
+			b.readCachePaths(logger),
+			b.totpPaths(logger),
+			b.schemaPaths(logger),
+			b.fieldACLPaths(logger),
+			b.rateLimitPaths(logger),
+			b.quotaPaths(logger),
+			b.rotationPaths(logger),
+			b.batchPaths(logger),
+			b.deletePaths(logger),
+			b.metadataPaths(logger),
+			b.searchPaths(logger),
+			b.expiryPaths(logger),
+			b.exportPaths(logger),
+			b.metricsPaths(logger),
+			b.sharePaths(logger),
+			b.importerPaths(logger),
 			b.paths(logger),
-		),
+		)))),
 	}
 
 	logger.Debug("scalesecSecretStore:newBackend(): -> Leaving")
@@ -132,6 +290,10 @@ func (b *scalesecSecretStoreBackend) paths(logger hclog.Logger) []*framework.Pat
 				},
 			},
 
+			// The keys of a secret are chosen by the caller, so the framework must not warn
+			// that they are not in Fields
+			TakesArbitraryInput: true,
+
 			//
 			// mapping the operational request:  Read; Write; Create; Delete
 			//
@@ -149,6 +311,10 @@ func (b *scalesecSecretStoreBackend) paths(logger hclog.Logger) []*framework.Pat
 					Callback: b.handleWrite,
 					Summary:  "Creates the secret at the specified location.",
 				},
+				logical.PatchOperation: &framework.PathOperation{
+					Callback: b.handlePatch,
+					Summary:  "Updates some of the keys of the secret at the specified location.",
+				},
 				logical.ListOperation: &framework.PathOperation{
 					Callback: b.handleList,
 					Summary:  "Lists the secret at the specified location.",
@@ -172,6 +338,41 @@ func (b *scalesecSecretStoreBackend) paths(logger hclog.Logger) []*framework.Pat
 	return frameworkPath
 }
 
+// periodicFunc is called by vault on a timer to do the background work of the plugin.
+// Performance standbys and secondaries can not write to storage so they skip it.
+func (b *scalesecSecretStoreBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	b.Logger().Debug("scalesecSecretStore.periodicFunc:-> Enter")
+
+	replicationState := b.System().ReplicationState()
+	if replicationState.HasState(consts.ReplicationPerformanceStandby) || replicationState.HasState(consts.ReplicationPerformanceSecondary) {
+		b.Logger().Debug("scalesecSecretStore.periodicFunc:-> Leaving not the primary")
+		return nil
+	}
+
+	// Each job runs even if the one before failed
+	var result error
+	if err := b.rotateDueSecrets(ctx, req.Storage); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := b.purgeDeletedSecrets(ctx, req.Storage); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := b.purgeExpiredShares(ctx, req.Storage); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := b.flushAccess(ctx); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if result != nil {
+		b.Logger().Debug("scalesecSecretStore.periodicFunc:-> Leaving with error")
+		return result
+	}
+
+	b.Logger().Debug("scalesecSecretStore.periodicFunc:-> Leaving")
+	return nil
+}
+
 // ============================================================================================
 // handleExistenceCheck: Check your secret Store to see if an secret exist
 //
@@ -182,22 +383,13 @@ func (b *scalesecSecretStoreBackend) paths(logger hclog.Logger) []*framework.Pat
 
 func (b *scalesecSecretStoreBackend) handleExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
 	b.Logger().Debug("scalesecSecretStore.handleExistenceCheck:-> Enter")
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleExistenceCheck:-> *logical.Request: %v", req))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleExistenceCheck:-> *framework.FieldData: %v", data))
-
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleExistenceCheck:-> req.Path: %s", req.Path))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleExistenceCheck:-> req.MountPoint: %s", req.MountPoint))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleExistenceCheck:-> req.Data: %s", req.Data))
-	// loop over keys and values in the map.
-	for data_key, data_value := range req.Data {
-		b.Logger().Debug("scalesecSecretStore.handleExistenceCheck:-> req.Data", "key:", data_key, "value:", data_value)
-	}
+	b.requestLogger(req).Debug("scalesecSecretStore.handleExistenceCheck:-> request")
 
 	// ***** ***** ***** ***** ***** ***** ***** ***** ***** ***** *****
 	// ***** **** Start your if existence check logic
 
 	// Read from the local storage to see if the secret exists
-	out, err := req.Storage.Get(ctx, req.Path)
+	out, err := b.getSecret(ctx, req.Storage, data.Get("path").(string))
 
 	if err != nil {
 		b.Logger().Debug("scalesecSecretStore.handleExistenceCheck:-> Leaving with error")
@@ -231,47 +423,91 @@ func (b *scalesecSecretStoreBackend) handleRead(ctx context.Context, req *logica
 		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRead:-> Leaving with error: %s", err))
 		return nil, err
 	}
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRead:-> *logical.Request: %v", req))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRead:-> *framework.FieldData: %v", data))
-
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRead:-> req.Path: %s", req.Path))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRead:-> req.MountPoint: %s", req.MountPoint))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRead:-> req.Data: %s", req.Data))
-	// loop over keys and values in the map.
-	for data_key, data_value := range req.Data {
-		b.Logger().Debug("scalesecSecretStore.handleRead:-> req.Data", "key:", data_key, "value:", data_value)
-	}
 
 	// ***** ***** ***** ***** ***** ***** ***** ***** ***** ***** *****
 	// **** Start your read logic
 
-	var rawData map[string]interface{}
 	path := data.Get("path").(string)
 
-	// Example hardcoded data
-	fetchedData := []byte("")
+	secret, err := b.getSecret(ctx, req.Storage, path)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleRead:-> Leaving with error")
+		return nil, fmt.Errorf("reading secret failed: %w", err)
+	}
 
-	if len(req.Data) != 0 {
-		// No data (key/value) passed on read request IE: vault read scalesecsecrets/test secret_key
-		fetchedData = []byte(`{"all_secrets_keys":"all_secrets_values", "secretPath":"` + path + `"}`)
-	} else {
-		// data (key/value) was passed on read request IE: vault read scalesecsecrets/test secret_key=secretPath
-		fetchedData = []byte(`{"secretPath":"` + path + `"}`)
+	// Check to see if we have data that should be returned.  A nil response is reported
+	// by vault as not found.
+	if secret == nil {
+		b.Logger().Debug("scalesecSecretStore.handleRead:-> Leaving no value at path")
+		return nil, nil
 	}
 
-	// Check to see if we have data that should be returned.
-	if fetchedData == nil {
-		b.Logger().Debug("scalesecSecretStore.handleRead:-> Leaving error message in response")
-		resp := logical.ErrorResponse("No value at Mount:%v Path:%v", req.MountPoint, path)
-		return resp, nil
+	// An expired secret is returned with a warning or rejected depending on the config
+	expiryWarning, rejectExpired, err := b.checkExpiry(ctx, req.Storage, path, secret)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleRead:-> Leaving with error")
+		return nil, err
+	}
+	if rejectExpired {
+		b.Logger().Debug("scalesecSecretStore.handleRead:-> Leaving secret expired")
+		return logical.ErrorResponse(expiryWarning), nil
+	}
+
+	rawData := secret.Data
+
+	// previous=true: return the data before the last rotation while it is still readable
+	if previous, ok := req.Data["previous"]; ok {
+		readPrevious, err := parseutil.ParseBool(previous)
+		if err != nil {
+			return logical.ErrorResponse("previous must be a boolean: %s", err), nil
+		}
+		if readPrevious {
+			if secret.Previous == nil || b.now().After(secret.Previous.ReadableUntil) {
+				b.Logger().Debug("scalesecSecretStore.handleRead:-> Leaving no previous version")
+				return nil, nil
+			}
+			rawData = secret.Previous.Data
+		}
 	}
 
-	// Take the data and load  the rawData interface so it can go into the response
-	err := jsonutil.DecodeJSON(fetchedData, &rawData)
+	// render=true: values that are templates are rendered with the secrets they reference
+	var renderWarnings []string
+	if render, ok := req.Data["render"]; ok {
+		doRender, err := parseutil.ParseBool(render)
+		if err != nil {
+			return logical.ErrorResponse("render must be a boolean: %s", err), nil
+		}
+		if doRender {
+			rawData, renderWarnings, err = b.renderSecret(ctx, req, path, rawData, nil)
+			if err != nil {
+				b.Logger().Debug("scalesecSecretStore.handleRead:-> Leaving with render error")
+				if errors.Is(err, logical.ErrPermissionDenied) {
+					return logical.ErrorResponse(err.Error()), logical.ErrPermissionDenied
+				}
+				var templateErr *templateError
+				if errors.As(err, &templateErr) {
+					return logical.ErrorResponse(err.Error()), nil
+				}
+				return nil, fmt.Errorf("rendering secret failed: %w", err)
+			}
+		}
+	}
+
+	// the field ACL rules remove the fields the caller is not allowed to see
+	rawData, redacted, err := b.redactFields(ctx, req, path, rawData)
 	if err != nil {
-		// use the HCP errwrap class to create and return an error message
 		b.Logger().Debug("scalesecSecretStore.handleRead:-> Leaving with error")
-		return nil, fmt.Errorf("json decoding failed: %w", err)
+		return nil, fmt.Errorf("applying the field ACL failed: %w", err)
+	}
+
+	// secret_key=key_name: only return the value of that key
+	if secretKey, ok := req.Data["secret_key"].(string); ok {
+		value, found := rawData[secretKey]
+		if !found {
+			b.Logger().Debug("scalesecSecretStore.handleRead:-> Leaving no value for key")
+			return nil, nil
+		}
+		rawData = map[string]interface{}{secretKey: value}
 	}
 
 	// ***** End - Your Read logic
@@ -281,6 +517,16 @@ func (b *scalesecSecretStoreBackend) handleRead(ctx context.Context, req *logica
 	resp := &logical.Response{
 		Data: rawData,
 	}
+	if expiryWarning != "" {
+		resp.AddWarning(expiryWarning)
+	}
+	for _, warning := range renderWarnings {
+		resp.AddWarning(warning)
+	}
+	if redacted > 0 {
+		resp.AddWarning(fmt.Sprintf("%d fields were removed by the field ACL", redacted))
+	}
+	b.recordRead(req.Storage, strings.TrimSuffix(path, "/"), req.EntityID)
 
 	b.Logger().Debug("scalesecSecretStore.handleRead:-> Leaving Resp with data")
 	return resp, nil
@@ -304,30 +550,47 @@ func (b *scalesecSecretStoreBackend) handleWrite(ctx context.Context, req *logic
 		return nil, err
 	}
 
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleWrite:-> *logical.Request: %v", req))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleWrite:-> *framework.FieldData: %v", data))
-
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleWrite:-> req.Path: %s", req.Path))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleWrite:-> req.MountPoint: %s", req.MountPoint))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleWrite:-> req.Data: %s", req.Data))
-	// loop over keys and values in the map.
-	for data_key, data_value := range req.Data {
-		b.Logger().Debug("scalesecSecretStore.handleWrite:-> req.Data", "key:", data_key, "value:", data_value)
-	}
-
 	// Check to make sure that we have data to actually store
 	if len(req.Data) == 0 {
 		b.Logger().Debug("scalesecSecretStore.handleWrite:-> Leaving with error")
 		return nil, fmt.Errorf("data must be provided to store in secret")
 	}
 
-	// TODO: Is this the path we want or the req.Path
-	path := data.Get("path").(string)
+	// The path field is req.Path without the mount point.  It is normalized so the lock is
+	// the same with or without a trailing slash.
+	path := normalizeSecretPath(data.Get("path").(string))
 	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleWrite:-> Path: %s", path))
 
 	// ***** ***** ***** ***** ***** ***** ***** ***** ***** ***** *****
 	// ***** Start your write logic
 
+	// Reject data that does not conform to the schemas registered for the path
+	if resp, err := b.validateSecret(ctx, req.Storage, path, req.Data); err != nil || resp != nil {
+		b.Logger().Debug("scalesecSecretStore.handleWrite:-> Leaving with schema validation error")
+		return resp, err
+	}
+
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// a deleted secret is replaced but the versions continue from it
+	secret, err := b.getSecretIncludingDeleted(ctx, req.Storage, path)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleWrite:-> Leaving with error")
+		return nil, fmt.Errorf("reading secret failed: %w", err)
+	}
+
+	// The secret is replaced by the data of the request
+	if err := b.putSecret(ctx, req.Storage, path, secret.nextVersion(req.Data, b.now())); err != nil {
+		if resp := quotaErrorResponse(err); resp != nil {
+			b.Logger().Debug("scalesecSecretStore.handleWrite:-> Leaving over quota")
+			return resp, nil
+		}
+		b.Logger().Debug("scalesecSecretStore.handleWrite:-> Leaving with error")
+		return nil, fmt.Errorf("storing secret failed: %w", err)
+	}
+
 	// ***** End - Your write logic
 	// ***** ***** ***** ***** ***** ***** ***** ***** ***** ***** *****
 
@@ -336,10 +599,77 @@ func (b *scalesecSecretStoreBackend) handleWrite(ctx context.Context, req *logic
 	return nil, nil
 }
 
+// ============================================================================================
+// handlePatch: Update some of the keys of a secret.  vault patch scalesecsecrets/test secret_key=value
+//
+// GOAL:  	Merge the request data into the stored secret (JSON merge patch RFC 7396).  A key
+// 			with a null value is removed from the secret.
+// Return:
+// 			*logical.Response := nil for success or not found if there is no secret to patch
+// 			error := Error with details if the patch failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handlePatch(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handlePatch:-> Enter")
+	// Make sure we have a ClientToken to insure we have authentication with Vault.
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handlePatch:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	// Check to make sure that we have data to actually patch
+	if len(req.Data) == 0 {
+		b.Logger().Debug("scalesecSecretStore.handlePatch:-> Leaving with error")
+		return nil, fmt.Errorf("data must be provided to patch the secret")
+	}
+
+	path := normalizeSecretPath(data.Get("path").(string))
+
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	secret, err := b.getSecret(ctx, req.Storage, path)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handlePatch:-> Leaving with error")
+		return nil, fmt.Errorf("reading secret failed: %w", err)
+	}
+	if secret == nil {
+		b.Logger().Debug("scalesecSecretStore.handlePatch:-> Leaving no value at path")
+		return nil, nil
+	}
+
+	patched, err := mergePatch(secret.Data, req.Data)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handlePatch:-> Leaving with error")
+		return nil, err
+	}
+
+	// Reject data that does not conform to the schemas registered for the path
+	if resp, err := b.validateSecret(ctx, req.Storage, path, patched); err != nil || resp != nil {
+		b.Logger().Debug("scalesecSecretStore.handlePatch:-> Leaving with schema validation error")
+		return resp, err
+	}
+
+	if err := b.putSecret(ctx, req.Storage, path, secret.nextVersion(patched, b.now())); err != nil {
+		if resp := quotaErrorResponse(err); resp != nil {
+			b.Logger().Debug("scalesecSecretStore.handlePatch:-> Leaving over quota")
+			return resp, nil
+		}
+		b.Logger().Debug("scalesecSecretStore.handlePatch:-> Leaving with error")
+		return nil, fmt.Errorf("storing secret failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handlePatch:-> Leaving")
+	return nil, nil
+}
+
 // ============================================================================================
 // handleDelete: Delete from your secret store.
 //
-// GOAL:  	Delete from your secret store
+// GOAL:  	Delete from your secret store.  The secret is marked deleted and can be undeleted
+// 			until it is purged (see scalesecSecretStoreDelete.go).
 // Return:
 // 			Response that is nil
 // 			Error with details if the delete failed or nil if success.
@@ -354,38 +684,66 @@ func (b *scalesecSecretStoreBackend) handleDelete(ctx context.Context, req *logi
 		return nil, err
 	}
 
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleDelete:-> *logical.Request: %v", req))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleDelete:-> *framework.FieldData: %v", data))
-
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleDelete:-> req.Path: %s", req.Path))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleDelete:-> req.MountPoint: %s", req.MountPoint))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleDelete:-> req.Data: %s", req.Data))
-	// loop over keys and values in the map.
-	for data_key, data_value := range req.Data {
-		b.Logger().Debug("scalesecSecretStore.handleDelete:-> req.Data", "key:", data_key, "value:", data_value)
-	}
-
 	// ***** ***** ***** ***** ***** ***** ***** ***** ***** ***** *****
 	// ***** Start your delete Logic
 
-	path := data.Get("path").(string)
+	path := normalizeSecretPath(data.Get("path").(string))
+
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
 
-	if len(req.Data) != 0 {
+	secretKey, ok := req.Data["secret_key"].(string)
+	if !ok {
 		// No data (key/value) passed on Delete request IE: vault delete scalesecsecrets/test
+		// The secret is only marked deleted so it can be undeleted until it is purged.
 		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleDelete:-> delete all secrets at path %s", path))
-	} else {
-		// data (key/value) was passed on read request IE: vault delete scalesecsecrets/test secret_key=secretPath
-		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleDelete:-> delete secrets based on data: %v", data))
+		secret, err := b.getSecret(ctx, req.Storage, path)
+		if err != nil {
+			b.Logger().Debug("scalesecSecretStore.handleDelete:-> Leaving with error")
+			return nil, fmt.Errorf("reading secret failed: %w", err)
+		}
+		if secret != nil {
+			if err := b.softDeleteSecret(ctx, req.Storage, path, secret); err != nil {
+				b.Logger().Debug("scalesecSecretStore.handleDelete:-> Leaving with error")
+				return nil, fmt.Errorf("deleting secret failed: %w", err)
+			}
+		}
+		b.Logger().Debug("scalesecSecretStore.handleDelete:-> Leaving")
+		return nil, nil
+	}
+
+	// data (key/value) was passed on delete request IE: vault delete scalesecsecrets/test secret_key=key_name
+	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleDelete:-> delete secret key %s at path %s", secretKey, path))
+	secret, err := b.getSecret(ctx, req.Storage, path)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleDelete:-> Leaving with error")
+		return nil, fmt.Errorf("reading secret failed: %w", err)
 	}
 
 	// Optional Response for delete: It is totally fine if you want to return nil for the resp.
 	// You can return a key/value response if you want.  This could be helpful if you want to
 	// return what was actually deleted.
-	var rawData map[string]interface{}
-	fetchedData := []byte(`{"delete_key1":"delete_value1", "delete_key2":"delete_value2"}`)
-	jsonutil.DecodeJSON(fetchedData, &rawData)
-	resp := &logical.Response{
-		Data: rawData,
+	var resp *logical.Response
+	if secret != nil {
+		if _, found := secret.Data[secretKey]; found {
+			if len(secret.Data) == 1 {
+				// deleting the last key deletes the secret.  It keeps its data so undelete restores it.
+				err = b.softDeleteSecret(ctx, req.Storage, path, secret)
+			} else {
+				delete(secret.Data, secretKey)
+				err = b.putSecret(ctx, req.Storage, path, secret.nextVersion(secret.Data, b.now()))
+			}
+			if err != nil {
+				b.Logger().Debug("scalesecSecretStore.handleDelete:-> Leaving with error")
+				return nil, fmt.Errorf("deleting secret key failed: %w", err)
+			}
+			resp = &logical.Response{
+				Data: map[string]interface{}{
+					"deleted_keys": []string{secretKey},
+				},
+			}
+		}
 	}
 	// ***** End your Delete Logic
 	// ***** ***** ***** ***** ***** ***** ***** ***** ***** ***** *****
@@ -415,32 +773,18 @@ func (b *scalesecSecretStoreBackend) handleList(ctx context.Context, req *logica
 		return nil, err
 	}
 
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleList:-> *logical.Request: %v", req))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleList:-> *framework.FieldData: %v", data))
-
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleList:-> req.Path: %s", req.Path))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleList:-> req.MountPoint: %s", req.MountPoint))
-	b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleList:-> req.Data: %s", req.Data))
-	// loop over keys and values in the map.
-	for data_key, data_value := range req.Data {
-		b.Logger().Debug("scalesecSecretStore.handleList:-> req.Data", "key:", data_key, "value:", data_value)
-	}
-
 	// ***** ***** ***** ***** ***** ***** ***** ***** ***** ***** *****
 	// **** Start your List logic
 
 	path := data.Get("path").(string)
 
-	// Example hardcoded data
-	fetchedData := []string{}
-	fetchedData = append(fetchedData, "key1")
-	fetchedData = append(fetchedData, "key2")
+	// tag=name: only list the secrets with the tag
+	tag, _ := req.Data["tag"].(string)
 
-	// Check to see if we have data that should be returned.
-	if fetchedData == nil {
-		b.Logger().Debug("scalesecSecretStore.handleList:-> Leaving error message in response")
-		resp := logical.ErrorResponse("No value at Mount:%v Path:%v", req.MountPoint, path)
-		return resp, nil
+	fetchedData, err := b.listSecrets(ctx, req.Storage, path, tag)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleList:-> Leaving with error")
+		return nil, fmt.Errorf("listing secrets failed: %w", err)
 	}
 
 	// Take the data and load into the response
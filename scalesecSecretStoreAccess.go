@@ -0,0 +1,247 @@
+// ********************************************************************************
+// Access tracking of the secrets
+//
+// Each read of a secret is recorded: when it was last read, how many times, and the entity
+// IDs of the last readers.  It shows which credentials are unused before they are rotated
+// or removed:
+//
+//   vault read scalesecsecrets/metadata/app/db
+//     last_read_time   2021-11-01T12:00:00Z
+//     read_count       42
+//     recent_readers   [{entity_id: ..., read_time: ...}]
+//
+// Writing storage on every read would turn each read into a write, so the reads are
+// counted in memory and the periodic function adds them to the access/<path> entries.  The
+// metadata read includes the reads that are not written yet.  A standby does not track the
+// reads it serves because it can not write storage.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Storage prefix for the access entries of the secrets
+const accessStoragePrefix = "access/"
+
+// How many recent readers are kept for a secret
+const accessRecentReaders = 10
+
+// How many secrets with reads not written yet are kept in memory.  The reads of other
+// secrets are not tracked until the next flush.
+const accessMaxPending = 10000
+
+// accessEntry is the storage entry for the reads of a secret
+type accessEntry struct {
+	ReadCount     int64          `json:"read_count"`
+	LastReadTime  *time.Time     `json:"last_read_time,omitempty"`
+	RecentReaders []accessReader `json:"recent_readers,omitempty"`
+}
+
+// accessReader is one of the recent readers of a secret, the most recent first
+type accessReader struct {
+	EntityID string    `json:"entity_id"`
+	ReadTime time.Time `json:"read_time"`
+}
+
+// accessTracker counts the reads of the secrets until they are written to storage
+type accessTracker struct {
+	lock    sync.Mutex
+	pending map[string]*accessEntry
+	storage logical.Storage
+}
+
+// recordRead counts a read of the secret at path by the entity
+func (b *scalesecSecretStoreBackend) recordRead(s logical.Storage, path string, entityID string) {
+	replicationState := b.System().ReplicationState()
+	if replicationState.HasState(consts.ReplicationPerformanceStandby) || replicationState.HasState(consts.ReplicationPerformanceSecondary) {
+		return
+	}
+
+	now := b.now()
+	read := &accessEntry{ReadCount: 1, LastReadTime: &now}
+	if entityID != "" {
+		read.RecentReaders = []accessReader{{EntityID: entityID, ReadTime: now}}
+	}
+
+	tracker := &b.access
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	if tracker.pending == nil {
+		tracker.pending = map[string]*accessEntry{}
+	}
+	tracker.storage = s
+
+	pending, ok := tracker.pending[path]
+	if !ok {
+		if len(tracker.pending) >= accessMaxPending {
+			return
+		}
+		pending = &accessEntry{}
+		tracker.pending[path] = pending
+	}
+	pending.add(read)
+}
+
+// add adds the reads of other to the entry.  other has the more recent reads.
+func (entry *accessEntry) add(other *accessEntry) {
+	entry.ReadCount += other.ReadCount
+	if other.LastReadTime != nil && (entry.LastReadTime == nil || other.LastReadTime.After(*entry.LastReadTime)) {
+		lastRead := *other.LastReadTime
+		entry.LastReadTime = &lastRead
+	}
+
+	// an entity is only listed once, at its last read
+	readers := append([]accessReader{}, other.RecentReaders...)
+	for _, reader := range entry.RecentReaders {
+		found := false
+		for _, recent := range readers {
+			if recent.EntityID == reader.EntityID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			readers = append(readers, reader)
+		}
+	}
+	sort.SliceStable(readers, func(i, j int) bool { return readers[i].ReadTime.After(readers[j].ReadTime) })
+	if len(readers) > accessRecentReaders {
+		readers = readers[:accessRecentReaders]
+	}
+	entry.RecentReaders = readers
+}
+
+// getAccess returns the reads of the secret at path: the stored ones and the ones not
+// written yet
+func (b *scalesecSecretStoreBackend) getAccess(ctx context.Context, s logical.Storage, path string) (*accessEntry, error) {
+	entry, err := getAccessEntry(ctx, s, path)
+	if err != nil {
+		return nil, err
+	}
+
+	b.access.lock.Lock()
+	defer b.access.lock.Unlock()
+	if pending, ok := b.access.pending[path]; ok {
+		entry.add(pending)
+	}
+	return entry, nil
+}
+
+// getAccessEntry reads the stored reads of the secret at path
+func getAccessEntry(ctx context.Context, s logical.Storage, path string) (*accessEntry, error) {
+	storageEntry, err := s.Get(ctx, accessStoragePrefix+path)
+	if err != nil {
+		return nil, fmt.Errorf("reading access of %q failed: %w", path, err)
+	}
+
+	entry := &accessEntry{}
+	if storageEntry == nil {
+		return entry, nil
+	}
+	if err := storageEntry.DecodeJSON(entry); err != nil {
+		return nil, fmt.Errorf("decoding access of %q failed: %w", path, err)
+	}
+	return entry, nil
+}
+
+// flushAccess adds the reads counted in memory to the stored access entries.  The reads of
+// a secret that could not be written are counted again for the next flush.
+func (b *scalesecSecretStoreBackend) flushAccess(ctx context.Context) error {
+	b.access.lock.Lock()
+	pending := b.access.pending
+	s := b.access.storage
+	b.access.pending = nil
+	b.access.lock.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(pending))
+	for path := range pending {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for i, path := range paths {
+		if err := b.writeAccess(ctx, s, path, pending[path]); err != nil {
+			// put back the reads that were not written
+			b.access.lock.Lock()
+			for _, notWritten := range paths[i:] {
+				b.requeueAccess(notWritten, pending[notWritten])
+			}
+			b.access.storage = s
+			b.access.lock.Unlock()
+			return fmt.Errorf("writing access of %q failed: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// requeueAccess puts back reads that were not written before the reads counted since.  The
+// caller holds the lock of the tracker.
+func (b *scalesecSecretStoreBackend) requeueAccess(path string, reads *accessEntry) {
+	if b.access.pending == nil {
+		b.access.pending = map[string]*accessEntry{}
+	}
+	if newer, ok := b.access.pending[path]; ok {
+		reads.add(newer)
+	}
+	b.access.pending[path] = reads
+}
+
+// writeAccess adds the reads to the stored access entry of the secret at path.  The reads
+// of a secret that was purged since are dropped.
+func (b *scalesecSecretStoreBackend) writeAccess(ctx context.Context, s logical.Storage, path string, reads *accessEntry) error {
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	secret, err := b.getSecretIncludingDeleted(ctx, s, path)
+	if err != nil || secret == nil {
+		return err
+	}
+
+	entry, err := getAccessEntry(ctx, s, path)
+	if err != nil {
+		return err
+	}
+	entry.add(reads)
+
+	storageEntry, err := logical.StorageEntryJSON(accessStoragePrefix+path, entry)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, storageEntry)
+}
+
+// accessResponseData returns the fields of the metadata response for the reads
+func (entry *accessEntry) accessResponseData() map[string]interface{} {
+	lastReadTime := ""
+	if entry.LastReadTime != nil {
+		lastReadTime = entry.LastReadTime.Format(time.RFC3339Nano)
+	}
+	readers := make([]map[string]interface{}, 0, len(entry.RecentReaders))
+	for _, reader := range entry.RecentReaders {
+		readers = append(readers, map[string]interface{}{
+			"entity_id": reader.EntityID,
+			"read_time": reader.ReadTime.Format(time.RFC3339Nano),
+		})
+	}
+
+	return map[string]interface{}{
+		"last_read_time": lastReadTime,
+		"read_count":     entry.ReadCount,
+		"recent_readers": readers,
+	}
+}
@@ -0,0 +1,106 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// The reads of a secret are on its metadata, written to storage by the periodic function
+func TestAccessTracking(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	response := sendRequest(t, b, storage, logical.ReadOperation, "metadata/app/db", nil)
+	assert.Equal(t, int64(0), response.Data["read_count"])
+	assert.Equal(t, "", response.Data["last_read_time"])
+
+	for _, entityID := range []string{"e1", "e2", "e1", ""} {
+		now = now.Add(time.Minute)
+		readAs(t, b, storage, entityID, "app/db", nil)
+	}
+
+	// the reads are not written yet but the metadata has them
+	entry, err := storage.Get(context.Background(), "access/app/db")
+	assert.Nil(t, err)
+	assert.Nil(t, entry)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "metadata/app/db", nil)
+	assert.Equal(t, int64(4), response.Data["read_count"])
+	assert.Equal(t, "2021-11-01T12:04:00Z", response.Data["last_read_time"])
+	assert.Equal(t, []map[string]interface{}{
+		{"entity_id": "e1", "read_time": "2021-11-01T12:03:00Z"},
+		{"entity_id": "e2", "read_time": "2021-11-01T12:02:00Z"},
+	}, response.Data["recent_readers"])
+
+	runPeriodic(t, b, storage)
+	entry, err = storage.Get(context.Background(), "access/app/db")
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+
+	// the new reads are added to the stored ones
+	now = now.Add(time.Minute)
+	readAs(t, b, storage, "e3", "app/db", nil)
+	runPeriodic(t, b, storage)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "metadata/app/db", nil)
+	assert.Equal(t, int64(5), response.Data["read_count"])
+	readers := response.Data["recent_readers"].([]map[string]interface{})
+	assert.Equal(t, "e3", readers[0]["entity_id"])
+	assert.Equal(t, 3, len(readers))
+
+	// a missing secret is not tracked
+	sendRequest(t, b, storage, logical.ReadOperation, "app/missing", nil)
+	assert.NotContains(t, b.(*scalesecSecretStoreBackend).access.pending, "app/missing")
+}
+
+// Only the most recent readers are kept
+func TestAccessRecentReadersBounded(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	for i := 0; i < 3*accessRecentReaders; i++ {
+		now = now.Add(time.Second)
+		readAs(t, b, storage, fmt.Sprintf("e%d", i), "app/db", nil)
+		if i%7 == 0 {
+			runPeriodic(t, b, storage)
+		}
+	}
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "metadata/app/db", nil)
+	readers := response.Data["recent_readers"].([]map[string]interface{})
+	assert.Equal(t, accessRecentReaders, len(readers))
+	assert.Equal(t, fmt.Sprintf("e%d", 3*accessRecentReaders-1), readers[0]["entity_id"])
+	assert.Equal(t, int64(3*accessRecentReaders), response.Data["read_count"])
+}
+
+// The reads of a purged secret are removed with it
+func TestAccessPurged(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	readAs(t, b, storage, "e1", "app/db", nil)
+	runPeriodic(t, b, storage)
+
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/db", nil)
+	now = now.Add(31 * 24 * time.Hour)
+	runPeriodic(t, b, storage)
+
+	entry, err := storage.Get(context.Background(), "access/app/db")
+	assert.Nil(t, err)
+	assert.Nil(t, entry)
+}
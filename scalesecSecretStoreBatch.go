@@ -0,0 +1,306 @@
+// ********************************************************************************
+// Batch: change many secrets in one request
+//
+// The batch path takes a list of operations on secret paths and applies all of them or
+// none of them.  Each operation can have a check-and-set version: the operation is only
+// applied if the secret is still at that version (cas=0: the secret must not exist).
+//
+//   vault write scalesecsecrets/batch @batch.json
+//
+//   {"operations": [
+//     {"operation": "put",    "path": "app/db",  "data": {"password": "..."}, "cas": 3},
+//     {"operation": "patch",  "path": "app/api", "data": {"key": "..."}},
+//     {"operation": "delete", "path": "app/old"}
+//   ]}
+//
+// Vault only checks the policy of the batch path, so the caller must also have the capability
+// a direct request would need on the path of each operation: create or update for a put,
+// patch for a patch and delete for a delete.  Otherwise the batch is denied as a whole.
+// The capabilities are asked from Vault with access_check_token (see
+// scalesecSecretStoreTemplate.go), so the batch path fails unless it is set in the config.
+//
+// If any operation is rejected (cas mismatch, schema validation, patch of a missing secret)
+// nothing is written and the error lists every rejected operation.  Otherwise the changes
+// and their search index entries are written with transactionalWrite and the response has
+// the result of each operation.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// The operations of a batch
+const (
+	batchOperationPut    = "put"
+	batchOperationPatch  = "patch"
+	batchOperationDelete = "delete"
+)
+
+// batchOperation is one operation of a batch request
+type batchOperation struct {
+	Operation string
+	Path      string
+	Data      map[string]interface{}
+
+	// CAS is the version the secret must be at; nil when there is no check
+	CAS *int
+}
+
+// batchPaths returns the path of the batch endpoint.
+func (b *scalesecSecretStoreBackend) batchPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.batchPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "batch$",
+
+			Fields: map[string]*framework.FieldSchema{
+				"operations": {
+					Type:        framework.TypeSlice,
+					Description: "List of operations: {operation: put|patch|delete, path, data, cas}.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleBatch,
+					Summary:  "Apply put, patch and delete operations on many secrets, all or nothing.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.batchPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleBatch: Apply a list of operations on many secrets, all or nothing
+//
+// GOAL:  	Check every operation then write all the changes in one transactional write
+// Return:
+// 			*logical.Response := the result of each operation, or an error listing the rejected ones
+// 			error := Error with details if the write failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleBatch(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleBatch:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleBatch:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	operations, err := parseBatchOperations(data.Get("operations").([]interface{}))
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleBatch:-> Leaving with invalid operations")
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	// the capabilities are asked from Vault before any secret is locked so the locks are not
+	// held during the calls
+	paths := make([]string, 0, len(operations))
+	granted := make([][]string, 0, len(operations))
+	for _, operation := range operations {
+		capabilities, err := b.accessChecker.Capabilities(ctx, req, operation.Path)
+		if err != nil {
+			b.Logger().Debug("scalesecSecretStore.handleBatch:-> Leaving with error")
+			return nil, err
+		}
+		paths = append(paths, operation.Path)
+		granted = append(granted, capabilities)
+	}
+	for _, lock := range b.secretLocksFor(paths) {
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	var rejected []string
+	changes := make([]storageChange, 0, len(operations))
+	results := make([]map[string]interface{}, 0, len(operations))
+	now := b.now()
+
+	for i, operation := range operations {
+		reject := func(reason string) {
+			rejected = append(rejected, fmt.Sprintf("operations[%d] %s %s: %s", i, operation.Operation, operation.Path, reason))
+		}
+
+		// a deleted secret does not exist for the operations but the versions of a secret
+		// put in its place continue from it
+		stored, err := b.getSecretIncludingDeleted(ctx, req.Storage, operation.Path)
+		if err != nil {
+			b.Logger().Debug("scalesecSecretStore.handleBatch:-> Leaving with error")
+			return nil, fmt.Errorf("reading secret failed: %w", err)
+		}
+		secret := stored
+		if secret != nil && secret.DeletedTime != nil {
+			secret = nil
+		}
+
+		if !hasCapability(granted[i], operation.capability(secret != nil)) {
+			b.Logger().Debug("scalesecSecretStore.handleBatch:-> Leaving permission denied")
+			// the error itself has to be ErrPermissionDenied for vault to answer 403
+			return logical.ErrorResponse("permission denied for operations[%d] %s %s", i, operation.Operation, operation.Path), logical.ErrPermissionDenied
+		}
+
+		if operation.CAS != nil {
+			version := 0
+			if secret != nil {
+				version = secret.Version
+			}
+			if version != *operation.CAS {
+				reject(fmt.Sprintf("check-and-set version %d does not match the current version %d", *operation.CAS, version))
+				continue
+			}
+		}
+
+		result := map[string]interface{}{
+			"operation": operation.Operation,
+			"path":      operation.Path,
+		}
+
+		if operation.Operation == batchOperationDelete {
+			// the secret is soft deleted like vault delete does
+			if secret != nil {
+				deletedTime := now
+				secret.DeletedTime = &deletedTime
+				secretChanges, err := b.secretChanges(ctx, req.Storage, operation.Path, secret)
+				if err != nil {
+					return nil, err
+				}
+				changes = append(changes, secretChanges...)
+			}
+			result["deleted"] = secret != nil
+			results = append(results, result)
+			continue
+		}
+
+		secretData := operation.Data
+		if operation.Operation == batchOperationPatch {
+			if secret == nil {
+				reject("there is no secret to patch")
+				continue
+			}
+			if secretData, err = mergePatch(secret.Data, operation.Data); err != nil {
+				reject(err.Error())
+				continue
+			}
+		}
+
+		resp, err := b.validateSecret(ctx, req.Storage, operation.Path, secretData)
+		if err != nil {
+			b.Logger().Debug("scalesecSecretStore.handleBatch:-> Leaving with error")
+			return nil, err
+		}
+		if resp != nil {
+			reject(resp.Error().Error())
+			continue
+		}
+
+		next := stored.nextVersion(secretData, now)
+		secretChanges, err := b.secretChanges(ctx, req.Storage, operation.Path, next)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, secretChanges...)
+		result["version"] = next.Version
+		results = append(results, result)
+	}
+
+	if len(rejected) > 0 {
+		b.Logger().Debug("scalesecSecretStore.handleBatch:-> Leaving batch rejected")
+		return logical.ErrorResponse("batch rejected, nothing was written: %s", strings.Join(rejected, "; ")), nil
+	}
+
+	if err := b.transactionalWrite(ctx, req.Storage, paths, changes); err != nil {
+		if resp := quotaErrorResponse(err); resp != nil {
+			b.Logger().Debug("scalesecSecretStore.handleBatch:-> Leaving over quota")
+			return logical.ErrorResponse("batch rejected, nothing was written: %s", resp.Error()), nil
+		}
+		b.Logger().Debug("scalesecSecretStore.handleBatch:-> Leaving with error")
+		return nil, fmt.Errorf("writing batch failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleBatch:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"results": results,
+		},
+	}, nil
+}
+
+// capability returns the capability a direct request would need for the operation
+func (operation *batchOperation) capability(exists bool) string {
+	switch {
+	case operation.Operation == batchOperationDelete:
+		return "delete"
+	case operation.Operation == batchOperationPatch:
+		return "patch"
+	case exists:
+		return "update"
+	default:
+		return "create"
+	}
+}
+
+// parseBatchOperations checks and converts the operations of the request.  A path can only
+// appear once in a batch so the result of the batch does not depend on the order.
+func parseBatchOperations(raw []interface{}) ([]*batchOperation, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("operations must be provided")
+	}
+
+	seen := map[string]bool{}
+	operations := make([]*batchOperation, 0, len(raw))
+	for i, item := range raw {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("operations[%d] must be an object", i)
+		}
+
+		operation := &batchOperation{}
+		operation.Operation, _ = fields["operation"].(string)
+		path, _ := fields["path"].(string)
+		operation.Path = strings.Trim(path, "/")
+
+		switch operation.Operation {
+		case batchOperationPut, batchOperationPatch:
+			operation.Data, _ = fields["data"].(map[string]interface{})
+			if len(operation.Data) == 0 {
+				return nil, fmt.Errorf("operations[%d] data must be provided", i)
+			}
+		case batchOperationDelete:
+		default:
+			return nil, fmt.Errorf("operations[%d] operation must be put, patch or delete", i)
+		}
+
+		if operation.Path == "" {
+			return nil, fmt.Errorf("operations[%d] path must be provided", i)
+		}
+		if seen[operation.Path] {
+			return nil, fmt.Errorf("operations[%d] path %q appears more than once", i, operation.Path)
+		}
+		seen[operation.Path] = true
+
+		if rawCAS, ok := fields["cas"]; ok && rawCAS != nil {
+			cas, err := parseutil.ParseInt(rawCAS)
+			if err != nil || cas < 0 {
+				return nil, fmt.Errorf("operations[%d] cas must be a version number", i)
+			}
+			version := int(cas)
+			operation.CAS = &version
+		}
+
+		operations = append(operations, operation)
+	}
+	return operations, nil
+}
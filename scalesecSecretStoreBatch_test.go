@@ -0,0 +1,183 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// All the operations of a batch are applied and each has a result
+func TestBatch(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/api", map[string]interface{}{"key": "k1", "url": "https://api"})
+	sendRequest(t, b, storage, logical.CreateOperation, "app/old", map[string]interface{}{"key": "old"})
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "batch", map[string]interface{}{
+		"operations": []interface{}{
+			map[string]interface{}{"operation": "put", "path": "app/db", "data": map[string]interface{}{"password": "p1"}, "cas": 0},
+			map[string]interface{}{"operation": "patch", "path": "app/api", "data": map[string]interface{}{"key": "k2"}, "cas": 1},
+			map[string]interface{}{"operation": "delete", "path": "app/old"},
+		},
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	results := response.Data["results"].([]map[string]interface{})
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, 1, results[0]["version"])
+	assert.Equal(t, 2, results[1]["version"])
+	assert.Equal(t, true, results[2]["deleted"])
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p1", response.Data["password"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/api", nil)
+	assert.Equal(t, map[string]interface{}{"key": "k2", "url": "https://api"}, response.Data)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/old", nil)
+	assert.Nil(t, response)
+	assert.Empty(t, listWAL(t, storage))
+}
+
+// A rejected operation rejects the whole batch and every rejection is reported
+func TestBatchRejected(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/api", map[string]interface{}{"key": "k1"})
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "batch", map[string]interface{}{
+		"operations": []interface{}{
+			map[string]interface{}{"operation": "put", "path": "app/db", "data": map[string]interface{}{"password": "p1"}},
+			map[string]interface{}{"operation": "put", "path": "app/api", "data": map[string]interface{}{"key": "k2"}, "cas": 0},
+			map[string]interface{}{"operation": "patch", "path": "app/missing", "data": map[string]interface{}{"key": "k2"}},
+		},
+	})
+	assert.True(t, response.IsError())
+	message := response.Error().Error()
+	assert.Contains(t, message, "operations[1] put app/api: check-and-set version 0 does not match the current version 1")
+	assert.Contains(t, message, "operations[2] patch app/missing: there is no secret to patch")
+	assert.NotContains(t, message, "operations[0]")
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Nil(t, response, "nothing is written when the batch is rejected")
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/api", nil)
+	assert.Equal(t, "k1", response.Data["key"])
+}
+
+// Malformed operations are rejected before anything is read
+func TestBatchInvalid(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	for _, operations := range [][]interface{}{
+		{},
+		{map[string]interface{}{"operation": "rename", "path": "app/db"}},
+		{map[string]interface{}{"operation": "put", "path": "app/db"}},
+		{map[string]interface{}{"operation": "delete", "path": ""}},
+		{map[string]interface{}{"operation": "delete", "path": "app/db"}, map[string]interface{}{"operation": "delete", "path": "/app/db/"}},
+		{map[string]interface{}{"operation": "delete", "path": "app/db", "cas": "x"}},
+	} {
+		response := sendRequest(t, b, storage, logical.UpdateOperation, "batch", map[string]interface{}{"operations": operations})
+		assert.True(t, response.IsError(), "operations %v", operations)
+	}
+}
+
+// The caller must have the capability of each operation on its path, not only on batch
+func TestBatchDenied(t *testing.T) {
+
+	b, storage := getBackend(t)
+	checker := b.(*scalesecSecretStoreBackend).accessChecker.(*staticAccessChecker)
+	checker.capabilities["app/db"] = []string{"read", "create"}
+	sendRequest(t, b, storage, logical.CreateOperation, "app/api", map[string]interface{}{"key": "k1"})
+
+	// create is enough for a new secret
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "batch", map[string]interface{}{
+		"operations": []interface{}{
+			map[string]interface{}{"operation": "put", "path": "app/db", "data": map[string]interface{}{"password": "p1"}},
+		},
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+
+	// an update of it is denied and nothing of the batch is written
+	response, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation:   logical.UpdateOperation,
+		Path:        "batch",
+		MountPoint:  MOUNT_POINT,
+		Storage:     storage,
+		ClientToken: "test_token",
+		Data: map[string]interface{}{
+			"operations": []interface{}{
+				map[string]interface{}{"operation": "patch", "path": "app/api", "data": map[string]interface{}{"key": "k2"}},
+				map[string]interface{}{"operation": "put", "path": "app/db", "data": map[string]interface{}{"password": "p2"}},
+			},
+		},
+	})
+	assert.Equal(t, logical.ErrPermissionDenied, err)
+	assert.Equal(t, "permission denied for operations[1] put app/db", response.Error().Error())
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/api", nil)
+	assert.Equal(t, "k1", response.Data["key"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p1", response.Data["password"])
+}
+
+// A put on a deleted secret continues its versions so a check-and-set version is never reused
+func TestBatchPutDeleted(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "app/db", map[string]interface{}{"password": "p2"})
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/db", nil)
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "batch", map[string]interface{}{
+		"operations": []interface{}{
+			map[string]interface{}{"operation": "put", "path": "app/db", "data": map[string]interface{}{"password": "p3"}, "cas": 0},
+		},
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	results := response.Data["results"].([]map[string]interface{})
+	assert.Equal(t, 3, results[0]["version"])
+
+	// the same goes for a write
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/db", nil)
+	sendRequest(t, b, storage, logical.UpdateOperation, "app/db", map[string]interface{}{"password": "p4"})
+	secret, err := b.(*scalesecSecretStoreBackend).getSecret(context.Background(), storage, "app/db")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, secret.Version)
+}
+
+// lockCheckingAccessChecker records the paths whose secret lock is held while their
+// capabilities are asked
+type lockCheckingAccessChecker struct {
+	staticAccessChecker
+	b      *scalesecSecretStoreBackend
+	locked []string
+}
+
+func (c *lockCheckingAccessChecker) Capabilities(ctx context.Context, req *logical.Request, path string) ([]string, error) {
+	lock := c.b.secretLock(path)
+	if lock.TryLock() {
+		lock.Unlock()
+	} else {
+		c.locked = append(c.locked, path)
+	}
+	return c.staticAccessChecker.Capabilities(ctx, req, path)
+}
+
+// The capabilities are asked before any secret of the batch is locked
+func TestBatchAccessCheckUnlocked(t *testing.T) {
+
+	b, storage := getBackend(t)
+	backend := b.(*scalesecSecretStoreBackend)
+	checker := &lockCheckingAccessChecker{staticAccessChecker: staticAccessChecker{capabilities: map[string][]string{}}, b: backend}
+	backend.accessChecker = checker
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "batch", map[string]interface{}{
+		"operations": []interface{}{
+			map[string]interface{}{"operation": "put", "path": "app/db", "data": map[string]interface{}{"password": "p1"}},
+			map[string]interface{}{"operation": "put", "path": "app/api", "data": map[string]interface{}{"key": "k1"}},
+		},
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	assert.Empty(t, checker.locked)
+}
@@ -0,0 +1,115 @@
+// ********************************************************************************
+// Invalidation of the caches and cleanup of the backend
+//
+// The backend keeps some storage entries in memory: the compiled schemas, the field ACL
+// rules, the rate limit rules, the quotas, the config of the mount and the secrets of the
+// read cache.  On a performance standby or a performance secondary the storage is written
+// by another node, so vault calls Invalidate with the storage key of each entry that
+// changed and the cache that holds it is dropped.  It is read from storage again on the
+// next use.
+//
+// Clean is called when the mount is unloaded: it stops the background work and releases
+// the connections of the backend.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"strings"
+)
+
+// ============================================================================================
+// invalidate: Called by vault when a storage entry was changed by another node
+//
+// GOAL:  	Drop the cache that holds the entry so it is read from storage again
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) invalidate(ctx context.Context, key string) {
+	b.Logger().Debug("scalesecSecretStore.invalidate:-> Enter", "key", key)
+
+	switch {
+	case key == configStorageKey:
+		b.resetConfig()
+	case strings.HasPrefix(key, schemaStoragePrefix):
+		b.resetSchemas()
+	case strings.HasPrefix(key, fieldACLStoragePrefix):
+		b.resetFieldACLs()
+	case strings.HasPrefix(key, rateLimitStoragePrefix):
+		b.resetRateLimits()
+	case strings.HasPrefix(key, quotaStoragePrefix):
+		b.resetQuotas()
+	case strings.HasPrefix(key, secretStoragePrefix):
+		b.forgetSecret(key)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.invalidate:-> Leaving")
+}
+
+// ============================================================================================
+// clean: Called by vault when the mount is unloaded
+//
+// GOAL:  	Stop the background work and release the resources of the backend
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) clean(ctx context.Context) {
+	b.Logger().Debug("scalesecSecretStore.clean:-> Enter")
+
+	// stop the storage migrations; they continue after their cursor on the next start
+	b.upgradeLock.Lock()
+	cancel, done := b.upgradeCancel, b.upgradeDone
+	b.upgradeLock.Unlock()
+	if cancel != nil {
+		cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+
+	// write the reads that were counted since the last periodic run
+	if err := b.flushAccess(ctx); err != nil {
+		b.Logger().Warn("scalesecSecretStore.clean:-> writing the access tracking failed", "error", err)
+	}
+
+	// send the spans that were not exported yet
+	if err := b.shutdownTracing(ctx); err != nil {
+		b.Logger().Warn("scalesecSecretStore.clean:-> exporting the spans failed", "error", err)
+	}
+
+	b.httpClient.CloseIdleConnections()
+	b.resetCaches()
+
+	b.Logger().Debug("scalesecSecretStore.clean:-> Leaving")
+}
+
+// resetCaches drops everything the backend keeps in memory from storage so it is read again
+func (b *scalesecSecretStoreBackend) resetCaches() {
+	b.resetSchemas()
+	b.resetFieldACLs()
+	b.resetRateLimits()
+	b.resetQuotas()
+	b.resetConfig()
+	b.resetReadCache()
+}
+
+// resetSchemas drops the compiled schemas
+func (b *scalesecSecretStoreBackend) resetSchemas() {
+	b.schemaLock.Lock()
+	b.schemas = nil
+	b.schemaLock.Unlock()
+}
+
+// resetFieldACLs drops the field ACL rules
+func (b *scalesecSecretStoreBackend) resetFieldACLs() {
+	b.fieldACLLock.Lock()
+	b.fieldACLs = nil
+	b.fieldACLLock.Unlock()
+}
+
+// resetConfig drops the config of the mount
+func (b *scalesecSecretStoreBackend) resetConfig() {
+	b.configLock.Lock()
+	b.config = nil
+	b.configLock.Unlock()
+}
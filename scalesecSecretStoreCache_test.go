@@ -0,0 +1,80 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// A second backend of the mount, like a performance standby.  The requests are sent to it
+// with the storage of the active node.
+func getStandbyBackend(t *testing.T) logical.Backend {
+	standby, _ := getBackend(t)
+	return standby
+}
+
+// The standby reads the config written by the active node again once it is invalidated
+func TestInvalidateConfig(t *testing.T) {
+
+	active, storage := getBackend(t)
+	standby := getStandbyBackend(t)
+
+	response := sendRequest(t, standby, storage, logical.ReadOperation, "config", nil)
+	assert.Equal(t, "warn", response.Data["expired_read"])
+
+	sendRequest(t, active, storage, logical.UpdateOperation, "config", map[string]interface{}{"expired_read": "fail"})
+	response = sendRequest(t, standby, storage, logical.ReadOperation, "config", nil)
+	assert.Equal(t, "warn", response.Data["expired_read"], "the standby serves its cache until it is invalidated")
+
+	// another key does not drop the config
+	standby.InvalidateKey(context.Background(), "data/app/db")
+	response = sendRequest(t, standby, storage, logical.ReadOperation, "config", nil)
+	assert.Equal(t, "warn", response.Data["expired_read"])
+
+	standby.InvalidateKey(context.Background(), "config")
+	response = sendRequest(t, standby, storage, logical.ReadOperation, "config", nil)
+	assert.Equal(t, "fail", response.Data["expired_read"])
+}
+
+// The standby validates the secrets with the schema written by the active node once it is
+// invalidated
+func TestInvalidateSchema(t *testing.T) {
+
+	active, storage := getBackend(t)
+	standby := getStandbyBackend(t)
+
+	response := sendRequest(t, standby, storage, logical.CreateOperation, "db/main", map[string]interface{}{"user": "admin"})
+	assert.Nil(t, response)
+
+	sendRequest(t, active, storage, logical.UpdateOperation, "schema/db", map[string]interface{}{
+		"prefix": "db/",
+		"schema": `{"type": "object", "required": ["password"]}`,
+	})
+	response = sendRequest(t, standby, storage, logical.CreateOperation, "db/other", map[string]interface{}{"user": "admin"})
+	assert.Nil(t, response, "the standby does not know the schema until it is invalidated")
+
+	standby.InvalidateKey(context.Background(), "schema/db")
+	response = sendRequest(t, standby, storage, logical.CreateOperation, "db/replica", map[string]interface{}{"user": "admin"})
+	assert.True(t, response.IsError())
+}
+
+// Clean stops the storage migrations and drops the caches
+func TestClean(t *testing.T) {
+
+	b, storage := getBackend(t)
+	writeUnindexedMount(t, b, storage)
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"expired_read": "fail"})
+
+	err := b.Initialize(context.Background(), &logical.InitializationRequest{Storage: storage})
+	assert.Nil(t, err)
+
+	b.Cleanup(context.Background())
+
+	backend := b.(*scalesecSecretStoreBackend)
+	assert.False(t, backend.upgradeRunning())
+	assert.Nil(t, backend.config)
+	assert.Nil(t, backend.schemas)
+}
@@ -0,0 +1,313 @@
+// ********************************************************************************
+// Configuration of the mount
+//
+// The settings that apply to all the secrets of the mount are written to the config path:
+//
+//   vault write scalesecsecrets/config delete_retention=720h expired_read=fail
+//
+// delete_retention   : how long a deleted secret can be undeleted before it is purged
+// expired_read       : what a read of an expired secret does: warn (default) or fail
+// cache_size         : how many secrets the read cache keeps, 0 turns it off (default 1000)
+// cache_ttl          : how long the read cache keeps a secret (default 60s)
+// log_level          : log level of the plugin for this mount (see scalesecSecretStoreLogging.go)
+// access_check_token : token of the plugin used to check the callers can read the secrets a
+//                      template references (see scalesecSecretStoreTemplate.go).  It is
+//                      never returned by a read.
+// upstream_hosts     : hosts the rotation generator and hooks may call, IE:
+//                      upstream_hosts=hooks.internal,*.db.internal:5432.  A host without a
+//                      port allows any port.  No upstream call is made until it is set.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryanuber/go-glob"
+)
+
+// Storage key of the configuration
+const configStorageKey = "config"
+
+// Default settings used until the configuration is written
+const defaultDeleteRetention = 30 * 24 * time.Hour
+
+// What a read of an expired secret does
+const (
+	expiredReadWarn = "warn"
+	expiredReadFail = "fail"
+)
+
+// mountConfig is the storage entry for the configuration of the mount
+type mountConfig struct {
+	DeleteRetention time.Duration `json:"delete_retention"`
+	ExpiredRead     string        `json:"expired_read"`
+	CacheSize       int           `json:"cache_size"`
+	CacheTTL        time.Duration `json:"cache_ttl"`
+	LogLevel        string        `json:"log_level,omitempty"`
+
+	AccessCheckToken string `json:"access_check_token,omitempty"`
+
+	UpstreamHosts []string `json:"upstream_hosts,omitempty"`
+}
+
+// defaultConfig returns the configuration used until one is written
+func defaultConfig() *mountConfig {
+	return &mountConfig{
+		DeleteRetention: defaultDeleteRetention,
+		ExpiredRead:     expiredReadWarn,
+		CacheSize:       defaultCacheSize,
+		CacheTTL:        defaultCacheTTL,
+	}
+}
+
+// configPaths returns the path to manage the configuration.
+func (b *scalesecSecretStoreBackend) configPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.configPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "config$",
+
+			Fields: map[string]*framework.FieldSchema{
+				"delete_retention": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How long a deleted secret can be undeleted before it is purged.  Defaults to 720h.",
+				},
+				"expired_read": {
+					Type:        framework.TypeString,
+					Description: "What a read of an expired secret does: warn returns it with a warning, fail rejects it.  Defaults to warn.",
+				},
+				"cache_size": {
+					Type:        framework.TypeInt,
+					Description: "How many secrets the read cache keeps.  0 turns the cache off.  Defaults to 1000.",
+				},
+				"cache_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How long the read cache keeps a secret.  Defaults to 60s.",
+				},
+				"log_level": {
+					Type:        framework.TypeString,
+					Description: "Log level of the plugin for this mount: trace, debug, info, warn or error.  Defaults to the level of vault.",
+				},
+				"access_check_token": {
+					Type:        framework.TypeString,
+					Description: "Token of the plugin with update on sys/capabilities-accessor.  Used to check the callers can read the secrets a template references.",
+					DisplayAttrs: &framework.DisplayAttributes{
+						Sensitive: true,
+					},
+				},
+				"upstream_hosts": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Hosts the rotation generator and hooks may call, as host or host:port.  *.example.com allows the hosts of the domain.  No upstream call is made until it is set.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleConfigRead,
+					Summary:  "Read the configuration of the mount.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleConfigWrite,
+					Summary:  "Update the configuration of the mount.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.configPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleConfigWrite: Update the configuration of the mount
+//
+// GOAL:  	Change the settings given in the request, the others keep their value
+// Return:
+// 			*logical.Response := nil for success or an error response if a setting is invalid
+// 			error := Error with details if the write failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleConfigWrite:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleConfigWrite:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	config, err := b.loadConfig(ctx, req.Storage)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleConfigWrite:-> Leaving with error")
+		return nil, err
+	}
+	// update a copy so the cached configuration is not changed if the write fails
+	updated := *config
+
+	if value, ok := data.GetOk("delete_retention"); ok {
+		updated.DeleteRetention = time.Duration(value.(int)) * time.Second
+		if updated.DeleteRetention < 0 {
+			return logical.ErrorResponse("delete_retention must not be negative"), nil
+		}
+	}
+	if value, ok := data.GetOk("expired_read"); ok {
+		updated.ExpiredRead = value.(string)
+		if updated.ExpiredRead != expiredReadWarn && updated.ExpiredRead != expiredReadFail {
+			return logical.ErrorResponse("expired_read must be warn or fail"), nil
+		}
+	}
+	if value, ok := data.GetOk("cache_size"); ok {
+		updated.CacheSize = value.(int)
+		if updated.CacheSize < 0 {
+			return logical.ErrorResponse("cache_size must not be negative"), nil
+		}
+	}
+	if value, ok := data.GetOk("cache_ttl"); ok {
+		updated.CacheTTL = time.Duration(value.(int)) * time.Second
+		if updated.CacheTTL <= 0 {
+			return logical.ErrorResponse("cache_ttl must be positive"), nil
+		}
+	}
+	if value, ok := data.GetOk("log_level"); ok {
+		level, err := parseLogLevel(value.(string))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		updated.LogLevel = level
+	}
+	if value, ok := data.GetOk("access_check_token"); ok {
+		updated.AccessCheckToken = value.(string)
+	}
+	if value, ok := data.GetOk("upstream_hosts"); ok {
+		updated.UpstreamHosts = nil
+		for _, host := range value.([]string) {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				updated.UpstreamHosts = append(updated.UpstreamHosts, host)
+			}
+		}
+	}
+
+	storageEntry, err := logical.StorageEntryJSON(configStorageKey, &updated)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, storageEntry); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleConfigWrite:-> Leaving with error")
+		return nil, fmt.Errorf("storing config failed: %w", err)
+	}
+	b.config = &updated
+	b.applyLogLevel(b.config)
+
+	b.Logger().Debug("scalesecSecretStore.handleConfigWrite:-> Leaving")
+	return nil, nil
+}
+
+// ============================================================================================
+// handleConfigRead: Read the configuration of the mount
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleConfigRead:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleConfigRead:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	config, err := b.getConfig(ctx, req.Storage)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleConfigRead:-> Leaving with error")
+		return nil, err
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleConfigRead:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"delete_retention": int64(config.DeleteRetention.Seconds()),
+			"expired_read":     config.ExpiredRead,
+			"cache_size":       config.CacheSize,
+			"cache_ttl":        int64(config.CacheTTL.Seconds()),
+			"log_level":        config.LogLevel,
+			// the token is never returned, only if it is set
+			"access_check_token_set": config.AccessCheckToken != "",
+			"upstream_hosts":         config.UpstreamHosts,
+		},
+	}, nil
+}
+
+// allowsUpstream returns true if the host and port are in the upstream hosts
+func (c *mountConfig) allowsUpstream(host string, port string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range c.UpstreamHosts {
+		allowedHost, allowedPort := allowed, ""
+		if splitHost, splitPort, err := net.SplitHostPort(allowed); err == nil {
+			allowedHost, allowedPort = splitHost, splitPort
+		}
+		if allowedPort != "" && allowedPort != port {
+			continue
+		}
+		if glob.Glob(allowedHost, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessCheckToken returns the token the plugin checks the access of the callers with
+func (b *scalesecSecretStoreBackend) accessCheckToken(ctx context.Context, s logical.Storage) (string, error) {
+	config, err := b.getConfig(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	return config.AccessCheckToken, nil
+}
+
+// getConfig returns the configuration of the mount.  It is read from storage once and kept
+// until it is written.
+func (b *scalesecSecretStoreBackend) getConfig(ctx context.Context, s logical.Storage) (*mountConfig, error) {
+	b.configLock.RLock()
+	config := b.config
+	b.configLock.RUnlock()
+	if config != nil {
+		return config, nil
+	}
+
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+	return b.loadConfig(ctx, s)
+}
+
+// loadConfig returns the cached configuration or reads it from storage.  The caller holds
+// the write lock of the configuration.
+func (b *scalesecSecretStoreBackend) loadConfig(ctx context.Context, s logical.Storage) (*mountConfig, error) {
+	if b.config != nil {
+		return b.config, nil
+	}
+
+	storageEntry, err := s.Get(ctx, configStorageKey)
+	if err != nil {
+		return nil, fmt.Errorf("reading config failed: %w", err)
+	}
+
+	config := defaultConfig()
+	if storageEntry != nil {
+		if err := storageEntry.DecodeJSON(config); err != nil {
+			return nil, fmt.Errorf("decoding config failed: %w", err)
+		}
+	}
+
+	b.config = config
+	b.applyLogLevel(config)
+	return config, nil
+}
@@ -0,0 +1,154 @@
+// ********************************************************************************
+// Soft delete: undelete and purge of the deleted secrets
+//
+// vault delete only marks the secret deleted.  Reads and lists do not see it but it stays in
+// storage for the delete retention of the mount (config delete_retention, 720h by default)
+// so it can be restored:
+//
+//   vault write -f scalesecsecrets/undelete/app/db
+//
+// The periodic function purges the secrets that were deleted longer than the retention ago.
+// It finds them in the index of the deleted secrets (see scalesecSecretStoreIndex.go) so only
+// the deleted secrets are listed and only the ones past the retention are read.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// deletePaths returns the path to undelete secrets.
+func (b *scalesecSecretStoreBackend) deletePaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.deletePaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "undelete/" + framework.MatchAllRegex("path"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Path of the deleted secret.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleUndelete,
+					Summary:  "Restore a deleted secret that was not purged yet.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.deletePaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleUndelete: Restore a deleted secret
+//
+// GOAL:  	Clear the deleted mark of the secret so it can be read again
+// Return:
+// 			*logical.Response := nil for success or an error response if there is no deleted secret
+// 			error := Error with details if the undelete failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleUndelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleUndelete:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleUndelete:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	path := data.Get("path").(string)
+
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	secret, err := b.getSecretIncludingDeleted(ctx, req.Storage, path)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleUndelete:-> Leaving with error")
+		return nil, fmt.Errorf("reading secret failed: %w", err)
+	}
+	if secret == nil || secret.DeletedTime == nil {
+		b.Logger().Debug("scalesecSecretStore.handleUndelete:-> Leaving no deleted secret at path")
+		return logical.ErrorResponse("there is no deleted secret at %q", path), nil
+	}
+
+	secret.DeletedTime = nil
+	if err := b.putSecret(ctx, req.Storage, path, secret); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleUndelete:-> Leaving with error")
+		return nil, fmt.Errorf("storing secret failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleUndelete:-> Leaving")
+	return nil, nil
+}
+
+// purgeDeletedSecrets removes the secrets that were deleted longer than the delete retention ago
+func (b *scalesecSecretStoreBackend) purgeDeletedSecrets(ctx context.Context, s logical.Storage) error {
+	config, err := b.getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	deleted := logical.NewStorageView(s, indexDeletedPrefix)
+	paths, err := logical.CollectKeysWithPrefix(ctx, deleted, "")
+	if err != nil {
+		return fmt.Errorf("listing deleted secrets failed: %w", err)
+	}
+
+	purgeBefore := b.now().Add(-config.DeleteRetention)
+	for _, path := range paths {
+		storageEntry, err := deleted.Get(ctx, path)
+		if err != nil {
+			return err
+		}
+		if storageEntry == nil {
+			continue
+		}
+		var entry deletedIndexEntry
+		if err := storageEntry.DecodeJSON(&entry); err != nil {
+			return fmt.Errorf("decoding deleted index entry of %q failed: %w", path, err)
+		}
+		if entry.DeletedTime.After(purgeBefore) {
+			continue
+		}
+
+		if err := b.purgeSecret(ctx, s, path, purgeBefore); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeSecret removes the secret at path if it was deleted before purgeBefore
+func (b *scalesecSecretStoreBackend) purgeSecret(ctx context.Context, s logical.Storage, path string, purgeBefore time.Time) error {
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	secret, err := b.getSecretIncludingDeleted(ctx, s, path)
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.DeletedTime == nil || secret.DeletedTime.After(purgeBefore) {
+		return nil
+	}
+
+	b.Logger().Debug("scalesecSecretStore.purgeSecret:-> purging deleted secret", "path", path)
+	if err := b.deleteSecret(ctx, s, path); err != nil {
+		return fmt.Errorf("purging secret %q failed: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// vault delete scalesecsecrets/app/db then vault write -f scalesecsecrets/undelete/app/db
+func TestUndelete(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.CreateOperation, "app/api", map[string]interface{}{"key": "k1"})
+
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/db", nil)
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Nil(t, response, "a deleted secret is not found")
+	response = sendRequest(t, b, storage, logical.ListOperation, "app/", nil)
+	assert.Equal(t, []string{"api"}, response.Data["keys"])
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "undelete/app/db", nil)
+	assert.Nil(t, response, "Response message %v", response)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p1", response.Data["password"])
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "undelete/app/db", nil)
+	assert.True(t, response.IsError(), "the secret is not deleted any more")
+}
+
+// Deleting the last key of a secret deletes the secret with that key
+func TestUndeleteLastKey(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/db", map[string]interface{}{"secret_key": "password"})
+	response := sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Nil(t, response)
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "undelete/app/db", nil)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, map[string]interface{}{"password": "p1"}, response.Data)
+}
+
+// The periodic function purges the secrets deleted longer than delete_retention ago
+func TestPurgeDeleted(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"delete_retention": "2h"})
+	assert.Nil(t, response, "Response message %v", response)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "config", nil)
+	assert.Equal(t, int64(7200), response.Data["delete_retention"])
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.CreateOperation, "app/api", map[string]interface{}{"key": "k1"})
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/db", nil)
+
+	now = now.Add(time.Hour)
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/api", nil)
+
+	// app/db was deleted 2h ago, app/api 1h ago
+	now = now.Add(time.Hour)
+	runPeriodic(t, b, storage)
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "undelete/app/db", nil)
+	assert.True(t, response.IsError(), "app/db should be purged")
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "undelete/app/api", nil)
+	assert.Nil(t, response, "app/api is still within the retention")
+}
+
+// The purge only reads the deleted secrets past the retention, found in the deleted index
+func TestPurgeDeletedIndex(t *testing.T) {
+
+	b, inmem := getBackend(t)
+	storage := &countingStorage{Storage: inmem}
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"delete_retention": "2h"})
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.CreateOperation, "app/old", map[string]interface{}{"key": "k1"})
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/old", nil)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/back", map[string]interface{}{"key": "k1"})
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/back", nil)
+	sendRequest(t, b, storage, logical.UpdateOperation, "undelete/app/back", nil)
+
+	keys, err := logical.CollectKeysWithPrefix(context.Background(), storage, indexDeletedPrefix)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{indexDeletedPrefix + "app/old"}, keys, "an undeleted secret leaves the index")
+
+	now = now.Add(3 * time.Hour)
+	reads := atomic.LoadInt64(&storage.secretReads)
+	runPeriodic(t, b, storage)
+	assert.Equal(t, reads, atomic.LoadInt64(&storage.secretReads), "a secret that is not deleted is not read")
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "undelete/app/old", nil)
+	assert.True(t, response.IsError(), "app/old should be purged")
+	keys, err = logical.CollectKeysWithPrefix(context.Background(), storage, indexDeletedPrefix)
+	assert.Nil(t, err)
+	assert.Empty(t, keys, "the purge removes the index entry")
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/back", nil)
+	assert.Equal(t, "k1", response.Data["key"])
+}
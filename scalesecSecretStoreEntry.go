@@ -0,0 +1,228 @@
+// ********************************************************************************
+// Storage of the secrets
+//
+// Secrets are stored in the Vault storage view of the mount under the data/ prefix so
+// they do not collide with the internal entries of the plugin (TOTP keys, config, ...).
+// The secret at scalesecsecrets/app/db is stored at data/app/db
+//
+// A deleted secret stays in storage with its deleted time until the purge removes it after
+// the delete retention (see scalesecSecretStoreDelete.go).  getSecret does not return it.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Storage prefix for the secrets
+const secretStoragePrefix = "data/"
+
+// secretEntry is the storage entry for a secret
+type secretEntry struct {
+	Data map[string]interface{} `json:"data"`
+
+	// Version is incremented every time the data changes
+	Version     int       `json:"version"`
+	UpdatedTime time.Time `json:"updated_time"`
+
+	// Previous is the data before the last rotation.  It stays readable for the grace period
+	// of the rotation so consumers have time to pick up the new value.
+	Previous *previousSecret `json:"previous,omitempty"`
+
+	// CustomMetadata and Tags describe the secret (owner, team, ...).  They are managed on
+	// metadata/<path> and are kept when the data changes.
+	CustomMetadata map[string]string `json:"custom_metadata,omitempty"`
+	Tags           []string          `json:"tags,omitempty"`
+
+	// ExpiresAt is when the secret stops being valid IE: the end date of a vendor API key.
+	// nil if it does not expire.  See scalesecSecretStoreExpiry.go.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// DeletedTime is set when the secret is deleted.  The secret can be undeleted until it
+	// is purged.
+	DeletedTime *time.Time `json:"deleted_time,omitempty"`
+}
+
+// previousSecret is the data of a secret before it was rotated
+type previousSecret struct {
+	Data          map[string]interface{} `json:"data"`
+	Version       int                    `json:"version"`
+	ReadableUntil time.Time              `json:"readable_until"`
+}
+
+// nextVersion returns the entry that replaces secret with data.  secret is nil when
+// there is no secret at the path yet.  The metadata of the secret is kept.  secret can be
+// deleted: the versions of the secret written in its place continue from it so a
+// check-and-set version never means two different values.
+func (secret *secretEntry) nextVersion(data map[string]interface{}, now time.Time) *secretEntry {
+	next := &secretEntry{
+		Data:        data,
+		Version:     1,
+		UpdatedTime: now,
+	}
+	if secret != nil {
+		next.Version = secret.Version + 1
+		next.CustomMetadata = secret.CustomMetadata
+		next.Tags = secret.Tags
+		next.ExpiresAt = secret.ExpiresAt
+	}
+	return next
+}
+
+// hasTag returns true if the secret is tagged with tag
+func (secret *secretEntry) hasTag(tag string) bool {
+	for _, secretTag := range secret.Tags {
+		if secretTag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// secretStorageKey returns the storage key for the secret at path.  A trailing slash is
+// ignored so scalesecsecrets/test and scalesecsecrets/test/ are the same secret.
+func secretStorageKey(path string) string {
+	return secretStoragePrefix + strings.TrimSuffix(path, "/")
+}
+
+// normalizeSecretPath returns the path of a secret without the slashes around it.  The
+// changes to a secret lock the normalized path so test and test/ take the same lock.
+func normalizeSecretPath(path string) string {
+	return strings.Trim(path, "/")
+}
+
+// secretLock returns the lock that serializes the changes to the secret at path
+func (b *scalesecSecretStoreBackend) secretLock(path string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.secretLocks, normalizeSecretPath(path))
+}
+
+// secretLocksFor returns the locks of the secrets at paths in the order they must be taken
+func (b *scalesecSecretStoreBackend) secretLocksFor(paths []string) []*locksutil.LockEntry {
+	normalized := make([]string, 0, len(paths))
+	for _, path := range paths {
+		normalized = append(normalized, normalizeSecretPath(path))
+	}
+	return locksutil.LocksForKeys(b.secretLocks, normalized)
+}
+
+// getSecret reads the secret at path from storage.  Returns nil if the secret does not exist
+// or is deleted.
+func (b *scalesecSecretStoreBackend) getSecret(ctx context.Context, s logical.Storage, path string) (*secretEntry, error) {
+	secret, err := b.getSecretIncludingDeleted(ctx, s, path)
+	if err != nil || secret == nil || secret.DeletedTime != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// getSecretIncludingDeleted reads the secret at path from storage even if it is deleted.
+// Returns nil if the secret does not exist.
+func (b *scalesecSecretStoreBackend) getSecretIncludingDeleted(ctx context.Context, s logical.Storage, path string) (*secretEntry, error) {
+	value, err := b.readSecretValue(ctx, s, path)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	var secret secretEntry
+	if err := jsonutil.DecodeJSON(value, &secret); err != nil {
+		return nil, fmt.Errorf("decoding secret %q failed: %w", path, err)
+	}
+	return &secret, nil
+}
+
+// putSecret writes the secret at path to storage with its search index entries.  The
+// caller holds the lock of the secret.
+func (b *scalesecSecretStoreBackend) putSecret(ctx context.Context, s logical.Storage, path string, secret *secretEntry) error {
+	changes, err := b.secretChanges(ctx, s, path, secret)
+	if err != nil {
+		return err
+	}
+	return b.transactionalWrite(ctx, s, []string{path}, changes)
+}
+
+// softDeleteSecret marks the secret at path as deleted
+func (b *scalesecSecretStoreBackend) softDeleteSecret(ctx context.Context, s logical.Storage, path string, secret *secretEntry) error {
+	now := b.now()
+	secret.DeletedTime = &now
+	return b.putSecret(ctx, s, path, secret)
+}
+
+// deleteSecret removes the secret at path from storage with its search index entries.  The
+// caller holds the lock of the secret.
+func (b *scalesecSecretStoreBackend) deleteSecret(ctx context.Context, s logical.Storage, path string) error {
+	changes, err := b.secretChanges(ctx, s, path, nil)
+	if err != nil {
+		return err
+	}
+	return b.transactionalWrite(ctx, s, []string{path}, changes)
+}
+
+// listSecrets returns the secrets and folders directly under path.  Deleted secrets are not
+// listed.  If tag is set only the secrets with the tag are listed, without the folders.
+func (b *scalesecSecretStoreBackend) listSecrets(ctx context.Context, s logical.Storage, path string, tag string) ([]string, error) {
+	folder := ""
+	if path = strings.TrimSuffix(path, "/"); path != "" {
+		folder = path + "/"
+	}
+
+	keys, err := s.List(ctx, secretStoragePrefix+folder)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if strings.HasSuffix(key, "/") {
+			if tag == "" {
+				listed = append(listed, key)
+			}
+			continue
+		}
+
+		secret, err := b.getSecret(ctx, s, folder+key)
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil || (tag != "" && !secret.hasTag(tag)) {
+			continue
+		}
+		listed = append(listed, key)
+	}
+	return listed, nil
+}
+
+// mergePatch applies patch to the secret data as a JSON merge patch (RFC 7396)
+func mergePatch(secretData map[string]interface{}, patch map[string]interface{}) (map[string]interface{}, error) {
+	original, err := json.Marshal(secretData)
+	if err != nil {
+		return nil, err
+	}
+	patchJSON, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := jsonpatch.MergePatch(original, patchJSON)
+	if err != nil {
+		return nil, fmt.Errorf("patching secret failed: %w", err)
+	}
+
+	var patched map[string]interface{}
+	if err := jsonutil.DecodeJSON(merged, &patched); err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
@@ -0,0 +1,138 @@
+// ********************************************************************************
+// Expiry of the secrets
+//
+// A secret can have an expiry date, IE: the end date of a vendor API key.  It is set with
+// expires_at on metadata/<path>.  A read of an expired secret either returns the secret
+// with a warning or fails, depending on expired_read in the config of the mount.
+//
+// The expiring path lists the secrets that expire within a window, and the ones already
+// expired, so they can be renewed in time:
+//
+//   vault read scalesecsecrets/expiring within=720h
+//
+// A secret is only listed if the caller has read or list on its path, so the list fails
+// unless access_check_token is set in the config (see scalesecSecretStoreTemplate.go).
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Default window of the expiring path: 7 days
+const defaultExpiringWithin = 7 * 24 * 60 * 60
+
+// expiryPaths returns the path to list the expiring secrets.
+func (b *scalesecSecretStoreBackend) expiryPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.expiryPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "expiring$",
+
+			Fields: map[string]*framework.FieldSchema{
+				"within": {
+					Type:        framework.TypeDurationSecond,
+					Default:     defaultExpiringWithin,
+					Description: "List the secrets that expire within this duration.  Defaults to 168h.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleExpiring,
+					Summary:  "List the secrets that are expired or expire within a window.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.expiryPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleExpiring: List the secrets that are expired or expire within a window
+//
+// GOAL:  	Find the secrets to renew from the search index
+// Return:
+// 			*logical.Response := keys and key_info with the expiry of each secret
+// 			error := Error with details if the list failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleExpiring(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleExpiring:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleExpiring:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	within := time.Duration(data.Get("within").(int)) * time.Second
+	if within < 0 {
+		return logical.ErrorResponse("within must not be negative"), nil
+	}
+
+	paths, err := logical.CollectKeysWithPrefix(ctx, logical.NewStorageView(req.Storage, indexSecretsPrefix), "")
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleExpiring:-> Leaving with error")
+		return nil, fmt.Errorf("listing the index failed: %w", err)
+	}
+	sort.Strings(paths)
+
+	now := b.now()
+	until := now.Add(within)
+	keys := []string{}
+	keyInfo := map[string]interface{}{}
+	for _, path := range paths {
+		entry, err := b.getIndexEntry(ctx, req.Storage, path)
+		if err != nil {
+			b.Logger().Debug("scalesecSecretStore.handleExpiring:-> Leaving with error")
+			return nil, fmt.Errorf("reading the index failed: %w", err)
+		}
+		if entry == nil || entry.ExpiresAt == nil || entry.ExpiresAt.After(until) {
+			continue
+		}
+		allowed, err := b.canAccess(ctx, req, path, "read", "list")
+		if err != nil {
+			b.Logger().Debug("scalesecSecretStore.handleExpiring:-> Leaving with error")
+			return nil, err
+		}
+		if !allowed {
+			continue
+		}
+
+		keys = append(keys, path)
+		keyInfo[path] = map[string]interface{}{
+			"expires_at": entry.ExpiresAt.Format(time.RFC3339Nano),
+			"expired":    !now.Before(*entry.ExpiresAt),
+		}
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleExpiring:-> Leaving")
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+// checkExpiry returns a message if the secret is expired and whether the read must fail
+// because of it according to the config of the mount
+func (b *scalesecSecretStoreBackend) checkExpiry(ctx context.Context, s logical.Storage, path string, secret *secretEntry) (string, bool, error) {
+	if secret.ExpiresAt == nil || b.now().Before(*secret.ExpiresAt) {
+		return "", false, nil
+	}
+
+	config, err := b.getConfig(ctx, s)
+	if err != nil {
+		return "", false, err
+	}
+
+	message := fmt.Sprintf("secret %q expired at %s", path, secret.ExpiresAt.Format(time.RFC3339))
+	return message, config.ExpiredRead == expiredReadFail, nil
+}
@@ -0,0 +1,78 @@
+package scalesecSecretStore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// A read of an expired secret has a warning, or fails with expired_read=fail
+func TestExpiredRead(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.CreateOperation, "vendor/api", map[string]interface{}{"key": "k1"})
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "metadata/vendor/api", map[string]interface{}{
+		"expires_at": "2021-01-02T00:00:00Z",
+	})
+	assert.Nil(t, response, "Response message %v", response)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "vendor/api", nil)
+	assert.Equal(t, "k1", response.Data["key"])
+	assert.Empty(t, response.Warnings, "the secret is not expired yet")
+
+	now = now.Add(48 * time.Hour)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "vendor/api", nil)
+	assert.Equal(t, "k1", response.Data["key"])
+	assert.Equal(t, []string{`secret "vendor/api" expired at 2021-01-02T00:00:00Z`}, response.Warnings)
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"expired_read": "fail"})
+	response = sendRequest(t, b, storage, logical.ReadOperation, "vendor/api", nil)
+	assert.True(t, response.IsError())
+	assert.NotContains(t, response.Data, "key")
+
+	// expires_at=0 removes the expiry
+	sendRequest(t, b, storage, logical.UpdateOperation, "metadata/vendor/api", map[string]interface{}{"expires_at": 0})
+	response = sendRequest(t, b, storage, logical.ReadOperation, "vendor/api", nil)
+	assert.Equal(t, "k1", response.Data["key"])
+}
+
+// vault read scalesecsecrets/expiring within=720h
+func TestExpiring(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	for path, expiresAt := range map[string]time.Time{
+		"vendor/expired": now.Add(-time.Hour),
+		"vendor/soon":    now.Add(24 * time.Hour),
+		"vendor/later":   now.Add(60 * 24 * time.Hour),
+	} {
+		sendRequest(t, b, storage, logical.CreateOperation, path, map[string]interface{}{"key": "k1"})
+		sendRequest(t, b, storage, logical.UpdateOperation, "metadata/"+path, map[string]interface{}{"expires_at": expiresAt.Unix()})
+	}
+	sendRequest(t, b, storage, logical.CreateOperation, "vendor/never", map[string]interface{}{"key": "k1"})
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "expiring", nil)
+	assert.Equal(t, []string{"vendor/expired", "vendor/soon"}, response.Data["keys"])
+	keyInfo := response.Data["key_info"].(map[string]interface{})
+	assert.Equal(t, true, keyInfo["vendor/expired"].(map[string]interface{})["expired"])
+	assert.Equal(t, false, keyInfo["vendor/soon"].(map[string]interface{})["expired"])
+	assert.Equal(t, "2021-01-02T00:00:00Z", keyInfo["vendor/soon"].(map[string]interface{})["expires_at"])
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "expiring", map[string]interface{}{"within": "2160h"})
+	assert.Equal(t, []string{"vendor/expired", "vendor/later", "vendor/soon"}, response.Data["keys"])
+
+	// the secrets the caller can not read or list are left out
+	checker := b.(*scalesecSecretStoreBackend).accessChecker.(*staticAccessChecker)
+	checker.capabilities["vendor/soon"] = []string{"deny"}
+	response = sendRequest(t, b, storage, logical.ReadOperation, "expiring", nil)
+	assert.Equal(t, []string{"vendor/expired"}, response.Data["keys"])
+	assert.NotContains(t, response.Data["key_info"], "vendor/soon")
+}
@@ -0,0 +1,611 @@
+// ********************************************************************************
+// Export and import of the whole mount as an encrypted bundle
+//
+// export writes every secret (with its previous version and metadata), the config, the
+// schemas, the field ACLs, the rate limits and the quotas to a bundle encrypted to a public
+// key:
+//
+//   vault write -field=bundle scalesecsecrets/export recipient=age1... > mount.bundle
+//   vault write -field=bundle scalesecsecrets/export recipient=@rsa-public.pem > mount.bundle
+//
+// import reads a bundle with the matching private key and writes its secrets.  The settings
+// of the bundle are not imported, they are listed as skipped to be set on their own paths,
+// so an import can not change the config, the ACLs or the quotas of the mount.  The caller
+// needs create on each new path and update on each existing one, like a write of the
+// secret, and the secrets are validated against the schemas of the mount.  The bundle is
+// first read as a dry run so a path the caller may not write rejects the whole import before
+// anything is written.  A secret that exists in the mount gets a new version: its version
+// numbers are never reused.  dry_run=true only reports what would be added or changed.
+// Secrets of the mount that are not in the bundle are kept.  A secret over a quota stops the
+// import and the error tells the entries already written.
+//
+//   vault write scalesecsecrets/import bundle=@mount.bundle private_key=@key.txt dry_run=true
+//
+// The bundle is an age file (https://age-encryption.org) holding gzipped JSON lines, one
+// per storage entry, base64 encoded.  The recipient is an age X25519 public key or an RSA
+// public key in PEM; RSA-OAEP keys are an age recipient of their own (scalesec-rsa-oaep).
+// The entries are encrypted and decrypted one at a time so the secrets are never all held in
+// clear.  The encrypted bundle itself is built in memory: it is returned in the response and
+// sent back in the request of the import, so a mount is only exported in one bundle while it
+// fits in the request size vault allows (max_request_size).
+//
+// The credentials are not exported: the TOTP keys, the rotations with the connection URLs
+// of their hooks and the access_check_token of the config.  Neither are the deleted secrets.
+// The WAL and the search index are not exported: the index is rebuilt as the secrets are
+// imported.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Version of the format of the bundle
+const bundleFormatVersion = 1
+
+// The kinds of the records of a bundle
+const (
+	bundleKindHeader  = "header"
+	bundleKindSecret  = "secret"
+	bundleKindStorage = "storage"
+)
+
+// exportSkipPrefixes are the storage prefixes that are not exported because they are
+// rebuilt or only matter to the running mount.  The shares are not exported so a one-time
+// value is never copied.  The usage of the quotas is counted again from the secrets.  The
+// TOTP keys and the rotations hold credentials.
+var exportSkipPrefixes = []string{"wal/", "index/", storageVersionKey, shareStoragePrefix, quotaUsageStoragePrefix, "totp/", rotationStoragePrefix}
+
+// bundleRecord is one line of a bundle.  Key is the path of a secret or the storage key of
+// another entry; Value the stored entry.
+type bundleRecord struct {
+	Kind  string `json:"kind"`
+	Key   string `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+}
+
+// bundleHeader is the value of the first record of a bundle
+type bundleHeader struct {
+	FormatVersion int       `json:"format_version"`
+	CreatedTime   time.Time `json:"created_time"`
+}
+
+// exportPaths returns the paths to export and import the mount.
+func (b *scalesecSecretStoreBackend) exportPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.exportPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "export$",
+
+			Fields: map[string]*framework.FieldSchema{
+				"recipient": {
+					Type:        framework.TypeString,
+					Description: "Public key the bundle is encrypted to: an age X25519 recipient (age1...) or an RSA public key in PEM.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleExport,
+					Summary:  "Export the whole mount as an encrypted bundle.",
+				},
+			},
+		},
+		{
+			Pattern: "import$",
+
+			Fields: map[string]*framework.FieldSchema{
+				"bundle": {
+					Type:        framework.TypeString,
+					Description: "Bundle written by export.",
+				},
+				"private_key": {
+					Type:        framework.TypeString,
+					Description: "Private key of the recipient: an age X25519 identity (AGE-SECRET-KEY-1...) or an RSA private key in PEM.",
+				},
+				"dry_run": {
+					Type:        framework.TypeBool,
+					Description: "Only report what the import would add and change.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleImport,
+					Summary:  "Import the secrets of a bundle written by export.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.exportPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleExport: Export the whole mount as an encrypted bundle
+//
+// GOAL:  	Stream every storage entry of the mount through gzip and age into the bundle
+// Return:
+// 			*logical.Response := the base64 bundle and the number of entries in it
+// 			error := Error with details if the export failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleExport(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleExport:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleExport:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	recipient, err := parseRecipient(data.Get("recipient").(string))
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleExport:-> Leaving with invalid recipient")
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	keys, err := logical.CollectKeys(ctx, req.Storage)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleExport:-> Leaving with error")
+		return nil, fmt.Errorf("listing storage failed: %w", err)
+	}
+
+	// records -> gzip -> age -> base64 -> bundle
+	var bundle bytes.Buffer
+	encoded := base64.NewEncoder(base64.StdEncoding, &bundle)
+	encrypted, err := age.Encrypt(encoded, recipient)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting bundle failed: %w", err)
+	}
+	compressed := gzip.NewWriter(encrypted)
+	encoder := json.NewEncoder(compressed)
+
+	header, err := json.Marshal(&bundleHeader{FormatVersion: bundleFormatVersion, CreatedTime: b.now()})
+	if err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(&bundleRecord{Kind: bundleKindHeader, Value: header}); err != nil {
+		return nil, fmt.Errorf("writing bundle failed: %w", err)
+	}
+
+	secrets := 0
+	entries := 0
+	for _, key := range keys {
+		if skipExport(key) {
+			continue
+		}
+
+		storageEntry, err := req.Storage.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("reading %q failed: %w", key, err)
+		}
+		if storageEntry == nil {
+			continue
+		}
+
+		record := &bundleRecord{Kind: bundleKindStorage, Key: key, Value: storageEntry.Value}
+		switch {
+		case strings.HasPrefix(key, secretStoragePrefix):
+			var secret secretEntry
+			if err := storageEntry.DecodeJSON(&secret); err != nil {
+				return nil, fmt.Errorf("decoding %q failed: %w", key, err)
+			}
+			if secret.DeletedTime != nil {
+				continue
+			}
+			record.Kind = bundleKindSecret
+			record.Key = strings.TrimPrefix(key, secretStoragePrefix)
+			secrets++
+		case key == configStorageKey:
+			if record.Value, err = exportConfig(storageEntry); err != nil {
+				return nil, err
+			}
+		}
+		if err := encoder.Encode(record); err != nil {
+			return nil, fmt.Errorf("writing bundle failed: %w", err)
+		}
+		entries++
+	}
+
+	for _, closer := range []io.Closer{compressed, encrypted, encoded} {
+		if err := closer.Close(); err != nil {
+			return nil, fmt.Errorf("writing bundle failed: %w", err)
+		}
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleExport:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"bundle":  bundle.String(),
+			"secrets": secrets,
+			"entries": entries,
+		},
+	}, nil
+}
+
+// ============================================================================================
+// handleImport: Import a bundle written by export
+//
+// GOAL:  	Stream the records out of the bundle and store each secret that is new or changed
+// Return:
+// 			*logical.Response := the storage keys added, changed, skipped and failed, the number unchanged
+// 			error := Error with details if the import failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleImport(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleImport:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleImport:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	identity, err := parseIdentity(data.Get("private_key").(string))
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleImport:-> Leaving with invalid private key")
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	dryRun := data.Get("dry_run").(bool)
+	bundle := strings.TrimSpace(data.Get("bundle").(string))
+
+	// the dry run checks the access to every path before the first write
+	report, resp, err := b.importBundle(ctx, req, bundle, identity, true)
+	if resp == nil && err == nil && !dryRun {
+		report, resp, err = b.importBundle(ctx, req, bundle, identity, false)
+	}
+	if resp != nil {
+		b.Logger().Debug("scalesecSecretStore.handleImport:-> Leaving with invalid bundle")
+		return resp, nil
+	}
+	if err != nil {
+		if resp := importQuotaErrorResponse(err, report.Written); resp != nil {
+			b.Logger().Debug("scalesecSecretStore.handleImport:-> Leaving over quota")
+			return resp, nil
+		}
+		b.Logger().Debug("scalesecSecretStore.handleImport:-> Leaving with error")
+		if errors.Is(err, logical.ErrPermissionDenied) {
+			return logical.ErrorResponse(err.Error()), logical.ErrPermissionDenied
+		}
+		return nil, err
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleImport:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"dry_run":   dryRun,
+			"added":     report.Added,
+			"changed":   report.Changed,
+			"unchanged": report.Unchanged,
+			"skipped":   report.Skipped,
+			"failed":    report.Failed,
+		},
+	}, nil
+}
+
+// bundleReport is what an import of a bundle did or would do.  The entries are storage keys.
+type bundleReport struct {
+	Added     []string
+	Changed   []string
+	Unchanged int
+	// Skipped are the settings of the bundle, they are not imported
+	Skipped []string
+	// Failed are the secrets rejected by a schema, with the reason
+	Failed []string
+	// Written are the entries written so far
+	Written []string
+}
+
+// importBundle reads the records out of the bundle and imports its secrets.  A bundle that
+// can not be read is an error response.  On error the report has what was done before it.
+func (b *scalesecSecretStoreBackend) importBundle(ctx context.Context, req *logical.Request, bundle string, identity age.Identity, dryRun bool) (*bundleReport, *logical.Response, error) {
+	report := &bundleReport{
+		Added:   []string{},
+		Changed: []string{},
+		Skipped: []string{},
+		Failed:  []string{},
+		Written: []string{},
+	}
+
+	// bundle -> base64 -> age -> gzip -> records
+	decrypted, err := age.Decrypt(base64.NewDecoder(base64.StdEncoding, strings.NewReader(bundle)), identity)
+	if err != nil {
+		return report, logical.ErrorResponse("decrypting bundle failed: %s", err), nil
+	}
+	decompressed, err := gzip.NewReader(decrypted)
+	if err != nil {
+		return report, logical.ErrorResponse("reading bundle failed: %s", err), nil
+	}
+	decoder := json.NewDecoder(decompressed)
+
+	var header bundleHeader
+	var record bundleRecord
+	if err := decoder.Decode(&record); err != nil || record.Kind != bundleKindHeader {
+		return report, logical.ErrorResponse("reading bundle failed: the bundle has no header"), nil
+	}
+	if err := json.Unmarshal(record.Value, &header); err != nil || header.FormatVersion != bundleFormatVersion {
+		return report, logical.ErrorResponse("the bundle format version is not supported"), nil
+	}
+
+	for {
+		record = bundleRecord{}
+		err := decoder.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return report, logical.ErrorResponse("reading bundle failed: %s", err), nil
+		}
+
+		switch record.Kind {
+		case bundleKindSecret:
+			var secret secretEntry
+			if err := json.Unmarshal(record.Value, &secret); err != nil {
+				return report, logical.ErrorResponse("the bundle has an invalid secret %q", record.Key), nil
+			}
+			if err := b.importBundleSecret(ctx, req, record.Key, &secret, dryRun, report); err != nil {
+				return report, nil, fmt.Errorf("importing %q failed: %w", record.Key, err)
+			}
+		case bundleKindStorage:
+			report.Skipped = append(report.Skipped, record.Key)
+		default:
+			return report, logical.ErrorResponse("the bundle has an entry of unknown kind %q", record.Kind), nil
+		}
+	}
+	return report, nil, nil
+}
+
+// importBundleSecret writes a secret of a bundle at path and adds the outcome to the report.
+// Data rejected by a schema is reported as failed.
+func (b *scalesecSecretStoreBackend) importBundleSecret(ctx context.Context, req *logical.Request, path string, imported *secretEntry, dryRun bool, report *bundleReport) error {
+	s := req.Storage
+	key := secretStorageKey(path)
+
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// a deleted secret does not exist for the import but the versions continue from it
+	stored, err := b.getSecretIncludingDeleted(ctx, s, path)
+	if err != nil {
+		return err
+	}
+	secret := stored
+	if secret != nil && secret.DeletedTime != nil {
+		secret = nil
+	}
+
+	// checked before the secret is compared so the report does not tell what a path holds
+	capability := "create"
+	if secret != nil {
+		capability = "update"
+	}
+	allowed, err := b.canAccess(ctx, req, path, capability)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("no %s capability: %w", capability, logical.ErrPermissionDenied)
+	}
+
+	if secret != nil {
+		same, err := sameBundleSecret(secret, imported)
+		if err != nil {
+			return err
+		}
+		if same {
+			report.Unchanged++
+			return nil
+		}
+	}
+
+	resp, err := b.validateSecret(ctx, s, path, imported.Data)
+	if err != nil {
+		return err
+	}
+	if resp != nil {
+		report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", key, resp.Error()))
+		return nil
+	}
+
+	if !dryRun {
+		// A new path keeps the versions of the bundle.  Over a secret of the mount the
+		// imported secret is the next version and the previous version of the bundle is
+		// dropped: its version number is one of the mount.
+		next := imported
+		if stored != nil {
+			next = stored.nextVersion(imported.Data, b.now())
+			next.CustomMetadata = imported.CustomMetadata
+			next.Tags = imported.Tags
+			next.ExpiresAt = imported.ExpiresAt
+		}
+		if next.Version < 1 {
+			next.Version = 1
+		}
+		next.DeletedTime = nil
+		if err := b.putSecret(ctx, s, path, next); err != nil {
+			return err
+		}
+		report.Written = append(report.Written, key)
+	}
+
+	if secret == nil {
+		report.Added = append(report.Added, key)
+	} else {
+		report.Changed = append(report.Changed, key)
+	}
+	return nil
+}
+
+// sameBundleSecret compares the data and the metadata of a secret of the mount and of a bundle
+func sameBundleSecret(secret *secretEntry, imported *secretEntry) (bool, error) {
+	same, err := sameSecretData(secret.Data, imported.Data)
+	if err != nil || !same {
+		return false, err
+	}
+	metadata := func(secret *secretEntry) map[string]interface{} {
+		return map[string]interface{}{
+			"custom_metadata": secret.CustomMetadata,
+			"tags":            secret.Tags,
+			"expires_at":      secret.ExpiresAt,
+		}
+	}
+	return sameSecretData(metadata(secret), metadata(imported))
+}
+
+// exportConfig returns the stored config without the access check token
+func exportConfig(storageEntry *logical.StorageEntry) ([]byte, error) {
+	var config mountConfig
+	if err := storageEntry.DecodeJSON(&config); err != nil {
+		return nil, fmt.Errorf("decoding config failed: %w", err)
+	}
+	config.AccessCheckToken = ""
+	return json.Marshal(&config)
+}
+
+// skipExport returns true if the storage key is not exported
+func skipExport(key string) bool {
+	for _, prefix := range exportSkipPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRecipient returns the age recipient of an age X25519 public key or an RSA public key in PEM
+func parseRecipient(recipient string) (age.Recipient, error) {
+	recipient = strings.TrimSpace(recipient)
+	if recipient == "" {
+		return nil, fmt.Errorf("recipient must be provided")
+	}
+	if strings.HasPrefix(recipient, "age1") {
+		return age.ParseX25519Recipient(recipient)
+	}
+
+	block, _ := pem.Decode([]byte(recipient))
+	if block == nil {
+		return nil, fmt.Errorf("recipient must be an age X25519 public key or an RSA public key in PEM")
+	}
+	var publicKey interface{}
+	var err error
+	if block.Type == "RSA PUBLIC KEY" {
+		publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing recipient failed: %w", err)
+	}
+	rsaKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("recipient must be an RSA public key")
+	}
+	return &rsaRecipient{publicKey: rsaKey}, nil
+}
+
+// parseIdentity returns the age identity of an age X25519 identity or an RSA private key in PEM
+func parseIdentity(privateKey string) (age.Identity, error) {
+	privateKey = strings.TrimSpace(privateKey)
+	if privateKey == "" {
+		return nil, fmt.Errorf("private_key must be provided")
+	}
+	if strings.HasPrefix(privateKey, "AGE-SECRET-KEY-1") {
+		return age.ParseX25519Identity(privateKey)
+	}
+
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return nil, fmt.Errorf("private_key must be an age X25519 identity or an RSA private key in PEM")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing private_key failed: %w", err)
+		}
+		return &rsaIdentity{privateKey: rsaKey}, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private_key failed: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private_key must be an RSA private key")
+	}
+	return &rsaIdentity{privateKey: rsaKey}, nil
+}
+
+// --------------------------------------------------------------------------------------------
+// RSA-OAEP age recipient
+//
+// The age file key is encrypted with RSA-OAEP SHA-256.  The stanza has the fingerprint of
+// the public key so an identity only tries the stanzas made for it.
+// --------------------------------------------------------------------------------------------
+
+const rsaStanzaType = "scalesec-rsa-oaep"
+
+// OAEP label so the encrypted file key can not be used for something else
+var rsaOAEPLabel = []byte("scalesec-secret-store/export")
+
+type rsaRecipient struct {
+	publicKey *rsa.PublicKey
+}
+
+func (r *rsaRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, r.publicKey, fileKey, rsaOAEPLabel)
+	if err != nil {
+		return nil, err
+	}
+	return []*age.Stanza{{
+		Type: rsaStanzaType,
+		Args: []string{rsaFingerprint(r.publicKey)},
+		Body: wrapped,
+	}}, nil
+}
+
+type rsaIdentity struct {
+	privateKey *rsa.PrivateKey
+}
+
+func (i *rsaIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	fingerprint := rsaFingerprint(&i.privateKey.PublicKey)
+	for _, stanza := range stanzas {
+		if stanza.Type != rsaStanzaType || len(stanza.Args) != 1 || stanza.Args[0] != fingerprint {
+			continue
+		}
+		fileKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, i.privateKey, stanza.Body, rsaOAEPLabel)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting file key failed: %w", err)
+		}
+		return fileKey, nil
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// rsaFingerprint returns a short fingerprint of the public key
+func rsaFingerprint(publicKey *rsa.PublicKey) string {
+	sum := sha256.Sum256(x509.MarshalPKCS1PublicKey(publicKey))
+	return base64.RawStdEncoding.EncodeToString(sum[:8])
+}
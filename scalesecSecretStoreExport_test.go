@@ -0,0 +1,292 @@
+package scalesecSecretStore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// write a mount with a secret with metadata, a config and a schema
+func writeExportMount(t *testing.T, b logical.Backend, storage logical.Storage) {
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "app/db", map[string]interface{}{"password": "p2"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "metadata/app/db", map[string]interface{}{"tags": "prod"})
+	sendRequest(t, b, storage, logical.CreateOperation, "app/api", map[string]interface{}{"key": "k1"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"expired_read": "fail"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "schema/db", map[string]interface{}{
+		"prefix": "db/",
+		"schema": `{"type": "object", "required": ["password"]}`,
+	})
+}
+
+// Export a mount with an age key and import it in another one
+func TestExportImportAge(t *testing.T) {
+
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	source, sourceStorage := getBackend(t)
+	writeExportMount(t, source, sourceStorage)
+
+	response := sendRequest(t, source, sourceStorage, logical.UpdateOperation, "export", map[string]interface{}{
+		"recipient": identity.Recipient().String(),
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	assert.Equal(t, 2, response.Data["secrets"])
+	assert.Equal(t, 4, response.Data["entries"])
+	bundle := response.Data["bundle"].(string)
+
+	target, targetStorage := getBackend(t)
+	sendRequest(t, target, targetStorage, logical.CreateOperation, "app/api", map[string]interface{}{"key": "other"})
+
+	// the dry run reports the differences without writing anything
+	response = sendRequest(t, target, targetStorage, logical.UpdateOperation, "import", map[string]interface{}{
+		"bundle":      bundle,
+		"private_key": identity.String(),
+		"dry_run":     true,
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	assert.Equal(t, []string{"data/app/db"}, response.Data["added"])
+	assert.Equal(t, []string{"data/app/api"}, response.Data["changed"])
+	assert.ElementsMatch(t, []string{"config", "schema/db"}, response.Data["skipped"], "the settings are not imported")
+	response = sendRequest(t, target, targetStorage, logical.ReadOperation, "app/db", nil)
+	assert.Nil(t, response)
+
+	response = sendRequest(t, target, targetStorage, logical.UpdateOperation, "import", map[string]interface{}{
+		"bundle":      bundle,
+		"private_key": identity.String(),
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+
+	response = sendRequest(t, target, targetStorage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p2", response.Data["password"])
+	response = sendRequest(t, target, targetStorage, logical.ReadOperation, "metadata/app/db", nil)
+	assert.Equal(t, 2, response.Data["version"])
+	assert.Equal(t, []string{"prod"}, response.Data["tags"])
+	response = sendRequest(t, target, targetStorage, logical.ReadOperation, "app/api", nil)
+	assert.Equal(t, "k1", response.Data["key"])
+	response = sendRequest(t, target, targetStorage, logical.ReadOperation, "metadata/app/api", nil)
+	assert.Equal(t, 2, response.Data["version"], "the version of a secret of the mount moves forward")
+	response = sendRequest(t, target, targetStorage, logical.ReadOperation, "config", nil)
+	assert.Equal(t, "warn", response.Data["expired_read"])
+	response = sendRequest(t, target, targetStorage, logical.ReadOperation, "search", map[string]interface{}{"tag": "prod"})
+	assert.Equal(t, []string{"app/db"}, response.Data["keys"], "the index is rebuilt by the import")
+
+	// importing again changes nothing
+	response = sendRequest(t, target, targetStorage, logical.UpdateOperation, "import", map[string]interface{}{
+		"bundle":      bundle,
+		"private_key": identity.String(),
+	})
+	assert.Empty(t, response.Data["added"])
+	assert.Empty(t, response.Data["changed"])
+	assert.Equal(t, 2, response.Data["unchanged"])
+}
+
+// Export with an RSA public key; only the matching private key can import it
+func TestExportImportRSA(t *testing.T) {
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	assert.Nil(t, err)
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	source, sourceStorage := getBackend(t)
+	writeExportMount(t, source, sourceStorage)
+
+	response := sendRequest(t, source, sourceStorage, logical.UpdateOperation, "export", map[string]interface{}{
+		"recipient": string(publicPEM),
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	bundle := response.Data["bundle"].(string)
+
+	target, targetStorage := getBackend(t)
+
+	otherIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	response = sendRequest(t, target, targetStorage, logical.UpdateOperation, "import", map[string]interface{}{
+		"bundle":      bundle,
+		"private_key": otherIdentity.String(),
+	})
+	assert.True(t, response.IsError(), "a bundle can not be imported with another key")
+
+	response = sendRequest(t, target, targetStorage, logical.UpdateOperation, "import", map[string]interface{}{
+		"bundle":      bundle,
+		"private_key": string(privatePEM),
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	assert.Equal(t, 2, len(response.Data["added"].([]string)))
+
+	response = sendRequest(t, target, targetStorage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p2", response.Data["password"])
+}
+
+// The recipient must be an age or RSA public key
+func TestExportInvalidRecipient(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	for _, recipient := range []string{"", "age1invalid", "not a key"} {
+		response := sendRequest(t, b, storage, logical.UpdateOperation, "export", map[string]interface{}{"recipient": recipient})
+		assert.True(t, response.IsError(), "recipient %q", recipient)
+	}
+}
+
+// read the records of a bundle
+func readBundle(t *testing.T, bundle string, identity age.Identity) map[string]bundleRecord {
+	decrypted, err := age.Decrypt(base64.NewDecoder(base64.StdEncoding, strings.NewReader(bundle)), identity)
+	assert.Nil(t, err)
+	decompressed, err := gzip.NewReader(decrypted)
+	assert.Nil(t, err)
+
+	records := map[string]bundleRecord{}
+	decoder := json.NewDecoder(decompressed)
+	for decoder.More() {
+		var record bundleRecord
+		assert.Nil(t, decoder.Decode(&record))
+		records[record.Kind+" "+record.Key] = record
+	}
+	return records
+}
+
+// write a bundle with the records
+func writeBundle(t *testing.T, identity *age.X25519Identity, records ...bundleRecord) string {
+	var bundle bytes.Buffer
+	encoded := base64.NewEncoder(base64.StdEncoding, &bundle)
+	encrypted, err := age.Encrypt(encoded, identity.Recipient())
+	assert.Nil(t, err)
+	compressed := gzip.NewWriter(encrypted)
+	encoder := json.NewEncoder(compressed)
+
+	header, err := json.Marshal(&bundleHeader{FormatVersion: bundleFormatVersion})
+	assert.Nil(t, err)
+	assert.Nil(t, encoder.Encode(&bundleRecord{Kind: bundleKindHeader, Value: header}))
+	for _, record := range records {
+		assert.Nil(t, encoder.Encode(&record))
+	}
+	assert.Nil(t, compressed.Close())
+	assert.Nil(t, encrypted.Close())
+	assert.Nil(t, encoded.Close())
+	return bundle.String()
+}
+
+// The credentials of the mount and the deleted secrets are not exported
+func TestExportCredentials(t *testing.T) {
+
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	b, storage := getBackend(t)
+	writeExportMount(t, b, storage)
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"access_check_token": "plugin-token"})
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "totp/keys/app", map[string]interface{}{"generate": true, "issuer": "app", "account_name": "app"})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "rotation/app/db", map[string]interface{}{"key": "password", "rotation_period": "1h"})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/old", map[string]interface{}{"key": "old"})
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/old", nil)
+
+	keys, err := logical.CollectKeys(context.Background(), storage)
+	assert.Nil(t, err)
+	assert.Contains(t, keys, "totp/keys/app")
+	assert.Contains(t, keys, "rotation/app/db")
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "export", map[string]interface{}{
+		"recipient": identity.Recipient().String(),
+	})
+	assert.Equal(t, 2, response.Data["secrets"])
+	assert.Equal(t, 4, response.Data["entries"])
+
+	records := readBundle(t, response.Data["bundle"].(string), identity)
+	assert.Contains(t, records, "secret app/db")
+	assert.NotContains(t, records, "secret app/old")
+	for key := range records {
+		assert.NotContains(t, key, "totp/")
+		assert.NotContains(t, key, "rotation/")
+	}
+	assert.Contains(t, string(records["storage config"].Value), `"expired_read":"fail"`)
+	assert.NotContains(t, string(records["storage config"].Value), "plugin-token")
+}
+
+// Only the secrets of a bundle are imported, by a caller who can write them
+func TestImportSecretsOnly(t *testing.T) {
+
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "schema/db", map[string]interface{}{
+		"prefix": "db/",
+		"schema": `{"type": "object", "required": ["password"]}`,
+	})
+
+	secret := func(data map[string]interface{}, version int) []byte {
+		value, err := json.Marshal(&secretEntry{Data: data, Version: version})
+		assert.Nil(t, err)
+		return value
+	}
+	bundle := writeBundle(t, identity,
+		bundleRecord{Kind: bundleKindStorage, Key: "config", Value: []byte(`{"access_check_token":"attacker"}`)},
+		bundleRecord{Kind: bundleKindStorage, Key: "rotation/app/db", Value: []byte(`{"key":"password"}`)},
+		bundleRecord{Kind: bundleKindSecret, Key: "app/db", Value: secret(map[string]interface{}{"password": "p2"}, 1)},
+		bundleRecord{Kind: bundleKindSecret, Key: "db/main", Value: secret(map[string]interface{}{"user": "app"}, 1)},
+	)
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "import", map[string]interface{}{
+		"bundle":      bundle,
+		"private_key": identity.String(),
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	assert.Equal(t, []string{"data/app/db"}, response.Data["changed"])
+	assert.Equal(t, []string{"config", "rotation/app/db"}, response.Data["skipped"])
+	failed := response.Data["failed"].([]string)
+	assert.Equal(t, 1, len(failed))
+	assert.Contains(t, failed[0], "data/db/main")
+
+	storageEntry, err := storage.Get(context.Background(), "config")
+	assert.Nil(t, err)
+	assert.Nil(t, storageEntry, "the config of the bundle is not written")
+	storageEntry, err = storage.Get(context.Background(), "rotation/app/db")
+	assert.Nil(t, err)
+	assert.Nil(t, storageEntry, "the rotation of the bundle is not written")
+
+	// the version 1 of the bundle is written as the version 2 of the mount
+	response = sendRequest(t, b, storage, logical.ReadOperation, "metadata/app/db", nil)
+	assert.Equal(t, 2, response.Data["version"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p2", response.Data["password"])
+
+	// a path the caller may not write rejects the whole import
+	checker := b.(*scalesecSecretStoreBackend).accessChecker.(*staticAccessChecker)
+	checker.capabilities["app/db"] = []string{"read", "create"}
+	bundle = writeBundle(t, identity,
+		bundleRecord{Kind: bundleKindSecret, Key: "app/api", Value: secret(map[string]interface{}{"key": "k1"}, 1)},
+		bundleRecord{Kind: bundleKindSecret, Key: "app/db", Value: secret(map[string]interface{}{"password": "p3"}, 1)},
+	)
+	response, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation:   logical.UpdateOperation,
+		Path:        "import",
+		MountPoint:  MOUNT_POINT,
+		Storage:     storage,
+		ClientToken: "test_token",
+		Data:        map[string]interface{}{"bundle": bundle, "private_key": identity.String()},
+	})
+	assert.Equal(t, logical.ErrPermissionDenied, err)
+	assert.Equal(t, `importing "app/db" failed: no update capability: permission denied`, response.Error().Error())
+	assert.Nil(t, sendRequest(t, b, storage, logical.ReadOperation, "app/api", nil))
+}
@@ -0,0 +1,391 @@
+// ********************************************************************************
+// Field level access control of the secrets
+//
+// Vault policies decide who can read a path, not which fields of the secret they see.  A
+// field ACL rule gives the fields of the secrets under a prefix a caller is allowed to see:
+//
+//   vault write scalesecsecrets/field_acl/db-dba prefix="db/*" group_ids=<dba group id> allowed_fields="*"
+//   vault write scalesecsecrets/field_acl/db-app prefix="db/*" entity_metadata=team=app allowed_fields="host,port,user"
+//
+// A rule applies to the caller when the entity of the token is in entity_ids, when the
+// entity is in one of group_ids, or when the entity has all the entity_metadata values.  A
+// rule without any of them applies to every caller, including tokens without an entity.
+//
+// The secrets under a prefix without rules are not restricted.  Once a rule has the prefix
+// of a secret, a read only returns the fields allowed by the rules that apply to the
+// caller; the others are removed from the response and counted in a warning.  Allowed
+// fields can be globs, IE: db_* or *.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryanuber/go-glob"
+)
+
+// Storage prefix for the field ACL rules
+const fieldACLStoragePrefix = "field_acl/"
+
+// fieldACLEntry is the storage entry for a field ACL rule
+type fieldACLEntry struct {
+	Prefix         string            `json:"prefix"`
+	EntityIDs      []string          `json:"entity_ids,omitempty"`
+	GroupIDs       []string          `json:"group_ids,omitempty"`
+	EntityMetadata map[string]string `json:"entity_metadata,omitempty"`
+	AllowedFields  []string          `json:"allowed_fields"`
+}
+
+// fieldACLPaths returns the paths to manage the field ACL rules.
+func (b *scalesecSecretStoreBackend) fieldACLPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.fieldACLPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "field_acl/?$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.handleFieldACLList,
+					Summary:  "Lists the field ACL rules.",
+				},
+			},
+		},
+		{
+			Pattern: "field_acl/" + framework.GenericNameRegex("name"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the rule.",
+				},
+				"prefix": {
+					Type:        framework.TypeString,
+					Description: "Path prefix of the secrets the rule applies to.  IE: db/ or db/*",
+				},
+				"entity_ids": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "IDs of the entities the rule applies to.",
+				},
+				"group_ids": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "IDs of the groups whose member entities the rule applies to.",
+				},
+				"entity_metadata": {
+					Type:        framework.TypeKVPairs,
+					Description: "Metadata values an entity must all have for the rule to apply to it.",
+				},
+				"allowed_fields": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Fields of the secrets the callers the rule applies to can see.  Globs are allowed, IE: db_* or *.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleFieldACLRead,
+					Summary:  "Read a field ACL rule.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleFieldACLWrite,
+					Summary:  "Write a field ACL rule for a path prefix.",
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.handleFieldACLDelete,
+					Summary:  "Delete a field ACL rule.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.fieldACLPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleFieldACLWrite: Write a field ACL rule for a path prefix
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleFieldACLWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleFieldACLWrite:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleFieldACLWrite:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	name := data.Get("name").(string)
+	entry := &fieldACLEntry{
+		Prefix:         strings.TrimSuffix(data.Get("prefix").(string), "*"),
+		EntityIDs:      strutil.RemoveDuplicates(data.Get("entity_ids").([]string), false),
+		GroupIDs:       strutil.RemoveDuplicates(data.Get("group_ids").([]string), false),
+		EntityMetadata: data.Get("entity_metadata").(map[string]string),
+		AllowedFields:  strutil.RemoveDuplicates(data.Get("allowed_fields").([]string), false),
+	}
+	if len(entry.AllowedFields) == 0 {
+		return logical.ErrorResponse("allowed_fields must be provided"), nil
+	}
+
+	storageEntry, err := logical.StorageEntryJSON(fieldACLStoragePrefix+name, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	b.fieldACLLock.Lock()
+	defer b.fieldACLLock.Unlock()
+
+	if err := req.Storage.Put(ctx, storageEntry); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleFieldACLWrite:-> Leaving with error")
+		return nil, fmt.Errorf("storing field ACL rule failed: %w", err)
+	}
+	b.fieldACLs = nil
+
+	b.Logger().Debug("scalesecSecretStore.handleFieldACLWrite:-> Leaving")
+	return nil, nil
+}
+
+// ============================================================================================
+// handleFieldACLRead: Read a field ACL rule
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleFieldACLRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleFieldACLRead:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleFieldACLRead:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	storageEntry, err := req.Storage.Get(ctx, fieldACLStoragePrefix+data.Get("name").(string))
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleFieldACLRead:-> Leaving with error")
+		return nil, fmt.Errorf("reading field ACL rule failed: %w", err)
+	}
+	if storageEntry == nil {
+		b.Logger().Debug("scalesecSecretStore.handleFieldACLRead:-> Leaving no rule")
+		return nil, nil
+	}
+
+	var entry fieldACLEntry
+	if err := storageEntry.DecodeJSON(&entry); err != nil {
+		return nil, fmt.Errorf("decoding field ACL rule failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleFieldACLRead:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"prefix":          entry.Prefix,
+			"entity_ids":      entry.EntityIDs,
+			"group_ids":       entry.GroupIDs,
+			"entity_metadata": entry.EntityMetadata,
+			"allowed_fields":  entry.AllowedFields,
+		},
+	}, nil
+}
+
+// ============================================================================================
+// handleFieldACLDelete: Delete a field ACL rule
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleFieldACLDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleFieldACLDelete:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleFieldACLDelete:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	b.fieldACLLock.Lock()
+	defer b.fieldACLLock.Unlock()
+
+	if err := req.Storage.Delete(ctx, fieldACLStoragePrefix+data.Get("name").(string)); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleFieldACLDelete:-> Leaving with error")
+		return nil, fmt.Errorf("deleting field ACL rule failed: %w", err)
+	}
+	b.fieldACLs = nil
+
+	b.Logger().Debug("scalesecSecretStore.handleFieldACLDelete:-> Leaving")
+	return nil, nil
+}
+
+// ============================================================================================
+// handleFieldACLList: List the field ACL rules
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleFieldACLList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleFieldACLList:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleFieldACLList:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	names, err := req.Storage.List(ctx, fieldACLStoragePrefix)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleFieldACLList:-> Leaving with error")
+		return nil, fmt.Errorf("listing field ACL rules failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleFieldACLList:-> Leaving")
+	return logical.ListResponse(names), nil
+}
+
+// loadFieldACLs returns the field ACL rules.  They are read once and kept until a rule is
+// written or deleted.
+func (b *scalesecSecretStoreBackend) loadFieldACLs(ctx context.Context, s logical.Storage) ([]*fieldACLEntry, error) {
+	b.fieldACLLock.RLock()
+	rules := b.fieldACLs
+	b.fieldACLLock.RUnlock()
+	if rules != nil {
+		return rules, nil
+	}
+
+	b.fieldACLLock.Lock()
+	defer b.fieldACLLock.Unlock()
+
+	// another request may have loaded them while we waited for the lock
+	if b.fieldACLs != nil {
+		return b.fieldACLs, nil
+	}
+
+	names, err := s.List(ctx, fieldACLStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing field ACL rules failed: %w", err)
+	}
+
+	rules = []*fieldACLEntry{}
+	for _, name := range names {
+		storageEntry, err := s.Get(ctx, fieldACLStoragePrefix+name)
+		if err != nil {
+			return nil, err
+		}
+		if storageEntry == nil {
+			continue
+		}
+
+		var entry fieldACLEntry
+		if err := storageEntry.DecodeJSON(&entry); err != nil {
+			return nil, fmt.Errorf("decoding field ACL rule %q failed: %w", name, err)
+		}
+		rules = append(rules, &entry)
+	}
+
+	b.fieldACLs = rules
+	return rules, nil
+}
+
+// redactFields returns the fields of the secret at path the caller of the request is allowed
+// to see and how many were removed
+func (b *scalesecSecretStoreBackend) redactFields(ctx context.Context, req *logical.Request, path string, secretData map[string]interface{}) (map[string]interface{}, int, error) {
+	rules, err := b.loadFieldACLs(ctx, req.Storage)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	path = strings.Trim(path, "/")
+	caller := &fieldACLCaller{b: b, entityID: req.EntityID}
+
+	restricted := false
+	var allowed []string
+	for _, rule := range rules {
+		if !strings.HasPrefix(path, rule.Prefix) {
+			continue
+		}
+		restricted = true
+
+		applies, err := caller.matches(rule)
+		if err != nil {
+			return nil, 0, err
+		}
+		if applies {
+			allowed = append(allowed, rule.AllowedFields...)
+		}
+	}
+	if !restricted {
+		return secretData, 0, nil
+	}
+
+	result := make(map[string]interface{}, len(secretData))
+	for key, value := range secretData {
+		for _, pattern := range allowed {
+			if glob.Glob(pattern, key) {
+				result[key] = value
+				break
+			}
+		}
+	}
+	return result, len(secretData) - len(result), nil
+}
+
+// fieldACLCaller is the identity of the caller of a request.  The entity and its groups are
+// only looked up when a rule needs them.
+type fieldACLCaller struct {
+	b        *scalesecSecretStoreBackend
+	entityID string
+
+	entity *logical.Entity
+	groups []*logical.Group
+	loaded bool
+}
+
+// matches returns true if the rule applies to the caller
+func (c *fieldACLCaller) matches(rule *fieldACLEntry) (bool, error) {
+	if len(rule.EntityIDs) == 0 && len(rule.GroupIDs) == 0 && len(rule.EntityMetadata) == 0 {
+		return true, nil
+	}
+	if c.entityID == "" {
+		return false, nil
+	}
+	if strutil.StrListContains(rule.EntityIDs, c.entityID) {
+		return true, nil
+	}
+	if len(rule.GroupIDs) == 0 && len(rule.EntityMetadata) == 0 {
+		return false, nil
+	}
+
+	if err := c.load(); err != nil {
+		return false, err
+	}
+	for _, group := range c.groups {
+		if strutil.StrListContains(rule.GroupIDs, group.ID) {
+			return true, nil
+		}
+	}
+	if len(rule.EntityMetadata) == 0 || c.entity == nil {
+		return false, nil
+	}
+	for key, value := range rule.EntityMetadata {
+		if c.entity.Metadata[key] != value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// load looks up the entity of the caller and its groups
+func (c *fieldACLCaller) load() error {
+	if c.loaded {
+		return nil
+	}
+
+	entity, err := c.b.System().EntityInfo(c.entityID)
+	if err != nil {
+		return fmt.Errorf("looking up the entity failed: %w", err)
+	}
+	groups, err := c.b.System().GroupsForEntity(c.entityID)
+	if err != nil {
+		return fmt.Errorf("looking up the groups of the entity failed: %w", err)
+	}
+
+	c.entity = entity
+	c.groups = groups
+	c.loaded = true
+	return nil
+}
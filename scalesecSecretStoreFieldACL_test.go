@@ -0,0 +1,170 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// identitySystemView returns the entities and groups of the test callers by entity ID
+type identitySystemView struct {
+	logical.StaticSystemView
+	entities map[string]*logical.Entity
+	groups   map[string][]*logical.Group
+}
+
+func (v *identitySystemView) EntityInfo(entityID string) (*logical.Entity, error) {
+	return v.entities[entityID], nil
+}
+
+func (v *identitySystemView) GroupsForEntity(entityID string) ([]*logical.Group, error) {
+	return v.groups[entityID], nil
+}
+
+// a backend whose callers are a DBA by group, an app by entity metadata and an auditor by
+// entity ID
+func getFieldACLBackend(t *testing.T) (logical.Backend, logical.Storage) {
+	backendConfig := &logical.BackendConfig{
+		Logger: logging.NewVaultLogger(log.Trace),
+		System: &identitySystemView{
+			entities: map[string]*logical.Entity{
+				"dba":     {ID: "dba"},
+				"app":     {ID: "app", Metadata: map[string]string{"team": "app"}},
+				"auditor": {ID: "auditor"},
+			},
+			groups: map[string][]*logical.Group{
+				"dba": {{ID: "dba-group"}},
+			},
+		},
+		StorageView: &logical.InmemStorage{},
+		BackendUUID: "test",
+	}
+
+	b, err := Factory(context.Background(), backendConfig)
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+	return b, backendConfig.StorageView
+}
+
+// read the secret at path as the entity
+func readAs(t *testing.T, b logical.Backend, storage logical.Storage, entityID string, path string, data map[string]interface{}) *logical.Response {
+	response, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation:   logical.ReadOperation,
+		Path:        path,
+		MountPoint:  MOUNT_POINT,
+		Storage:     storage,
+		ClientToken: "test_token",
+		EntityID:    entityID,
+		Data:        data,
+	})
+	assert.Nil(t, err)
+	return response
+}
+
+// Each caller only sees the fields the rules that apply to them allow
+func TestFieldACL(t *testing.T) {
+
+	b, storage := getFieldACLBackend(t)
+	secret := map[string]interface{}{"host": "db1", "port": "5432", "user": "app", "password": "p1"}
+	sendRequest(t, b, storage, logical.CreateOperation, "db/main", secret)
+	sendRequest(t, b, storage, logical.CreateOperation, "web/main", secret)
+
+	// without rules every caller sees every field
+	response := readAs(t, b, storage, "app", "db/main", nil)
+	assert.Equal(t, secret, response.Data)
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "field_acl/db-dba", map[string]interface{}{
+		"prefix":         "db/*",
+		"group_ids":      "dba-group",
+		"allowed_fields": "*",
+	})
+	sendRequest(t, b, storage, logical.UpdateOperation, "field_acl/db-app", map[string]interface{}{
+		"prefix":          "db/",
+		"entity_metadata": "team=app",
+		"allowed_fields":  "host,port,user",
+	})
+	sendRequest(t, b, storage, logical.UpdateOperation, "field_acl/db-auditor", map[string]interface{}{
+		"prefix":         "db/",
+		"entity_ids":     "auditor",
+		"allowed_fields": "h*",
+	})
+
+	response = readAs(t, b, storage, "dba", "db/main", nil)
+	assert.Equal(t, secret, response.Data)
+	assert.Empty(t, response.Warnings)
+
+	response = readAs(t, b, storage, "app", "db/main", nil)
+	assert.Equal(t, map[string]interface{}{"host": "db1", "port": "5432", "user": "app"}, response.Data)
+	assert.Equal(t, []string{"1 fields were removed by the field ACL"}, response.Warnings)
+
+	response = readAs(t, b, storage, "auditor", "db/main", nil)
+	assert.Equal(t, map[string]interface{}{"host": "db1"}, response.Data)
+
+	// a caller no rule applies to sees no field, a token without an entity either
+	response = readAs(t, b, storage, "other", "db/main", nil)
+	assert.Empty(t, response.Data)
+	response = readAs(t, b, storage, "", "db/main", nil)
+	assert.Empty(t, response.Data)
+
+	// a redacted field can not be read with secret_key
+	response = readAs(t, b, storage, "app", "db/main", map[string]interface{}{"secret_key": "password"})
+	assert.Nil(t, response)
+
+	// the secrets under another prefix are not restricted
+	response = readAs(t, b, storage, "other", "web/main", nil)
+	assert.Equal(t, secret, response.Data)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "field_acl/db-app", nil)
+	assert.Equal(t, map[string]string{"team": "app"}, response.Data["entity_metadata"])
+	response = sendRequest(t, b, storage, logical.ListOperation, "field_acl/", nil)
+	assert.Equal(t, []string{"db-app", "db-auditor", "db-dba"}, response.Data["keys"])
+
+	// deleting the rule of the app removes its access to the fields
+	sendRequest(t, b, storage, logical.DeleteOperation, "field_acl/db-app", nil)
+	response = readAs(t, b, storage, "app", "db/main", nil)
+	assert.Empty(t, response.Data)
+}
+
+// A template can not reveal a field the caller is not allowed to see
+func TestFieldACLTemplate(t *testing.T) {
+
+	b, storage := getFieldACLBackend(t)
+	b.(*scalesecSecretStoreBackend).accessChecker = &staticAccessChecker{}
+	sendRequest(t, b, storage, logical.CreateOperation, "db/main", map[string]interface{}{"host": "db1", "password": "p1"})
+	sendRequest(t, b, storage, logical.CreateOperation, "app/config", map[string]interface{}{
+		"url": `postgres://{{ secret "db/main" "host" }}`,
+		"dsn": `postgres://app:{{ secret "db/main" "password" }}@db1`,
+	})
+	sendRequest(t, b, storage, logical.UpdateOperation, "field_acl/db-app", map[string]interface{}{
+		"prefix":          "db/",
+		"entity_metadata": "team=app",
+		"allowed_fields":  "host",
+	})
+
+	response, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation:   logical.ReadOperation,
+		Path:        "app/config",
+		Storage:     storage,
+		ClientToken: "test_token",
+		EntityID:    "app",
+		Data:        map[string]interface{}{"render": true},
+	})
+	assert.Nil(t, err)
+	assert.True(t, response.IsError())
+	assert.NotContains(t, response.Error().Error(), "p1")
+}
+
+// allowed_fields must be provided
+func TestFieldACLInvalid(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "field_acl/db", map[string]interface{}{"prefix": "db/"})
+	assert.True(t, response.IsError())
+}
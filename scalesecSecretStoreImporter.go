@@ -0,0 +1,410 @@
+// ********************************************************************************
+// Importer: migrate existing secrets into the mount
+//
+// The importer path reads secrets from the files other tools produce and writes them under
+// a prefix of the mount.  cmd/scalesec-import sends a file to it from the command line.
+//
+//   vault write scalesecsecrets/importer format=env prefix=app/web content=@web.env conflict=skip
+//
+// Formats:
+//   kv-json : JSON object of path -> secret.  A secret is its key/value data or a KV v2
+//             secret {"data": {...}, "metadata": {...}} as vault kv get -format=json prints it.
+//   yaml    : the same as kv-json written in YAML
+//   env     : KEY=value lines of a .env file.  They are one secret stored at the prefix.
+//
+// Conflict policies, when there is already a secret at the path:
+//   skip      : the existing secret is kept (default)
+//   overwrite : the imported data replaces the secret
+//   version   : the imported data replaces the secret and the replaced data stays readable
+//               with previous=true for previous_ttl, like after a rotation
+//
+// The caller needs create on each new path and update on each existing one, like a write of
+// the secret.  The import is first run as a dry run over every path so a path the caller
+// may not write rejects the whole import before anything is written.
+//
+// The response reports the paths created, updated, skipped, unchanged and failed.  With
+// dry_run=true nothing is written.  A secret over a quota stops the import and the error
+// tells the paths already written.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"gopkg.in/yaml.v3"
+)
+
+// The formats of the importer
+const (
+	importFormatKVJSON = "kv-json"
+	importFormatYAML   = "yaml"
+	importFormatEnv    = "env"
+)
+
+// The conflict policies of the importer
+const (
+	importConflictSkip      = "skip"
+	importConflictOverwrite = "overwrite"
+	importConflictVersion   = "version"
+)
+
+// importReport is what the importer did with each path
+type importReport struct {
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Skipped   []string `json:"skipped"`
+	Unchanged []string `json:"unchanged"`
+	Failed    []string `json:"failed"`
+}
+
+// importerPaths returns the path of the importer.
+func (b *scalesecSecretStoreBackend) importerPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.importerPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "importer$",
+
+			Fields: map[string]*framework.FieldSchema{
+				"format": {
+					Type:        framework.TypeString,
+					Description: "Format of the content: kv-json, yaml or env.",
+				},
+				"content": {
+					Type:        framework.TypeString,
+					Description: "Content of the file to import.",
+				},
+				"prefix": {
+					Type:        framework.TypeString,
+					Description: "Path prefix the secrets are written under.  The path of the secret of an env file.",
+				},
+				"conflict": {
+					Type:        framework.TypeString,
+					Default:     importConflictSkip,
+					Description: "What to do when there is already a secret at a path: skip, overwrite or version.",
+				},
+				"previous_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Default:     86400,
+					Description: "With conflict=version, how long the replaced data stays readable with previous=true.",
+				},
+				"dry_run": {
+					Type:        framework.TypeBool,
+					Description: "Only report what the import would do.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleImporter,
+					Summary:  "Import secrets from a KV JSON dump, a YAML map or a .env file.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.importerPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleImporter: Import secrets from a KV JSON dump, a YAML map or a .env file
+//
+// GOAL:  	Write each secret of the content under the prefix following the conflict policy
+// Return:
+// 			*logical.Response := the report of what was done with each path
+// 			error := Error with details if the import failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleImporter(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleImporter:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleImporter:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	conflict := data.Get("conflict").(string)
+	switch conflict {
+	case importConflictSkip, importConflictOverwrite, importConflictVersion:
+	default:
+		return logical.ErrorResponse("conflict must be skip, overwrite or version"), nil
+	}
+	previousTTL := time.Duration(data.Get("previous_ttl").(int)) * time.Second
+	dryRun := data.Get("dry_run").(bool)
+	prefix := strings.Trim(data.Get("prefix").(string), "/")
+
+	secrets, err := parseImportContent(data.Get("format").(string), data.Get("content").(string), prefix)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleImporter:-> Leaving with invalid content")
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	paths := make([]string, 0, len(secrets))
+	for path := range secrets {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// the dry run checks the access to every path before the first write
+	report, err := b.importSecrets(ctx, req, paths, secrets, conflict, previousTTL, true)
+	if err == nil && !dryRun {
+		report, err = b.importSecrets(ctx, req, paths, secrets, conflict, previousTTL, false)
+	}
+	if err != nil {
+		if resp := importQuotaErrorResponse(err, append(report.Created, report.Updated...)); resp != nil {
+			b.Logger().Debug("scalesecSecretStore.handleImporter:-> Leaving over quota")
+			return resp, nil
+		}
+		b.Logger().Debug("scalesecSecretStore.handleImporter:-> Leaving with error")
+		if errors.Is(err, logical.ErrPermissionDenied) {
+			return logical.ErrorResponse(err.Error()), logical.ErrPermissionDenied
+		}
+		return nil, err
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleImporter:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"dry_run":   dryRun,
+			"created":   report.Created,
+			"updated":   report.Updated,
+			"skipped":   report.Skipped,
+			"unchanged": report.Unchanged,
+			"failed":    report.Failed,
+		},
+	}, nil
+}
+
+// importSecrets imports the secrets of the paths in order and returns the report.  On error
+// the report has what was done before it.
+func (b *scalesecSecretStoreBackend) importSecrets(ctx context.Context, req *logical.Request, paths []string, secrets map[string]map[string]interface{}, conflict string, previousTTL time.Duration, dryRun bool) (*importReport, error) {
+	report := &importReport{
+		Created:   []string{},
+		Updated:   []string{},
+		Skipped:   []string{},
+		Unchanged: []string{},
+		Failed:    []string{},
+	}
+	for _, path := range paths {
+		if err := b.importSecret(ctx, req, path, secrets[path], conflict, previousTTL, dryRun, report); err != nil {
+			return report, fmt.Errorf("importing %q failed: %w", path, err)
+		}
+	}
+	return report, nil
+}
+
+// importSecret writes the imported data at path following the conflict policy and adds
+// the outcome to the report.  Data rejected by a schema is reported as failed.
+func (b *scalesecSecretStoreBackend) importSecret(ctx context.Context, req *logical.Request, path string, secretData map[string]interface{}, conflict string, previousTTL time.Duration, dryRun bool, report *importReport) error {
+	s := req.Storage
+
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// a deleted secret does not exist for the import but the versions continue from it
+	stored, err := b.getSecretIncludingDeleted(ctx, s, path)
+	if err != nil {
+		return err
+	}
+	secret := stored
+	if secret != nil && secret.DeletedTime != nil {
+		secret = nil
+	}
+
+	// checked before the data is compared so the report does not tell what a path holds
+	capability := "create"
+	if secret != nil {
+		capability = "update"
+	}
+	allowed, err := b.canAccess(ctx, req, path, capability)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("no %s capability: %w", capability, logical.ErrPermissionDenied)
+	}
+
+	if secret != nil {
+		same, err := sameSecretData(secret.Data, secretData)
+		if err != nil {
+			return err
+		}
+		if same {
+			report.Unchanged = append(report.Unchanged, path)
+			return nil
+		}
+		if conflict == importConflictSkip {
+			report.Skipped = append(report.Skipped, path)
+			return nil
+		}
+	}
+
+	resp, err := b.validateSecret(ctx, s, path, secretData)
+	if err != nil {
+		return err
+	}
+	if resp != nil {
+		report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", path, resp.Error()))
+		return nil
+	}
+
+	if !dryRun {
+		now := b.now()
+		next := stored.nextVersion(secretData, now)
+		if secret != nil && conflict == importConflictVersion {
+			next.Previous = &previousSecret{
+				Data:          secret.Data,
+				Version:       secret.Version,
+				ReadableUntil: now.Add(previousTTL),
+			}
+		}
+		if err := b.putSecret(ctx, s, path, next); err != nil {
+			return err
+		}
+	}
+
+	if secret == nil {
+		report.Created = append(report.Created, path)
+	} else {
+		report.Updated = append(report.Updated, path)
+	}
+	return nil
+}
+
+// sameSecretData compares the data the way it is stored, as JSON
+func sameSecretData(a map[string]interface{}, b map[string]interface{}) (bool, error) {
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return string(aJSON) == string(bJSON), nil
+}
+
+// parseImportContent returns the secrets of the content by path under prefix
+func parseImportContent(format string, content string, prefix string) (map[string]map[string]interface{}, error) {
+	if strings.TrimSpace(content) == "" {
+		return nil, fmt.Errorf("content must be provided")
+	}
+
+	var raw map[string]interface{}
+	switch format {
+	case importFormatEnv:
+		if prefix == "" {
+			return nil, fmt.Errorf("prefix must be provided for an env file: it is the path of the secret")
+		}
+		secretData, err := parseEnv(content)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]map[string]interface{}{prefix: secretData}, nil
+	case importFormatKVJSON:
+		if err := jsonutil.DecodeJSON([]byte(content), &raw); err != nil {
+			return nil, fmt.Errorf("parsing JSON failed: %w", err)
+		}
+	case importFormatYAML:
+		if err := yaml.Unmarshal([]byte(content), &raw); err != nil {
+			return nil, fmt.Errorf("parsing YAML failed: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("format must be kv-json, yaml or env")
+	}
+
+	secrets := map[string]map[string]interface{}{}
+	for path, value := range raw {
+		secretData, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("the secret at %q must be an object", path)
+		}
+		secretData = unwrapKVv2(secretData)
+		if len(secretData) == 0 {
+			return nil, fmt.Errorf("the secret at %q has no data", path)
+		}
+
+		path = strings.Trim(path, "/")
+		if prefix != "" {
+			path = prefix + "/" + path
+		}
+		secrets[path] = secretData
+	}
+	return secrets, nil
+}
+
+// unwrapKVv2 returns the data of a KV v2 secret {"data": {...}, "metadata": {...}}, or the
+// secret itself if it is not one
+func unwrapKVv2(secret map[string]interface{}) map[string]interface{} {
+	secretData, ok := secret["data"].(map[string]interface{})
+	if !ok {
+		return secret
+	}
+	for key := range secret {
+		if key != "data" && key != "metadata" {
+			return secret
+		}
+	}
+	return secretData
+}
+
+// parseEnv returns the KEY=value pairs of a .env file.  Blank lines and # comments are
+// ignored, an export in front of the key is dropped and quoted values are unquoted.
+func parseEnv(content string) (map[string]interface{}, error) {
+	secretData := map[string]interface{}{}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		equals := strings.Index(line, "=")
+		if equals <= 0 {
+			return nil, fmt.Errorf("line %d is not KEY=value", lineNumber)
+		}
+		key := strings.TrimSpace(line[:equals])
+		value := strings.TrimSpace(line[equals+1:])
+
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d has an invalid quoted value", lineNumber)
+			}
+			value = unquoted
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			// an unquoted value ends at a comment
+			if comment := strings.Index(value, " #"); comment >= 0 {
+				value = strings.TrimSpace(value[:comment])
+			}
+		}
+		secretData[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(secretData) == 0 {
+		return nil, fmt.Errorf("the env file has no variables")
+	}
+	return secretData, nil
+}
@@ -0,0 +1,186 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Import a KV v2 JSON dump under a prefix with each conflict policy
+func TestImporterKVJSON(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.CreateOperation, "legacy/db", map[string]interface{}{"password": "old"})
+	sendRequest(t, b, storage, logical.CreateOperation, "legacy/same", map[string]interface{}{"key": "k1"})
+
+	content := `{
+		"db":   {"data": {"password": "new"}, "metadata": {"version": 3}},
+		"api":  {"key": "a1"},
+		"same": {"data": {"key": "k1"}, "metadata": {}}
+	}`
+
+	// the dry run reports without writing
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "importer", map[string]interface{}{
+		"format":  "kv-json",
+		"content": content,
+		"prefix":  "legacy",
+		"dry_run": true,
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	assert.Equal(t, []string{"legacy/api"}, response.Data["created"])
+	assert.Equal(t, []string{"legacy/db"}, response.Data["skipped"])
+	assert.Equal(t, []string{"legacy/same"}, response.Data["unchanged"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "legacy/api", nil)
+	assert.Nil(t, response)
+
+	// skip keeps the existing secret
+	sendRequest(t, b, storage, logical.UpdateOperation, "importer", map[string]interface{}{
+		"format":  "kv-json",
+		"content": content,
+		"prefix":  "legacy",
+	})
+	response = sendRequest(t, b, storage, logical.ReadOperation, "legacy/api", nil)
+	assert.Equal(t, "a1", response.Data["key"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "legacy/db", nil)
+	assert.Equal(t, "old", response.Data["password"])
+
+	// version replaces the secret and keeps the replaced data readable
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "importer", map[string]interface{}{
+		"format":   "kv-json",
+		"content":  content,
+		"prefix":   "legacy",
+		"conflict": "version",
+	})
+	assert.Equal(t, []string{"legacy/db"}, response.Data["updated"])
+	assert.Equal(t, []string{"legacy/api", "legacy/same"}, response.Data["unchanged"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "legacy/db", nil)
+	assert.Equal(t, "new", response.Data["password"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "legacy/db", map[string]interface{}{"previous": true})
+	assert.Equal(t, "old", response.Data["password"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "metadata/legacy/db", nil)
+	assert.Equal(t, 2, response.Data["version"])
+
+	// overwrite does not keep the replaced data
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "importer", map[string]interface{}{
+		"format":   "kv-json",
+		"content":  `{"db": {"password": "newer"}}`,
+		"prefix":   "legacy",
+		"conflict": "overwrite",
+	})
+	assert.Equal(t, []string{"legacy/db"}, response.Data["updated"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "legacy/db", map[string]interface{}{"previous": true})
+	assert.Nil(t, response)
+}
+
+// Import a YAML map and a .env file
+func TestImporterYAMLAndEnv(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "importer", map[string]interface{}{
+		"format": "yaml",
+		"content": `
+app/db:
+  password: p1
+  port: 5432
+app/api:
+  key: k1
+`,
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	assert.Equal(t, []string{"app/api", "app/db"}, response.Data["created"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p1", response.Data["password"])
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "importer", map[string]interface{}{
+		"format": "env",
+		"prefix": "app/web",
+		"content": `# web settings
+export DB_URL="postgres://db:5432/web"
+API_KEY=k1 # the vendor key
+GREETING='hello world'
+`,
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	assert.Equal(t, []string{"app/web"}, response.Data["created"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/web", nil)
+	assert.Equal(t, "postgres://db:5432/web", response.Data["DB_URL"])
+	assert.Equal(t, "k1", response.Data["API_KEY"])
+	assert.Equal(t, "hello world", response.Data["GREETING"])
+}
+
+// Invalid content, a missing prefix for an env file and an unknown policy are rejected
+func TestImporterInvalid(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	for _, data := range []map[string]interface{}{
+		{"format": "kv-json", "content": "{not json"},
+		{"format": "kv-json", "content": `{"app/db": "p1"}`},
+		{"format": "env", "content": "KEY=value"},
+		{"format": "env", "prefix": "app/web", "content": "not a variable"},
+		{"format": "toml", "content": "key = 1"},
+		{"format": "kv-json", "content": `{"app/db": {"password": "p1"}}`, "conflict": "merge"},
+	} {
+		response := sendRequest(t, b, storage, logical.UpdateOperation, "importer", data)
+		assert.True(t, response.IsError(), "data %v", data)
+	}
+}
+
+// A secret rejected by a schema is reported as failed and the others are imported
+func TestImporterSchema(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.UpdateOperation, "schema/db", map[string]interface{}{
+		"prefix": "db/",
+		"schema": `{"type": "object", "required": ["password"]}`,
+	})
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "importer", map[string]interface{}{
+		"format":  "kv-json",
+		"content": `{"db/main": {"user": "admin"}, "db/replica": {"password": "p1"}}`,
+	})
+	assert.Equal(t, []string{"db/replica"}, response.Data["created"])
+	failed := response.Data["failed"].([]string)
+	assert.Equal(t, 1, len(failed))
+	assert.Contains(t, failed[0], "db/main")
+}
+
+// The caller must be allowed to write each imported path, not only the importer path
+func TestImporterDenied(t *testing.T) {
+
+	b, storage := getBackend(t)
+	checker := b.(*scalesecSecretStoreBackend).accessChecker.(*staticAccessChecker)
+	checker.capabilities["app/db"] = []string{"read", "create"}
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+
+	// app/api sorts first and would be created, but app/db can not be updated
+	response, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation:   logical.UpdateOperation,
+		Path:        "importer",
+		MountPoint:  MOUNT_POINT,
+		Storage:     storage,
+		ClientToken: "test_token",
+		Data: map[string]interface{}{
+			"format":   "kv-json",
+			"content":  `{"app/api": {"key": "k1"}, "app/db": {"password": "p2"}}`,
+			"conflict": "overwrite",
+		},
+	})
+	assert.Equal(t, logical.ErrPermissionDenied, err)
+	assert.Equal(t, `importing "app/db" failed: no update capability: permission denied`, response.Error().Error())
+
+	assert.Nil(t, sendRequest(t, b, storage, logical.ReadOperation, "app/api", nil))
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p1", response.Data["password"])
+
+	// a new path only needs create
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "importer", map[string]interface{}{
+		"format":  "kv-json",
+		"content": `{"app/api": {"key": "k1"}}`,
+	})
+	assert.Equal(t, []string{"app/api"}, response.Data["created"])
+}
@@ -0,0 +1,209 @@
+// ********************************************************************************
+// Search index of the secrets
+//
+// The search path would have to read every secret to find the ones with a tag or a
+// metadata value.  Instead a secondary index is kept in storage next to the secrets:
+//
+//   index/secrets/<path>                  : tags, custom metadata, version, updated time and expiry
+//   index/tags/<tag>/<path>               : marker, the secret has the tag
+//   index/metadata/<key>/<value>/<path>   : marker, the secret has the metadata value
+//   index/deleted/<path>                  : deleted time of a deleted secret, for the purge
+//
+// Tags, metadata keys and values are path escaped so a "/" in them does not add a level.
+// putSecret and deleteSecret write the secret and its index entries in one transactional
+// write so the index never disagrees with the secrets.  Deleted secrets are only in
+// index/deleted/.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Storage prefixes of the index
+const (
+	indexSecretsPrefix  = "index/secrets/"
+	indexTagsPrefix     = "index/tags/"
+	indexMetadataPrefix = "index/metadata/"
+	indexDeletedPrefix  = "index/deleted/"
+)
+
+// indexMarker is the value of the marker entries of the index
+var indexMarker = []byte("{}")
+
+// indexEntry is what the search knows about a secret without reading it
+type indexEntry struct {
+	Tags           []string          `json:"tags,omitempty"`
+	CustomMetadata map[string]string `json:"custom_metadata,omitempty"`
+	Version        int               `json:"version"`
+	UpdatedTime    time.Time         `json:"updated_time"`
+	ExpiresAt      *time.Time        `json:"expires_at,omitempty"`
+}
+
+// deletedIndexEntry is what the purge knows about a deleted secret without reading it
+type deletedIndexEntry struct {
+	DeletedTime time.Time `json:"deleted_time"`
+}
+
+// indexTagPrefix returns the prefix of the markers of tag
+func indexTagPrefix(tag string) string {
+	return indexTagsPrefix + url.PathEscape(tag) + "/"
+}
+
+// indexMetadataValuePrefix returns the prefix of the markers of the metadata key=value
+func indexMetadataValuePrefix(key string, value string) string {
+	return indexMetadataPrefix + url.PathEscape(key) + "/" + url.PathEscape(value) + "/"
+}
+
+// getIndexEntry reads the index entry of the secret at path.  Returns nil if it is not indexed.
+func (b *scalesecSecretStoreBackend) getIndexEntry(ctx context.Context, s logical.Storage, path string) (*indexEntry, error) {
+	storageEntry, err := s.Get(ctx, indexSecretsPrefix+path)
+	if err != nil {
+		return nil, err
+	}
+	if storageEntry == nil {
+		return nil, nil
+	}
+
+	var entry indexEntry
+	if err := storageEntry.DecodeJSON(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// secretChanges returns the storage changes that store secret at path with its index
+// entries.  A nil secret removes the secret and its index entries.
+func (b *scalesecSecretStoreBackend) secretChanges(ctx context.Context, s logical.Storage, path string, secret *secretEntry) ([]storageChange, error) {
+	change := storageChange{Key: secretStorageKey(path)}
+	if secret != nil {
+		storageEntry, err := logical.StorageEntryJSON(change.Key, secret)
+		if err != nil {
+			return nil, err
+		}
+		change.Value = storageEntry.Value
+	}
+
+	indexChanges, err := b.indexChanges(ctx, s, path, secret)
+	if err != nil {
+		return nil, err
+	}
+	changes := append([]storageChange{change}, indexChanges...)
+
+	// the reads of a removed secret go with it
+	if secret == nil {
+		changes = append(changes, storageChange{Key: accessStoragePrefix + strings.TrimSuffix(path, "/")})
+	}
+	return changes, nil
+}
+
+// indexChanges returns the changes that bring the index entries of the secret at path up
+// to date.  Only the markers that differ from the current index are changed.
+func (b *scalesecSecretStoreBackend) indexChanges(ctx context.Context, s logical.Storage, path string, secret *secretEntry) ([]storageChange, error) {
+	path = strings.TrimSuffix(path, "/")
+
+	current, err := b.getIndexEntry(ctx, s, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the markers the secret has now and the ones it should have
+	currentMarkers := map[string]bool{}
+	if current != nil {
+		for _, key := range current.markers(path) {
+			currentMarkers[key] = true
+		}
+	}
+
+	var next *indexEntry
+	nextMarkers := map[string]bool{}
+	if secret != nil && secret.DeletedTime == nil {
+		next = &indexEntry{
+			Tags:           secret.Tags,
+			CustomMetadata: secret.CustomMetadata,
+			Version:        secret.Version,
+			UpdatedTime:    secret.UpdatedTime,
+			ExpiresAt:      secret.ExpiresAt,
+		}
+		for _, key := range next.markers(path) {
+			nextMarkers[key] = true
+		}
+	}
+
+	var changes []storageChange
+	for key := range currentMarkers {
+		if !nextMarkers[key] {
+			changes = append(changes, storageChange{Key: key})
+		}
+	}
+	for key := range nextMarkers {
+		if !currentMarkers[key] {
+			changes = append(changes, storageChange{Key: key, Value: indexMarker})
+		}
+	}
+
+	switch {
+	case next != nil:
+		storageEntry, err := logical.StorageEntryJSON(indexSecretsPrefix+path, next)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, storageChange{Key: storageEntry.Key, Value: storageEntry.Value})
+	case current != nil:
+		changes = append(changes, storageChange{Key: indexSecretsPrefix + path})
+	}
+
+	deletedChange, err := deletedIndexChange(ctx, s, path, secret)
+	if err != nil {
+		return nil, err
+	}
+	if deletedChange != nil {
+		changes = append(changes, *deletedChange)
+	}
+	return changes, nil
+}
+
+// deletedIndexChange returns the change that brings the deleted index entry of the secret at
+// path up to date, or nil if it is up to date
+func deletedIndexChange(ctx context.Context, s logical.Storage, path string, secret *secretEntry) (*storageChange, error) {
+	key := indexDeletedPrefix + path
+	current, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil || secret.DeletedTime == nil {
+		if current == nil {
+			return nil, nil
+		}
+		return &storageChange{Key: key}, nil
+	}
+
+	storageEntry, err := logical.StorageEntryJSON(key, &deletedIndexEntry{DeletedTime: *secret.DeletedTime})
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && bytes.Equal(current.Value, storageEntry.Value) {
+		return nil, nil
+	}
+	return &storageChange{Key: key, Value: storageEntry.Value}, nil
+}
+
+// markers returns the keys of the marker entries of the secret at path
+func (entry *indexEntry) markers(path string) []string {
+	keys := make([]string, 0, len(entry.Tags)+len(entry.CustomMetadata))
+	for _, tag := range entry.Tags {
+		keys = append(keys, indexTagPrefix(tag)+path)
+	}
+	for key, value := range entry.CustomMetadata {
+		keys = append(keys, indexMetadataValuePrefix(key, value)+path)
+	}
+	return keys
+}
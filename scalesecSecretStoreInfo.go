@@ -0,0 +1,329 @@
+// ********************************************************************************
+// Plugin information and health
+//
+// plugin/main.go gets the build date, version and information from the link options and
+// hands them to the backend with SetBuildInfo.  The info path returns them without a
+// token so the version running on a node can be checked by anyone:
+//
+//   vault read scalesecsecrets/info
+//
+// The health path checks the backend can use what it depends on: the storage, and the
+// upstream systems of the rotations (the generator hooks, the http hooks and the sql hook
+// databases).  The checks run in parallel and all of them end within healthCheckTimeout.
+// It returns 503 when a check fails:
+//
+//   vault read scalesecsecrets/health
+//
+// The build version is also the RunningVersion of the backend, which vault shows in the
+// plugin catalog and the mount.  Vault only takes a semantic version, IE: v1.2.3, so a
+// build version that is not one is only reported by the info path.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// How long the health checks wait for the upstream systems
+const healthCheckTimeout = 5 * time.Second
+
+// buildInfo is the build metadata of the plugin binary
+type buildInfo struct {
+	Date    string
+	Version string
+	Info    string
+}
+
+// pluginBuild is set by SetBuildInfo before the plugin is served
+var pluginBuild buildInfo
+
+// SetBuildInfo records the build metadata set by the link options of plugin/main.go
+func SetBuildInfo(date string, version string, info string) {
+	pluginBuild = buildInfo{Date: date, Version: version, Info: info}
+}
+
+// runningVersion returns the build version as vault takes it for the RunningVersion of the
+// backend: a semantic version with a leading v.  Empty if the build version is not one.
+func runningVersion(buildVersion string) string {
+	if _, err := version.NewSemver(buildVersion); err != nil {
+		return ""
+	}
+	return "v" + strings.TrimPrefix(buildVersion, "v")
+}
+
+// healthCheck is the result of the check of one dependency
+type healthCheck struct {
+	Name     string
+	Target   string
+	Healthy  bool
+	Error    string
+	Duration time.Duration
+}
+
+// infoPaths returns the info and health paths.
+func (b *scalesecSecretStoreBackend) infoPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.infoPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "info$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleInfo,
+					Summary:  "Read the build version of the plugin.  No token is needed.",
+				},
+			},
+		},
+		{
+			Pattern: "health$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleHealth,
+					Summary:  "Check the storage and the upstream systems of the rotations can be reached.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.infoPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleInfo: Read the build version of the plugin
+//
+// GOAL:  	Show which build of the plugin a node runs.  The path is unauthenticated so there
+// 			is no ClientToken.
+// Return:
+// 			*logical.Response := the build metadata and the storage version the plugin supports
+// 			error := nil
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleInfo(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleInfo:-> Enter")
+
+	b.Logger().Debug("scalesecSecretStore.handleInfo:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"plugin_name":     b.pluginName,
+			"build_date":      pluginBuild.Date,
+			"build_version":   pluginBuild.Version,
+			"build_info":      pluginBuild.Info,
+			"storage_version": len(b.storageMigrations()),
+		},
+	}, nil
+}
+
+// ============================================================================================
+// handleHealth: Check the dependencies of the backend
+//
+// GOAL:  	Tell if the storage and the upstream systems of the rotations can be reached
+// Return:
+// 			*logical.Response := the result of each check, with status 503 if one failed
+// 			error := Error with details if the rotations could not be listed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleHealth(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleHealth:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleHealth:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	checks := []healthCheck{checkStorage(ctx, req.Storage)}
+	if !checks[0].Healthy {
+		// the rotations are in the storage
+		return healthResponse(req, checks)
+	}
+
+	upstream, err := b.checkUpstreams(ctx, req.Storage)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleHealth:-> Leaving with error")
+		return nil, err
+	}
+	checks = append(checks, upstream...)
+
+	b.Logger().Debug("scalesecSecretStore.handleHealth:-> Leaving")
+	return healthResponse(req, checks)
+}
+
+// healthResponse returns the checks, with status 503 if one failed
+func healthResponse(req *logical.Request, checks []healthCheck) (*logical.Response, error) {
+	healthy := true
+	results := make([]map[string]interface{}, 0, len(checks))
+	for _, check := range checks {
+		healthy = healthy && check.Healthy
+		result := map[string]interface{}{
+			"name":        check.Name,
+			"healthy":     check.Healthy,
+			"duration_ms": check.Duration.Milliseconds(),
+		}
+		if check.Target != "" {
+			result["target"] = check.Target
+		}
+		if check.Error != "" {
+			result["error"] = check.Error
+		}
+		results = append(results, result)
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"healthy":       healthy,
+			"build_version": pluginBuild.Version,
+			"checks":        results,
+		},
+	}
+	if !healthy {
+		return logical.RespondWithStatusCode(resp, req, http.StatusServiceUnavailable)
+	}
+	return resp, nil
+}
+
+// checkStorage reads the config entry to check the storage answers
+func checkStorage(ctx context.Context, s logical.Storage) healthCheck {
+	start := time.Now()
+	_, err := s.Get(ctx, configStorageKey)
+	return newHealthCheck("storage", "", start, err)
+}
+
+// checkUpstreams checks the upstream systems of the rotations.  A system used by several
+// rotations is checked once.
+func (b *scalesecSecretStoreBackend) checkUpstreams(ctx context.Context, s logical.Storage) ([]healthCheck, error) {
+	paths, err := logical.CollectKeysWithPrefix(ctx, logical.NewStorageView(s, rotationStoragePrefix), "")
+	if err != nil {
+		return nil, fmt.Errorf("listing rotations failed: %w", err)
+	}
+
+	// the http systems are checked by host so the URLs, that can hold tokens, are not shown
+	hosts := map[string]string{}
+	databases := map[string]*rotationHookConfig{}
+	for _, path := range paths {
+		rotation, err := b.getRotation(ctx, s, path)
+		if err != nil {
+			return nil, err
+		}
+		if rotation == nil {
+			continue
+		}
+		if rotation.Generator == generatorHook {
+			addHealthHost(hosts, "generator_hook", rotation.GeneratorURL)
+		}
+		if rotation.Hook == nil {
+			continue
+		}
+		switch rotation.Hook.Type {
+		case hookTypeHTTP:
+			addHealthHost(hosts, "hook_http", rotation.Hook.URL)
+			addHealthHost(hosts, "hook_http", rotation.Hook.VerifyURL)
+		case hookTypeSQL:
+			databases[path] = rotation.Hook
+		}
+	}
+
+	// the checks share one deadline so a slow system does not add to the others
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	var checkFuncs []func() healthCheck
+	for host, name := range hosts {
+		host, name := host, name
+		checkFuncs = append(checkFuncs, func() healthCheck { return checkHost(ctx, name, host) })
+	}
+	for path, hook := range databases {
+		path, hook := path, hook
+		checkFuncs = append(checkFuncs, func() healthCheck { return checkDatabase(ctx, path, hook) })
+	}
+
+	checks := make([]healthCheck, len(checkFuncs))
+	var wg sync.WaitGroup
+	for i, check := range checkFuncs {
+		wg.Add(1)
+		go func(i int, check func() healthCheck) {
+			defer wg.Done()
+			checks[i] = check()
+		}(i, check)
+	}
+	wg.Wait()
+
+	sort.Slice(checks, func(i, j int) bool {
+		if checks[i].Name != checks[j].Name {
+			return checks[i].Name < checks[j].Name
+		}
+		return checks[i].Target < checks[j].Target
+	})
+	return checks, nil
+}
+
+// addHealthHost adds the host:port of the URL to the hosts to check
+func addHealthHost(hosts map[string]string, name string, rawURL string) {
+	if rawURL == "" {
+		return
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return
+	}
+	host := parsed.Host
+	if parsed.Port() == "" {
+		port := "80"
+		if parsed.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(parsed.Hostname(), port)
+	}
+	if _, ok := hosts[host]; !ok {
+		hosts[host] = name
+	}
+}
+
+// checkHost opens a TCP connection to the host.  Nothing is sent so the check does not
+// call the hook.
+func checkHost(ctx context.Context, name string, host string) healthCheck {
+	start := time.Now()
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err == nil {
+		conn.Close()
+	}
+	return newHealthCheck(name, host, start, err)
+}
+
+// checkDatabase pings the database of the sql hook of the rotation at path.  The connection
+// URL has credentials so the check is named after the rotation.
+func checkDatabase(ctx context.Context, path string, hook *rotationHookConfig) healthCheck {
+	start := time.Now()
+	db, err := sql.Open(hook.Driver, hook.ConnectionURL)
+	if err == nil {
+		err = db.PingContext(ctx)
+		db.Close()
+	}
+	return newHealthCheck("hook_sql", rotationStoragePrefix+path, start, err)
+}
+
+// newHealthCheck returns the result of a check that started at start
+func newHealthCheck(name string, target string, start time.Time, err error) healthCheck {
+	check := healthCheck{Name: name, Target: target, Healthy: err == nil, Duration: time.Since(start)}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
@@ -0,0 +1,151 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// The info path returns the build metadata without a token
+func TestInfo(t *testing.T) {
+
+	SetBuildInfo("2021-11-01", "v1.2.3", "commit abc")
+	defer SetBuildInfo("", "", "")
+
+	b, storage := getBackend(t)
+	assert.Contains(t, b.SpecialPaths().Unauthenticated, "info")
+
+	response, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation:  logical.ReadOperation,
+		Path:       "info",
+		MountPoint: MOUNT_POINT,
+		Storage:    storage,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "2021-11-01", response.Data["build_date"])
+	assert.Equal(t, "v1.2.3", response.Data["build_version"])
+	assert.Equal(t, "commit abc", response.Data["build_info"])
+	assert.Equal(t, "scalesecSecretStore", response.Data["plugin_name"])
+	assert.Equal(t, len(b.(*scalesecSecretStoreBackend).storageMigrations()), response.Data["storage_version"])
+	assert.Equal(t, "v1.2.3", b.(*scalesecSecretStoreBackend).RunningVersion, "vault shows the build version")
+
+	assert.Equal(t, "v1.2.3", runningVersion("1.2.3"))
+	assert.Equal(t, "v2.0.0-rc.1", runningVersion("v2.0.0-rc.1"))
+	assert.Equal(t, "", runningVersion(""))
+	assert.Equal(t, "", runningVersion("nightly"))
+}
+
+// The health path checks the storage and the upstream systems of the rotations
+func TestHealth(t *testing.T) {
+
+	b, storage := getBackend(t)
+	allowUpstreams(t, b, storage)
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "health", nil)
+	assert.Equal(t, true, response.Data["healthy"])
+	checks := response.Data["checks"].([]map[string]interface{})
+	assert.Len(t, checks, 1)
+	assert.Equal(t, "storage", checks[0]["name"])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the health check must not call the hook")
+	}))
+	host := server.Listener.Addr().String()
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "initial"})
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "rotation/app/db", map[string]interface{}{
+		"rotation_period": "1h",
+		"generator":       "hook",
+		"generator_url":   server.URL + "/generate?token=secret",
+	})
+	assert.Nil(t, response, "Response message %v", response)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "health", nil)
+	assert.Equal(t, true, response.Data["healthy"])
+	checks = response.Data["checks"].([]map[string]interface{})
+	assert.Len(t, checks, 2)
+	assert.Equal(t, "generator_hook", checks[1]["name"])
+	assert.Equal(t, host, checks[1]["target"], "only the host of the URL is shown")
+
+	// a system that can not be reached makes the mount unhealthy
+	server.Close()
+	response = sendRequest(t, b, storage, logical.ReadOperation, "health", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, response.Data[logical.HTTPStatusCode])
+
+	var body struct {
+		Data struct {
+			Healthy bool                     `json:"healthy"`
+			Checks  []map[string]interface{} `json:"checks"`
+		} `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(response.Data[logical.HTTPRawBody].(string)), &body))
+	assert.False(t, body.Data.Healthy)
+	assert.Equal(t, true, body.Data.Checks[0]["healthy"], "the storage is still healthy")
+	assert.Equal(t, false, body.Data.Checks[1]["healthy"])
+	assert.NotEmpty(t, body.Data.Checks[1]["error"])
+	assert.NotContains(t, response.Data[logical.HTTPRawBody], "token=secret")
+}
+
+// slowDriver is a sql driver whose connections take slowPing to answer a ping
+type slowDriver struct{}
+
+const slowPing = 150 * time.Millisecond
+
+func (slowDriver) Open(name string) (driver.Conn, error) { return slowConn{}, nil }
+
+type slowConn struct{ driver.Conn }
+
+func (slowConn) Ping(ctx context.Context) error {
+	select {
+	case <-time.After(slowPing):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (slowConn) Close() error { return nil }
+
+func init() {
+	sql.Register("slow", slowDriver{})
+}
+
+// The upstream systems are checked in parallel and a check past the deadline fails
+func TestHealthParallel(t *testing.T) {
+
+	b, storage := getBackend(t)
+	for _, path := range []string{"app/a", "app/b", "app/c"} {
+		err := b.(*scalesecSecretStoreBackend).putRotation(context.Background(), storage, path, &rotationEntry{
+			Period: time.Hour,
+			Hook:   &rotationHookConfig{Type: hookTypeSQL, Driver: "slow", ConnectionURL: "db"},
+		})
+		assert.Nil(t, err)
+	}
+
+	start := time.Now()
+	checks, err := b.(*scalesecSecretStoreBackend).checkUpstreams(context.Background(), storage)
+	assert.Nil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(2*slowPing), "the checks do not wait one after another")
+	assert.Len(t, checks, 3)
+	for _, check := range checks {
+		assert.True(t, check.Healthy, "check %v", check)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), slowPing/3)
+	defer cancel()
+	checks, err = b.(*scalesecSecretStoreBackend).checkUpstreams(ctx, storage)
+	assert.Nil(t, err)
+	for _, check := range checks {
+		assert.False(t, check.Healthy)
+		assert.Equal(t, "hook_sql", check.Name)
+	}
+}
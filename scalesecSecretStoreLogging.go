@@ -0,0 +1,125 @@
+// ********************************************************************************
+// Logging of the requests
+//
+// Every request is logged at debug level with structured fields that identify it and
+// never with the values it carries:
+//
+//   request_id : ID of the request, the same as in the vault audit log
+//   operation  : read, create, update, delete or list
+//   path       : path of the request in the mount
+//   mount      : mount point of the plugin
+//   entity_id  : entity of the caller
+//   data_keys  : names of the request fields; their values are redacted
+//
+// The log level of the plugin is set per mount on the config path, IE: to see the debug
+// logs of one mount only:
+//
+//   vault write scalesecsecrets/config log_level=debug
+//
+// Without log_level the level set by vault is kept, and clearing log_level restores it.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// The log levels of the config
+var logLevels = []string{"trace", "debug", "info", "warn", "error"}
+
+// requestLogger returns the logger of the backend with the fields that identify the request
+func (b *scalesecSecretStoreBackend) requestLogger(req *logical.Request) hclog.Logger {
+	return b.Logger().With(
+		"request_id", req.ID,
+		"operation", string(req.Operation),
+		"path", req.Path,
+		"mount", req.MountPoint,
+		"entity_id", req.EntityID,
+		"data_keys", redactedKeys(req.Data),
+	)
+}
+
+// logRequests returns the paths with their handlers logging each request
+func (b *scalesecSecretStoreBackend) logRequests(paths []*framework.Path) []*framework.Path {
+	for _, path := range paths {
+		for operation, handler := range path.Operations {
+			if pathOperation, ok := handler.(*framework.PathOperation); ok {
+				pathOperation.Callback = b.logged(pathOperation.Callback)
+				path.Operations[operation] = pathOperation
+			}
+		}
+	}
+	return paths
+}
+
+// logged returns the handler logging the request before it is handled
+func (b *scalesecSecretStoreBackend) logged(handler framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		b.requestLogger(req).Debug("scalesecSecretStore:-> request")
+		return handler(ctx, req, data)
+	}
+}
+
+// redactedKeys returns the sorted names of the fields of data without their values
+func redactedKeys(data map[string]interface{}) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseLogLevel checks the log level of the config.  An empty level keeps the one of vault.
+func parseLogLevel(level string) (string, error) {
+	level = strings.ToLower(strings.TrimSpace(level))
+	if level == "" {
+		return "", nil
+	}
+	for _, known := range logLevels {
+		if level == known {
+			return level, nil
+		}
+	}
+	return "", fmt.Errorf("log_level must be one of %s", strings.Join(logLevels, ", "))
+}
+
+// applyLogLevel sets the log level of the backend from the config.  The level set by vault
+// is kept the first time so it can be restored when the config has no level.
+func (b *scalesecSecretStoreBackend) applyLogLevel(config *mountConfig) {
+	b.logLevelOnce.Do(func() {
+		b.vaultLogLevel = loggerLevel(b.Logger())
+	})
+
+	if config.LogLevel == "" {
+		b.Logger().SetLevel(b.vaultLogLevel)
+		return
+	}
+	b.Logger().SetLevel(hclog.LevelFromString(config.LogLevel))
+}
+
+// loggerLevel returns the level of the logger.  The logger of this hclog version does not
+// tell its level so it is found from the levels it logs.
+func loggerLevel(logger hclog.Logger) hclog.Level {
+	switch {
+	case logger.IsTrace():
+		return hclog.Trace
+	case logger.IsDebug():
+		return hclog.Debug
+	case logger.IsInfo():
+		return hclog.Info
+	case logger.IsWarn():
+		return hclog.Warn
+	case logger.IsError():
+		return hclog.Error
+	}
+	return hclog.Off
+}
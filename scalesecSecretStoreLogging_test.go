@@ -0,0 +1,133 @@
+package scalesecSecretStore
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// syncBuffer is a buffer the logger can write to from several goroutines
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// a backend logging in JSON to the returned buffer
+func getLoggingBackend(t *testing.T) (logical.Backend, logical.Storage, *syncBuffer) {
+	output := &syncBuffer{}
+	backendConfig := &logical.BackendConfig{
+		Logger:      log.New(&log.LoggerOptions{Output: output, Level: log.Trace, JSONFormat: true}),
+		System:      &logical.StaticSystemView{},
+		StorageView: &logical.InmemStorage{},
+		BackendUUID: "test",
+		Config:      map[string]string{},
+	}
+
+	b, err := Factory(context.Background(), backendConfig)
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+	return b, backendConfig.StorageView, output
+}
+
+// The requests are logged with the fields that identify them and never with their values
+func TestRequestLogging(t *testing.T) {
+
+	b, storage, output := getLoggingBackend(t)
+
+	for _, operation := range []logical.Operation{logical.CreateOperation, logical.ReadOperation, logical.ListOperation, logical.DeleteOperation} {
+		path := "app/db"
+		if operation == logical.ListOperation {
+			path = "app/"
+		}
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			ID:          "req-" + string(operation),
+			Operation:   operation,
+			Path:        path,
+			MountPoint:  MOUNT_POINT,
+			Storage:     storage,
+			ClientToken: "test_token",
+			EntityID:    "e1",
+			Data:        map[string]interface{}{"password": "s3cr3t-value"},
+		})
+		assert.Nil(t, err)
+	}
+
+	logs := output.String()
+	assert.NotContains(t, logs, "s3cr3t-value")
+	assert.NotContains(t, logs, "test_token")
+	for _, expected := range []string{`"request_id":"req-create"`, `"request_id":"req-read"`, `"operation":"delete"`, `"entity_id":"e1"`, `"mount":"scalesecsecrets/"`, `"data_keys":["password"]`} {
+		assert.Contains(t, logs, expected)
+	}
+}
+
+// log_level on the config sets the log level of the mount
+func TestLogLevel(t *testing.T) {
+
+	b, storage, output := getLoggingBackend(t)
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"log_level": "verbose"})
+	assert.True(t, response.IsError())
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"log_level": "warn"})
+	response = sendRequest(t, b, storage, logical.ReadOperation, "config", nil)
+	assert.Equal(t, "warn", response.Data["log_level"])
+
+	before := len(output.String())
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.False(t, strings.Contains(output.String()[before:], `"@level":"debug"`))
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"log_level": "debug"})
+	before = len(output.String())
+	sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.True(t, strings.Contains(output.String()[before:], `"@level":"debug"`))
+	assert.False(t, strings.Contains(output.String()[before:], `"@level":"trace"`))
+
+	// clearing log_level restores the level set by vault
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"log_level": "warn"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"log_level": ""})
+	assert.Equal(t, log.Trace, loggerLevel(b.Logger()))
+}
+
+// The requests of every path are logged, not only the ones of the secrets
+func TestRequestLoggingEveryPath(t *testing.T) {
+
+	b, storage, output := getLoggingBackend(t)
+
+	for _, path := range []string{"config", "quotas/", "status/cache", "metadata/app/db"} {
+		var operation logical.Operation = logical.ReadOperation
+		if strings.HasSuffix(path, "/") {
+			operation = logical.ListOperation
+		}
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			ID:          "req-" + path,
+			Operation:   operation,
+			Path:        path,
+			MountPoint:  MOUNT_POINT,
+			Storage:     storage,
+			ClientToken: "test_token",
+		})
+		assert.Nil(t, err)
+		assert.Contains(t, output.String(), `"request_id":"req-`+path+`"`)
+	}
+}
@@ -0,0 +1,266 @@
+// ********************************************************************************
+// Custom metadata and tags of the secrets
+//
+// The metadata of a secret describes it without exposing its values: who owns it, the team,
+// the ticket it was created for, ...  It is managed on metadata/<path>:
+//
+//   vault write scalesecsecrets/metadata/app/db custom_metadata=owner=alice \
+//     custom_metadata=team=payments tags=prod,database
+//   vault read scalesecsecrets/metadata/app/db
+//
+// expires_at sets when the secret stops being valid (see scalesecSecretStoreExpiry.go).  The
+// read also returns who read the secret and when (see scalesecSecretStoreAccess.go).
+//
+// Writing custom_metadata, tags or expires_at replaces the previous value of the field.  The
+// metadata does not change the version of the secret and is kept when the secret data changes.
+// A list can be filtered by tag:  LIST /v1/scalesecsecrets/app/?tag=prod
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// metadataPaths returns the path to manage the metadata of the secrets.
+func (b *scalesecSecretStoreBackend) metadataPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.metadataPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "metadata/" + framework.MatchAllRegex("path"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Specifies the path of the secret.",
+				},
+				"custom_metadata": {
+					Type:        framework.TypeKVPairs,
+					Description: "Key value pairs describing the secret.  IE: owner=alice team=payments",
+				},
+				"tags": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Tags of the secret.  A list can be filtered by tag.",
+				},
+				"expires_at": {
+					Type:        framework.TypeTime,
+					Description: "When the secret expires.  RFC3339 or unix seconds, 0 for never.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleMetadataRead,
+					Summary:  "Read the metadata of a secret.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleMetadataWrite,
+					Summary:  "Set the custom metadata, tags and expiry of a secret.",
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.handleMetadataDelete,
+					Summary:  "Remove the custom metadata, tags and expiry of a secret.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.metadataPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleMetadataRead: Read the metadata of a secret
+//
+// GOAL:  	Return what describes the secret but never its values
+// Return:
+// 			*logical.Response := the metadata or nil if there is no secret at the path
+// 			error := Error with details if the read failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleMetadataRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleMetadataRead:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleMetadataRead:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	secret, err := b.getSecret(ctx, req.Storage, data.Get("path").(string))
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleMetadataRead:-> Leaving with error")
+		return nil, fmt.Errorf("reading secret failed: %w", err)
+	}
+	if secret == nil {
+		b.Logger().Debug("scalesecSecretStore.handleMetadataRead:-> Leaving no value at path")
+		return nil, nil
+	}
+
+	customMetadata := secret.CustomMetadata
+	if customMetadata == nil {
+		customMetadata = map[string]string{}
+	}
+	tags := secret.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	expiresAt := ""
+	if secret.ExpiresAt != nil {
+		expiresAt = secret.ExpiresAt.Format(time.RFC3339Nano)
+	}
+
+	access, err := b.getAccess(ctx, req.Storage, strings.TrimSuffix(data.Get("path").(string), "/"))
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleMetadataRead:-> Leaving with error")
+		return nil, err
+	}
+
+	responseData := map[string]interface{}{
+		"custom_metadata": customMetadata,
+		"tags":            tags,
+		"expires_at":      expiresAt,
+		"version":         secret.Version,
+		"updated_time":    secret.UpdatedTime.Format(time.RFC3339Nano),
+	}
+	for key, value := range access.accessResponseData() {
+		responseData[key] = value
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleMetadataRead:-> Leaving")
+	return &logical.Response{
+		Data: responseData,
+	}, nil
+}
+
+// ============================================================================================
+// handleMetadataWrite: Set the custom metadata, tags and expiry of a secret
+//
+// GOAL:  	Replace the fields given in the request.  The data and version of the secret do not change.
+// Return:
+// 			*logical.Response := nil for success or an error response if there is no secret
+// 			error := Error with details if the write failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleMetadataWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleMetadataWrite:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleMetadataWrite:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	path := data.Get("path").(string)
+
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	secret, err := b.getSecret(ctx, req.Storage, path)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleMetadataWrite:-> Leaving with error")
+		return nil, fmt.Errorf("reading secret failed: %w", err)
+	}
+	if secret == nil {
+		b.Logger().Debug("scalesecSecretStore.handleMetadataWrite:-> Leaving no value at path")
+		return logical.ErrorResponse("there is no secret at %q", path), nil
+	}
+
+	if value, ok := data.GetOk("custom_metadata"); ok {
+		customMetadata := value.(map[string]string)
+		for key := range customMetadata {
+			if strings.TrimSpace(key) == "" {
+				return logical.ErrorResponse("custom_metadata keys must not be empty"), nil
+			}
+		}
+		secret.CustomMetadata = customMetadata
+	}
+	if value, ok := data.GetOk("tags"); ok {
+		secret.Tags = normalizeTags(value.([]string))
+	}
+	if value, ok := data.GetOk("expires_at"); ok {
+		secret.ExpiresAt = nil
+		if expiresAt := value.(time.Time); expiresAt.Unix() > 0 {
+			expiresAt = expiresAt.UTC()
+			secret.ExpiresAt = &expiresAt
+		}
+	}
+
+	if err := b.putSecret(ctx, req.Storage, path, secret); err != nil {
+		if resp := quotaErrorResponse(err); resp != nil {
+			b.Logger().Debug("scalesecSecretStore.handleMetadataWrite:-> Leaving over quota")
+			return resp, nil
+		}
+		b.Logger().Debug("scalesecSecretStore.handleMetadataWrite:-> Leaving with error")
+		return nil, fmt.Errorf("storing secret failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleMetadataWrite:-> Leaving")
+	return nil, nil
+}
+
+// ============================================================================================
+// handleMetadataDelete: Remove the custom metadata, tags and expiry of a secret
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleMetadataDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleMetadataDelete:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleMetadataDelete:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	path := data.Get("path").(string)
+
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	secret, err := b.getSecret(ctx, req.Storage, path)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleMetadataDelete:-> Leaving with error")
+		return nil, fmt.Errorf("reading secret failed: %w", err)
+	}
+	if secret == nil {
+		b.Logger().Debug("scalesecSecretStore.handleMetadataDelete:-> Leaving no value at path")
+		return nil, nil
+	}
+
+	secret.CustomMetadata = nil
+	secret.Tags = nil
+	secret.ExpiresAt = nil
+	if err := b.putSecret(ctx, req.Storage, path, secret); err != nil {
+		if resp := quotaErrorResponse(err); resp != nil {
+			b.Logger().Debug("scalesecSecretStore.handleMetadataDelete:-> Leaving over quota")
+			return resp, nil
+		}
+		b.Logger().Debug("scalesecSecretStore.handleMetadataDelete:-> Leaving with error")
+		return nil, fmt.Errorf("storing secret failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleMetadataDelete:-> Leaving")
+	return nil, nil
+}
+
+// normalizeTags trims the tags and drops the empty and repeated ones
+func normalizeTags(tags []string) []string {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
@@ -0,0 +1,74 @@
+package scalesecSecretStore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// vault write scalesecsecrets/metadata/app/db custom_metadata=owner=alice tags=prod,database
+func TestMetadata(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "metadata/app/db", map[string]interface{}{
+		"custom_metadata": map[string]interface{}{"owner": "alice", "team": "payments"},
+		"tags":            "prod, database,prod",
+	})
+	assert.Nil(t, response, "Response message %v", response)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "metadata/app/db", nil)
+	assert.Equal(t, map[string]string{"owner": "alice", "team": "payments"}, response.Data["custom_metadata"])
+	assert.Equal(t, []string{"prod", "database"}, response.Data["tags"])
+	assert.Equal(t, 1, response.Data["version"])
+	assert.NotContains(t, response.Data, "password")
+	assert.NotContains(t, response.Data, "data")
+
+	// the metadata is kept when the data changes and only the given fields are replaced
+	sendRequest(t, b, storage, logical.UpdateOperation, "app/db", map[string]interface{}{"password": "p2"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "metadata/app/db", map[string]interface{}{"tags": "staging"})
+	response = sendRequest(t, b, storage, logical.ReadOperation, "metadata/app/db", nil)
+	assert.Equal(t, map[string]string{"owner": "alice", "team": "payments"}, response.Data["custom_metadata"])
+	assert.Equal(t, []string{"staging"}, response.Data["tags"])
+	assert.Equal(t, 2, response.Data["version"])
+
+	// the data of the secret is not changed by the metadata
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, map[string]interface{}{"password": "p2"}, response.Data)
+
+	sendRequest(t, b, storage, logical.DeleteOperation, "metadata/app/db", nil)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "metadata/app/db", nil)
+	assert.Equal(t, map[string]string{}, response.Data["custom_metadata"])
+	assert.Equal(t, []string{}, response.Data["tags"])
+}
+
+// There is no metadata without a secret
+func TestMetadataMissingSecret(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "metadata/app/db", nil)
+	assert.Nil(t, response)
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "metadata/app/db", map[string]interface{}{"tags": "prod"})
+	assert.True(t, response.IsError())
+}
+
+// LIST /v1/scalesecsecrets/app/?tag=prod
+func TestListByTag(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.CreateOperation, "app/api", map[string]interface{}{"key": "k1"})
+	sendRequest(t, b, storage, logical.CreateOperation, "app/nested/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "metadata/app/db", map[string]interface{}{"tags": "prod"})
+
+	response := sendRequest(t, b, storage, logical.ListOperation, "app/", map[string]interface{}{"tag": "prod"})
+	assert.Equal(t, []string{"db"}, response.Data["keys"])
+
+	response = sendRequest(t, b, storage, logical.ListOperation, "app/", nil)
+	assert.Equal(t, []string{"api", "db", "nested/"}, response.Data["keys"])
+}
@@ -0,0 +1,340 @@
+// ********************************************************************************
+// Metrics of the plugin
+//
+// The requests and the calls to the providers the plugin depends on (the storage, the
+// rotation hooks and the generator hook) are measured:
+//
+//   scalesec_secret_store_requests_total{operation}                 requests handled
+//   scalesec_secret_store_request_errors_total{operation}           requests that failed
+//   scalesec_secret_store_request_duration_seconds{operation}       latency histogram
+//   scalesec_secret_store_provider_calls_total{provider,call}        provider calls
+//   scalesec_secret_store_provider_errors_total{provider,call}       provider calls that failed
+//   scalesec_secret_store_provider_duration_seconds{provider,call}  latency histogram
+//
+// They are sent to the go-metrics sink of the process, and the metrics path returns them
+// in the Prometheus text format so they can be scraped from the mount:
+//
+//   curl -H "X-Vault-Token: ..." $VAULT_ADDR/v1/scalesecsecrets/metrics
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Prefix of the metric names
+const metricsPrefix = "scalesec_secret_store"
+
+// Upper bounds in seconds of the buckets of the latency histograms
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricsRegistry keeps the counters and histograms for the metrics path
+type metricsRegistry struct {
+	lock       sync.Mutex
+	counters   map[string]*counterMetric
+	histograms map[string]*histogramMetric
+}
+
+// counterMetric is a counter with its labels
+type counterMetric struct {
+	name   string
+	labels []metrics.Label
+	value  uint64
+}
+
+// histogramMetric is a latency histogram with its labels.  buckets[i] counts the
+// observations up to latencyBuckets[i].
+type histogramMetric struct {
+	name    string
+	labels  []metrics.Label
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// newMetricsRegistry returns an empty registry
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		counters:   map[string]*counterMetric{},
+		histograms: map[string]*histogramMetric{},
+	}
+}
+
+// metricKey returns the key of a metric with its labels
+func metricKey(name string, labels []metrics.Label) string {
+	var key strings.Builder
+	key.WriteString(name)
+	for _, label := range labels {
+		key.WriteString("," + label.Name + "=" + label.Value)
+	}
+	return key.String()
+}
+
+// incrCounter adds one to the counter and to the go-metrics sink
+func (r *metricsRegistry) incrCounter(name string, labels []metrics.Label) {
+	metrics.IncrCounterWithLabels([]string{metricsPrefix, name}, 1, labels)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := metricKey(name, labels)
+	counter, ok := r.counters[key]
+	if !ok {
+		counter = &counterMetric{name: name, labels: labels}
+		r.counters[key] = counter
+	}
+	counter.value++
+}
+
+// observe adds the duration since start to the histogram and to the go-metrics sink
+func (r *metricsRegistry) observe(name string, labels []metrics.Label, start time.Time) {
+	metrics.MeasureSinceWithLabels([]string{metricsPrefix, name}, start, labels)
+	seconds := time.Since(start).Seconds()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := metricKey(name, labels)
+	histogram, ok := r.histograms[key]
+	if !ok {
+		histogram = &histogramMetric{name: name, labels: labels, buckets: make([]uint64, len(latencyBuckets))}
+		r.histograms[key] = histogram
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			histogram.buckets[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+}
+
+// prometheusText returns the metrics in the Prometheus text format
+func (r *metricsRegistry) prometheusText() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var out strings.Builder
+
+	counters := make([]*counterMetric, 0, len(r.counters))
+	for _, counter := range r.counters {
+		counters = append(counters, counter)
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		return metricKey(counters[i].name, counters[i].labels) < metricKey(counters[j].name, counters[j].labels)
+	})
+	previous := ""
+	for _, counter := range counters {
+		name := metricsPrefix + "_" + counter.name + "_total"
+		if name != previous {
+			fmt.Fprintf(&out, "# TYPE %s counter\n", name)
+			previous = name
+		}
+		fmt.Fprintf(&out, "%s%s %d\n", name, prometheusLabels(counter.labels, ""), counter.value)
+	}
+
+	histograms := make([]*histogramMetric, 0, len(r.histograms))
+	for _, histogram := range r.histograms {
+		histograms = append(histograms, histogram)
+	}
+	sort.Slice(histograms, func(i, j int) bool {
+		return metricKey(histograms[i].name, histograms[i].labels) < metricKey(histograms[j].name, histograms[j].labels)
+	})
+	previous = ""
+	for _, histogram := range histograms {
+		name := metricsPrefix + "_" + histogram.name + "_seconds"
+		if name != previous {
+			fmt.Fprintf(&out, "# TYPE %s histogram\n", name)
+			previous = name
+		}
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(&out, "%s_bucket%s %d\n", name, prometheusLabels(histogram.labels, fmt.Sprint(bound)), histogram.buckets[i])
+		}
+		fmt.Fprintf(&out, "%s_bucket%s %d\n", name, prometheusLabels(histogram.labels, "+Inf"), histogram.count)
+		fmt.Fprintf(&out, "%s_sum%s %g\n", name, prometheusLabels(histogram.labels, ""), histogram.sum)
+		fmt.Fprintf(&out, "%s_count%s %d\n", name, prometheusLabels(histogram.labels, ""), histogram.count)
+	}
+
+	return out.String()
+}
+
+// prometheusLabels returns the labels in the Prometheus format, with the le label of a
+// histogram bucket if le is set
+func prometheusLabels(labels []metrics.Label, le string) string {
+	parts := make([]string, 0, len(labels)+1)
+	for _, label := range labels {
+		parts = append(parts, fmt.Sprintf("%s=%q", label.Name, label.Value))
+	}
+	if le != "" {
+		parts = append(parts, fmt.Sprintf("le=%q", le))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// metricsPaths returns the path of the metrics.
+func (b *scalesecSecretStoreBackend) metricsPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.metricsPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "metrics$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleMetrics,
+					Summary:  "Read the metrics of the plugin in the Prometheus text format.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.metricsPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleMetrics: Read the metrics of the plugin
+//
+// GOAL:  	Return the counters and histograms in the Prometheus text format
+// Return:
+// 			*logical.Response := raw text/plain response with the metrics
+// 			error := Error with details if the read failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleMetrics(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleMetrics:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleMetrics:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleMetrics:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "text/plain; version=0.0.4",
+			logical.HTTPRawBody:     []byte(b.metrics.prometheusText()),
+			logical.HTTPStatusCode:  http.StatusOK,
+		},
+	}, nil
+}
+
+// instrumentRequests returns the paths with their handlers and existence checks measured and
+// traced.  A create and an update are both measured as a write.
+func (b *scalesecSecretStoreBackend) instrumentRequests(paths []*framework.Path) []*framework.Path {
+	for _, path := range paths {
+		for operation, handler := range path.Operations {
+			if pathOperation, ok := handler.(*framework.PathOperation); ok {
+				name := string(operation)
+				if operation == logical.CreateOperation || operation == logical.UpdateOperation {
+					name = "write"
+				}
+				pathOperation.Callback = b.instrument(name, pathOperation.Callback)
+				path.Operations[operation] = pathOperation
+			}
+		}
+		if path.ExistenceCheck != nil {
+			path.ExistenceCheck = b.instrumentExistenceCheck(path.ExistenceCheck)
+		}
+	}
+	return paths
+}
+
+// instrument returns the handler measured and traced under the operation name.  An error
+// response counts as an error.
+func (b *scalesecSecretStoreBackend) instrument(operation string, handler framework.OperationFunc) framework.OperationFunc {
+	labels := []metrics.Label{{Name: "operation", Value: operation}}
+
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		start := time.Now()
+		ctx, span := b.startRequestSpan(ctx, operation, req)
+		resp, err := handler(ctx, req, data)
+		failed := err != nil || (resp != nil && resp.IsError())
+		endSpan(span, failed)
+
+		b.metrics.incrCounter("requests", labels)
+		if failed {
+			b.metrics.incrCounter("request_errors", labels)
+		}
+		b.metrics.observe("request_duration", labels, start)
+		return resp, err
+	}
+}
+
+// instrumentExistenceCheck returns the existence check measured and traced like a handler
+func (b *scalesecSecretStoreBackend) instrumentExistenceCheck(check framework.ExistenceFunc) framework.ExistenceFunc {
+	labels := []metrics.Label{{Name: "operation", Value: "existence_check"}}
+
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+		start := time.Now()
+		ctx, span := b.startRequestSpan(ctx, "existence_check", req)
+		exists, err := check(ctx, req, data)
+		endSpan(span, err != nil)
+
+		b.metrics.incrCounter("requests", labels)
+		if err != nil {
+			b.metrics.incrCounter("request_errors", labels)
+		}
+		b.metrics.observe("request_duration", labels, start)
+		return exists, err
+	}
+}
+
+// measureProvider measures a call to a provider the plugin depends on
+func (b *scalesecSecretStoreBackend) measureProvider(provider string, call string, start time.Time, err error) {
+	labels := []metrics.Label{{Name: "provider", Value: provider}, {Name: "call", Value: call}}
+
+	b.metrics.incrCounter("provider_calls", labels)
+	if err != nil {
+		b.metrics.incrCounter("provider_errors", labels)
+	}
+	b.metrics.observe("provider_duration", labels, start)
+}
+
+// measuredRotationHook measures and traces the calls to a rotation hook
+type measuredRotationHook struct {
+	b        *scalesecSecretStoreBackend
+	hook     rotationHook
+	provider string
+}
+
+// Push sets the secret data on the consumer
+func (h *measuredRotationHook) Push(ctx context.Context, path string, data map[string]interface{}) (err error) {
+	ctx, end := h.b.startProviderCall(ctx, h.provider, "push")
+	defer func() { end(err) }()
+	return h.hook.Push(ctx, path, data)
+}
+
+// Verify checks the consumer accepts the secret data that was pushed
+func (h *measuredRotationHook) Verify(ctx context.Context, path string, data map[string]interface{}) (err error) {
+	ctx, end := h.b.startProviderCall(ctx, h.provider, "verify")
+	defer func() { end(err) }()
+	return h.hook.Verify(ctx, path, data)
+}
+
+// Close releases what the hook holds
+func (h *measuredRotationHook) Close() error {
+	return h.hook.Close()
+}
+
+// Rollback pushes the previous data back to the consumer the way the hook does it
+func (h *measuredRotationHook) Rollback(ctx context.Context, path string, previous map[string]interface{}) (err error) {
+	ctx, end := h.b.startProviderCall(ctx, h.provider, "rollback")
+	defer func() { end(err) }()
+	return rollbackRotation(ctx, h.hook, path, previous)
+}
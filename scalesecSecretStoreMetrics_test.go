@@ -0,0 +1,62 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// read the metrics path and return its body
+func readMetrics(t *testing.T, b logical.Backend, storage logical.Storage) string {
+	response := sendRequest(t, b, storage, logical.ReadOperation, "metrics", nil)
+	assert.Equal(t, "text/plain; version=0.0.4", response.Data[logical.HTTPContentType])
+	assert.Equal(t, http.StatusOK, response.Data[logical.HTTPStatusCode])
+	return string(response.Data[logical.HTTPRawBody].([]byte))
+}
+
+// The handlers and the storage calls are counted and measured
+func TestMetrics(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	sendRequest(t, b, storage, logical.ListOperation, "app/", nil)
+	_, _, err := b.HandleExistenceCheck(context.Background(), &logical.Request{Operation: logical.CreateOperation, Path: "app/db", Storage: storage, ClientToken: "test_token"})
+	assert.Nil(t, err)
+
+	body := readMetrics(t, b, storage)
+	assert.Contains(t, body, "# TYPE scalesec_secret_store_requests_total counter\n")
+	assert.Contains(t, body, `scalesec_secret_store_requests_total{operation="read"} 2`+"\n")
+	assert.Contains(t, body, `scalesec_secret_store_requests_total{operation="list"} 1`+"\n")
+	assert.Contains(t, body, `scalesec_secret_store_requests_total{operation="existence_check"} 1`+"\n")
+	assert.Contains(t, body, "# TYPE scalesec_secret_store_request_duration_seconds histogram\n")
+	assert.Contains(t, body, `scalesec_secret_store_request_duration_seconds_bucket{operation="read",le="+Inf"} 2`+"\n")
+	assert.Contains(t, body, `scalesec_secret_store_request_duration_seconds_count{operation="read"} 2`+"\n")
+	assert.Contains(t, body, `scalesec_secret_store_provider_calls_total{provider="storage",call="write"}`)
+	assert.Contains(t, body, `scalesec_secret_store_provider_calls_total{provider="storage",call="get"}`)
+	assert.NotContains(t, body, "p1", "values are never in the metrics")
+}
+
+// An error or an error response counts as a failed request
+func TestMetricsErrors(t *testing.T) {
+
+	b, storage := getBackend(t)
+	backend := b.(*scalesecSecretStoreBackend)
+
+	failing := backend.instrument("write", func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		return logical.ErrorResponse("invalid"), nil
+	})
+	_, err := failing(context.Background(), &logical.Request{}, nil)
+	assert.Nil(t, err)
+
+	body := readMetrics(t, b, storage)
+	assert.Contains(t, body, `scalesec_secret_store_requests_total{operation="write"} 1`+"\n")
+	assert.Contains(t, body, `scalesec_secret_store_request_errors_total{operation="write"} 1`+"\n")
+}
@@ -0,0 +1,614 @@
+// ********************************************************************************
+// Storage quotas of the secrets
+//
+// A quota limits what the secrets under a directory, IE: the directory of a team, can use:
+//
+//   vault write scalesecsecrets/quotas/team-a max_secrets=500 max_bytes=10485760 max_value_size=65536
+//   vault read scalesecsecrets/quotas/team-a
+//
+// max_secrets    : how many secrets can be stored under the directory
+// max_bytes      : how many bytes the stored secrets can use, with their versions and metadata
+// max_value_size : how many bytes the data of one secret can have, JSON encoded
+//
+// 0 does not limit.  The read returns the limits and the usage.  A deleted secret counts
+// until it is purged because it is still stored.
+//
+// The usage is kept in quota_usage/<directory> and is changed in the same transactional
+// write as the secrets (see transactionalWrite), so it always matches them.  A write that
+// adds to the usage beyond a limit fails and nothing is written; a write that lowers the
+// usage is always allowed so a directory over its quota can be cleaned up.  Writing the
+// quota counts the usage again from the secrets.
+//
+// The quotas a write applies to are found before anything is locked.  Only the usage of
+// those quotas is locked for the write, so the writes of directories without a quota and of
+// other quotas do not wait on each other.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Storage prefixes of the quotas and of their usage
+const (
+	quotaStoragePrefix      = "quota/"
+	quotaUsageStoragePrefix = "quota_usage/"
+)
+
+// quotaEntry is the storage entry for the limits of a directory
+type quotaEntry struct {
+	// Prefix is the directory with a trailing slash, it is not stored
+	Prefix string `json:"-"`
+
+	MaxSecrets   int64 `json:"max_secrets"`
+	MaxBytes     int64 `json:"max_bytes"`
+	MaxValueSize int64 `json:"max_value_size"`
+}
+
+// quotaUsage is the storage entry for what the secrets of a directory use
+type quotaUsage struct {
+	Secrets int64 `json:"secrets"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// quotaError is returned by a write that goes over a quota
+type quotaError struct {
+	prefix string
+	reason string
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("quota of %q exceeded: %s", e.prefix, e.reason)
+}
+
+// quotaErrorResponse returns the error response of a write that went over a quota, or nil
+// if err is another error
+func quotaErrorResponse(err error) *logical.Response {
+	var quotaErr *quotaError
+	if errors.As(err, &quotaErr) {
+		return logical.ErrorResponse(quotaErr.Error())
+	}
+	return nil
+}
+
+// importQuotaErrorResponse returns the error response of an import that went over a quota
+// after it wrote the keys of written, or nil if err is another error.  An import writes its
+// entries one at a time so the caller is told where it stopped.
+func importQuotaErrorResponse(err error, written []string) *logical.Response {
+	if quotaErrorResponse(err) == nil {
+		return nil
+	}
+	if len(written) == 0 {
+		return logical.ErrorResponse("%s, nothing was written", err)
+	}
+	return logical.ErrorResponse("%s, the import stopped there after writing %s", err, strings.Join(written, ", "))
+}
+
+// quotaPaths returns the paths to manage the quotas.
+func (b *scalesecSecretStoreBackend) quotaPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.quotaPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "quotas/?$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.handleQuotaList,
+					Summary:  "Lists the directories with a quota.",
+				},
+			},
+		},
+		{
+			Pattern: "quotas/" + framework.MatchAllRegex("prefix"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"prefix": {
+					Type:        framework.TypeString,
+					Description: "Directory of the secrets the quota applies to.  IE: team-a",
+				},
+				"max_secrets": {
+					Type:        framework.TypeInt,
+					Description: "How many secrets can be stored under the directory.  0 does not limit.",
+				},
+				"max_bytes": {
+					Type:        framework.TypeInt,
+					Description: "How many bytes the stored secrets can use.  0 does not limit.",
+				},
+				"max_value_size": {
+					Type:        framework.TypeInt,
+					Description: "How many bytes the data of one secret can have.  0 does not limit.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleQuotaRead,
+					Summary:  "Read the limits and the usage of a directory.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleQuotaWrite,
+					Summary:  "Set the limits of a directory and count its usage.",
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.handleQuotaDelete,
+					Summary:  "Remove the quota of a directory.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.quotaPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// quotaPrefix returns the directory of the prefix field with a trailing slash
+func quotaPrefix(data *framework.FieldData) string {
+	return strings.Trim(data.Get("prefix").(string), "/") + "/"
+}
+
+// quotaKey returns the storage key of the quota or usage of a directory
+func quotaKey(storagePrefix string, prefix string) string {
+	return storagePrefix + strings.TrimSuffix(prefix, "/")
+}
+
+// ============================================================================================
+// handleQuotaWrite: Set the limits of a directory and count its usage
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleQuotaWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleQuotaWrite:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleQuotaWrite:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	prefix := quotaPrefix(data)
+	if prefix == "/" {
+		return logical.ErrorResponse("prefix must be provided"), nil
+	}
+	entry := &quotaEntry{
+		MaxSecrets:   int64(data.Get("max_secrets").(int)),
+		MaxBytes:     int64(data.Get("max_bytes").(int)),
+		MaxValueSize: int64(data.Get("max_value_size").(int)),
+	}
+	if entry.MaxSecrets < 0 || entry.MaxBytes < 0 || entry.MaxValueSize < 0 {
+		return logical.ErrorResponse("the limits must not be negative"), nil
+	}
+
+	storageEntry, err := logical.StorageEntryJSON(quotaKey(quotaStoragePrefix, prefix), entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// the secrets are not written while their usage is counted
+	b.quotaSetLock.Lock()
+	defer b.quotaSetLock.Unlock()
+
+	usage, err := b.countQuotaUsage(ctx, req.Storage, prefix)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleQuotaWrite:-> Leaving with error")
+		return nil, err
+	}
+	usageEntry, err := logical.StorageEntryJSON(quotaKey(quotaUsageStoragePrefix, prefix), usage)
+	if err != nil {
+		return nil, err
+	}
+
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+
+	if err := req.Storage.Put(ctx, usageEntry); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleQuotaWrite:-> Leaving with error")
+		return nil, fmt.Errorf("storing quota usage failed: %w", err)
+	}
+	if err := req.Storage.Put(ctx, storageEntry); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleQuotaWrite:-> Leaving with error")
+		return nil, fmt.Errorf("storing quota failed: %w", err)
+	}
+	b.quotas = nil
+
+	var resp *logical.Response
+	if over := entry.overLimits(usage); over != "" {
+		resp = &logical.Response{}
+		resp.AddWarning(fmt.Sprintf("the directory is already over its quota: %s", over))
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleQuotaWrite:-> Leaving")
+	return resp, nil
+}
+
+// ============================================================================================
+// handleQuotaRead: Read the limits and the usage of a directory
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleQuotaRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleQuotaRead:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleQuotaRead:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	prefix := quotaPrefix(data)
+	entry, err := getQuota(ctx, req.Storage, prefix)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleQuotaRead:-> Leaving with error")
+		return nil, err
+	}
+	if entry == nil {
+		b.Logger().Debug("scalesecSecretStore.handleQuotaRead:-> Leaving no quota")
+		return nil, nil
+	}
+	usage, err := b.getQuotaUsage(ctx, req.Storage, prefix)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleQuotaRead:-> Leaving with error")
+		return nil, err
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleQuotaRead:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"prefix":         prefix,
+			"max_secrets":    entry.MaxSecrets,
+			"max_bytes":      entry.MaxBytes,
+			"max_value_size": entry.MaxValueSize,
+			"secrets":        usage.Secrets,
+			"bytes":          usage.Bytes,
+		},
+	}, nil
+}
+
+// ============================================================================================
+// handleQuotaDelete: Remove the quota of a directory
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleQuotaDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleQuotaDelete:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleQuotaDelete:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	prefix := quotaPrefix(data)
+
+	b.quotaSetLock.Lock()
+	defer b.quotaSetLock.Unlock()
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+
+	if err := req.Storage.Delete(ctx, quotaKey(quotaStoragePrefix, prefix)); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleQuotaDelete:-> Leaving with error")
+		return nil, fmt.Errorf("deleting quota failed: %w", err)
+	}
+	if err := req.Storage.Delete(ctx, quotaKey(quotaUsageStoragePrefix, prefix)); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleQuotaDelete:-> Leaving with error")
+		return nil, fmt.Errorf("deleting quota usage failed: %w", err)
+	}
+	b.quotas = nil
+
+	b.Logger().Debug("scalesecSecretStore.handleQuotaDelete:-> Leaving")
+	return nil, nil
+}
+
+// ============================================================================================
+// handleQuotaList: List the directories with a quota
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleQuotaList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleQuotaList:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleQuotaList:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	quotas, err := b.loadQuotas(ctx, req.Storage)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleQuotaList:-> Leaving with error")
+		return nil, err
+	}
+	prefixes := make([]string, 0, len(quotas))
+	for _, quota := range quotas {
+		prefixes = append(prefixes, quota.Prefix)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleQuotaList:-> Leaving")
+	return logical.ListResponse(prefixes), nil
+}
+
+// getQuota reads the quota of the directory.  Returns nil if there is none.
+func getQuota(ctx context.Context, s logical.Storage, prefix string) (*quotaEntry, error) {
+	storageEntry, err := s.Get(ctx, quotaKey(quotaStoragePrefix, prefix))
+	if err != nil {
+		return nil, fmt.Errorf("reading quota failed: %w", err)
+	}
+	if storageEntry == nil {
+		return nil, nil
+	}
+
+	entry := &quotaEntry{Prefix: prefix}
+	if err := storageEntry.DecodeJSON(entry); err != nil {
+		return nil, fmt.Errorf("decoding quota of %q failed: %w", prefix, err)
+	}
+	return entry, nil
+}
+
+// loadQuotas returns the quotas.  They are read once and kept until a quota is written or
+// deleted.
+func (b *scalesecSecretStoreBackend) loadQuotas(ctx context.Context, s logical.Storage) ([]*quotaEntry, error) {
+	b.quotaLock.RLock()
+	quotas := b.quotas
+	b.quotaLock.RUnlock()
+	if quotas != nil {
+		return quotas, nil
+	}
+
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+
+	// another request may have loaded them while we waited for the lock
+	if b.quotas != nil {
+		return b.quotas, nil
+	}
+
+	keys, err := logical.CollectKeysWithPrefix(ctx, logical.NewStorageView(s, quotaStoragePrefix), "")
+	if err != nil {
+		return nil, fmt.Errorf("listing quotas failed: %w", err)
+	}
+
+	quotas = []*quotaEntry{}
+	for _, key := range keys {
+		entry, err := getQuota(ctx, s, key+"/")
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			quotas = append(quotas, entry)
+		}
+	}
+
+	b.quotas = quotas
+	return quotas, nil
+}
+
+// resetQuotas drops the quotas so they are read again from storage
+func (b *scalesecSecretStoreBackend) resetQuotas() {
+	b.quotaLock.Lock()
+	b.quotas = nil
+	b.quotaLock.Unlock()
+}
+
+// getQuotaUsage reads the usage of the directory.  It is counted from the secrets if it
+// was not stored, IE: the quota came from an imported bundle.
+func (b *scalesecSecretStoreBackend) getQuotaUsage(ctx context.Context, s logical.Storage, prefix string) (*quotaUsage, error) {
+	storageEntry, err := s.Get(ctx, quotaKey(quotaUsageStoragePrefix, prefix))
+	if err != nil {
+		return nil, fmt.Errorf("reading quota usage failed: %w", err)
+	}
+	if storageEntry == nil {
+		return b.countQuotaUsage(ctx, s, prefix)
+	}
+
+	usage := &quotaUsage{}
+	if err := storageEntry.DecodeJSON(usage); err != nil {
+		return nil, fmt.Errorf("decoding quota usage of %q failed: %w", prefix, err)
+	}
+	return usage, nil
+}
+
+// countQuotaUsage counts the secrets stored under the directory and their size
+func (b *scalesecSecretStoreBackend) countQuotaUsage(ctx context.Context, s logical.Storage, prefix string) (*quotaUsage, error) {
+	keys, err := logical.CollectKeysWithPrefix(ctx, s, secretStoragePrefix+prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing secrets of %q failed: %w", prefix, err)
+	}
+
+	usage := &quotaUsage{}
+	for _, key := range keys {
+		storageEntry, err := s.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if storageEntry != nil {
+			usage.Secrets++
+			usage.Bytes += int64(len(storageEntry.Value))
+		}
+	}
+	return usage, nil
+}
+
+// overLimits returns which limit of the quota the usage is over, or "" if none
+func (q *quotaEntry) overLimits(usage *quotaUsage) string {
+	switch {
+	case q.MaxSecrets > 0 && usage.Secrets > q.MaxSecrets:
+		return fmt.Sprintf("%d secrets, the limit is %d", usage.Secrets, q.MaxSecrets)
+	case q.MaxBytes > 0 && usage.Bytes > q.MaxBytes:
+		return fmt.Sprintf("%d bytes, the limit is %d", usage.Bytes, q.MaxBytes)
+	}
+	return ""
+}
+
+// quotaChanges returns the changes of the usage of the quotas for the changes of a
+// transactional write, and checks the write stays within the limits.  The returned unlock
+// function must be called once the write is done: no other write changes the usage of the
+// same quotas until then, and no quota is written or deleted.
+func (b *scalesecSecretStoreBackend) quotaChanges(ctx context.Context, s logical.Storage, changes []storageChange) ([]storageChange, func(), error) {
+	noop := func() {}
+
+	// held until the write is done so a quota written meanwhile, which counts its usage from
+	// the secrets, does not miss the write
+	b.quotaSetLock.RLock()
+	quotas, err := b.loadQuotas(ctx, s)
+	if err != nil {
+		b.quotaSetLock.RUnlock()
+		return nil, noop, err
+	}
+	applied := appliedQuotas(quotas, changes)
+	if len(applied) == 0 {
+		return nil, b.quotaSetLock.RUnlock, nil
+	}
+
+	unlock := b.lockQuotaUsage(applied)
+	quotaChanges, err := b.computeQuotaChanges(ctx, s, applied, changes)
+	if err != nil {
+		unlock()
+		return nil, noop, err
+	}
+	return quotaChanges, unlock, nil
+}
+
+// lockQuotaUsage locks the usage of the quotas.  The caller holds quotaSetLock for reading;
+// the returned function unlocks the usage and quotaSetLock.
+func (b *scalesecSecretStoreBackend) lockQuotaUsage(quotas []*quotaEntry) func() {
+	locks := b.quotaUsageLocksFor(quotas)
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+		b.quotaSetLock.RUnlock()
+	}
+}
+
+// quotaUsageLocksFor returns the locks of the usage of the quotas in the order they must be taken
+func (b *scalesecSecretStoreBackend) quotaUsageLocksFor(quotas []*quotaEntry) []*locksutil.LockEntry {
+	prefixes := make([]string, 0, len(quotas))
+	for _, quota := range quotas {
+		prefixes = append(prefixes, quota.Prefix)
+	}
+	return locksutil.LocksForKeys(b.quotaUsageLocks, prefixes)
+}
+
+// appliedQuotas returns the quotas of the directories of the secrets changed
+func appliedQuotas(quotas []*quotaEntry, changes []storageChange) []*quotaEntry {
+	var applied []*quotaEntry
+	for _, quota := range quotas {
+		for _, change := range changes {
+			if strings.HasPrefix(change.Key, secretStoragePrefix+quota.Prefix) {
+				applied = append(applied, quota)
+				break
+			}
+		}
+	}
+	return applied
+}
+
+// computeQuotaChanges returns the new usage of the quotas the changes apply to.  The caller
+// holds the usage locks of the quotas.
+func (b *scalesecSecretStoreBackend) computeQuotaChanges(ctx context.Context, s logical.Storage, quotas []*quotaEntry, changes []storageChange) ([]storageChange, error) {
+	deltas := map[*quotaEntry]*quotaUsage{}
+	for _, change := range changes {
+		if !strings.HasPrefix(change.Key, secretStoragePrefix) {
+			continue
+		}
+		path := strings.TrimPrefix(change.Key, secretStoragePrefix)
+
+		var applied []*quotaEntry
+		for _, quota := range quotas {
+			if strings.HasPrefix(path, quota.Prefix) {
+				applied = append(applied, quota)
+			}
+		}
+		if len(applied) == 0 {
+			continue
+		}
+
+		current, err := s.Get(ctx, change.Key)
+		if err != nil {
+			return nil, err
+		}
+		delta := quotaUsage{Bytes: int64(len(change.Value))}
+		if current != nil {
+			delta.Bytes -= int64(len(current.Value))
+			delta.Secrets--
+		}
+		if change.Value != nil {
+			delta.Secrets++
+		}
+
+		// a write that does not grow the data, IE: a delete, is allowed over the limit
+		valueSize, err := secretValueSize(change.Value)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil {
+			currentSize, err := secretValueSize(current.Value)
+			if err != nil {
+				return nil, err
+			}
+			if valueSize <= currentSize {
+				valueSize = 0
+			}
+		}
+		for _, quota := range applied {
+			if quota.MaxValueSize > 0 && valueSize > quota.MaxValueSize {
+				return nil, &quotaError{prefix: quota.Prefix, reason: fmt.Sprintf("the data of %q is %d bytes, the limit is %d", path, valueSize, quota.MaxValueSize)}
+			}
+			if deltas[quota] == nil {
+				deltas[quota] = &quotaUsage{}
+			}
+			deltas[quota].Secrets += delta.Secrets
+			deltas[quota].Bytes += delta.Bytes
+		}
+	}
+
+	var usageChanges []storageChange
+	for _, quota := range quotas {
+		delta, ok := deltas[quota]
+		if !ok || (delta.Secrets == 0 && delta.Bytes == 0) {
+			continue
+		}
+
+		usage, err := b.getQuotaUsage(ctx, s, quota.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		next := &quotaUsage{Secrets: usage.Secrets + delta.Secrets, Bytes: usage.Bytes + delta.Bytes}
+
+		// a write that lowers the usage is allowed even over the limits
+		if delta.Secrets > 0 && quota.MaxSecrets > 0 && next.Secrets > quota.MaxSecrets {
+			return nil, &quotaError{prefix: quota.Prefix, reason: fmt.Sprintf("%d secrets, the limit is %d", next.Secrets, quota.MaxSecrets)}
+		}
+		if delta.Bytes > 0 && quota.MaxBytes > 0 && next.Bytes > quota.MaxBytes {
+			return nil, &quotaError{prefix: quota.Prefix, reason: fmt.Sprintf("%d bytes, the limit is %d", next.Bytes, quota.MaxBytes)}
+		}
+
+		value, err := json.Marshal(next)
+		if err != nil {
+			return nil, err
+		}
+		usageChanges = append(usageChanges, storageChange{Key: quotaKey(quotaUsageStoragePrefix, quota.Prefix), Value: value})
+	}
+	return usageChanges, nil
+}
+
+// secretValueSize returns the size of the JSON encoded data of the stored secret
+func secretValueSize(value []byte) (int64, error) {
+	if value == nil {
+		return 0, nil
+	}
+	var secret secretEntry
+	if err := json.Unmarshal(value, &secret); err != nil {
+		return 0, fmt.Errorf("decoding secret failed: %w", err)
+	}
+	data, err := json.Marshal(secret.Data)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
@@ -0,0 +1,203 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// The writes under a directory are rejected once they go over its quota
+func TestQuota(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	// the secrets written before the quota are counted
+	sendRequest(t, b, storage, logical.CreateOperation, "team-a/db", map[string]interface{}{"password": "p1"})
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "quotas/team-a", map[string]interface{}{
+		"max_secrets":    2,
+		"max_value_size": 40,
+	})
+	assert.Nil(t, response, "Response message %v", response)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "quotas/team-a/", nil)
+	assert.Equal(t, int64(1), response.Data["secrets"])
+	assert.True(t, response.Data["bytes"].(int64) > 0)
+	assert.Equal(t, int64(2), response.Data["max_secrets"])
+
+	response = sendRequest(t, b, storage, logical.CreateOperation, "team-a/api", map[string]interface{}{"key": "k1"})
+	assert.Nil(t, response, "Response message %v", response)
+
+	// a third secret, or a value over the size, is rejected and nothing is written
+	response = sendRequest(t, b, storage, logical.CreateOperation, "team-a/extra", map[string]interface{}{"key": "k1"})
+	assert.True(t, response.IsError())
+	assert.Contains(t, response.Error().Error(), `quota of "team-a/" exceeded: 3 secrets, the limit is 2`)
+	assert.Nil(t, sendRequest(t, b, storage, logical.ReadOperation, "team-a/extra", nil))
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "team-a/db", map[string]interface{}{"password": strings.Repeat("x", 40)})
+	assert.True(t, response.IsError())
+	assert.Contains(t, response.Error().Error(), "the limit is 40")
+	response = sendRequest(t, b, storage, logical.ReadOperation, "team-a/db", nil)
+	assert.Equal(t, "p1", response.Data["password"])
+
+	// a change of an existing secret within the limits, and other directories, are allowed
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "team-a/db", map[string]interface{}{"password": "p2"})
+	assert.Nil(t, response, "Response message %v", response)
+	response = sendRequest(t, b, storage, logical.CreateOperation, "team-b/db", map[string]interface{}{"password": strings.Repeat("x", 100)})
+	assert.Nil(t, response, "Response message %v", response)
+
+	// a batch over the quota is rejected as a whole
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "batch", map[string]interface{}{
+		"operations": []interface{}{
+			map[string]interface{}{"operation": "put", "path": "team-b/api", "data": map[string]interface{}{"key": "k2"}},
+			map[string]interface{}{"operation": "put", "path": "team-a/extra", "data": map[string]interface{}{"key": "k2"}},
+		},
+	})
+	assert.True(t, response.IsError())
+	assert.Contains(t, response.Error().Error(), "batch rejected, nothing was written")
+	assert.Nil(t, sendRequest(t, b, storage, logical.ReadOperation, "team-b/api", nil))
+
+	// a deleted secret counts until it is purged
+	sendRequest(t, b, storage, logical.DeleteOperation, "team-a/api", nil)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "quotas/team-a", nil)
+	assert.Equal(t, int64(2), response.Data["secrets"])
+
+	now = now.Add(31 * 24 * time.Hour)
+	runPeriodic(t, b, storage)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "quotas/team-a", nil)
+	assert.Equal(t, int64(1), response.Data["secrets"])
+
+	response = sendRequest(t, b, storage, logical.CreateOperation, "team-a/extra", map[string]interface{}{"key": "k1"})
+	assert.Nil(t, response, "Response message %v", response)
+}
+
+// The usage matches what is stored, is counted again when the quota is written, and is not
+// exported
+func TestQuotaUsage(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "quotas/team-a", map[string]interface{}{"max_bytes": 1 << 20})
+	sendRequest(t, b, storage, logical.CreateOperation, "team-a/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.CreateOperation, "team-a/nested/api", map[string]interface{}{"key": "k1"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "team-a/db", map[string]interface{}{"password": "a longer password"})
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "quotas/team-a", nil)
+	maintained := response.Data["bytes"].(int64)
+	assert.Equal(t, int64(2), response.Data["secrets"])
+
+	storage.Delete(context.Background(), quotaUsageStoragePrefix+"team-a")
+	response = sendRequest(t, b, storage, logical.ReadOperation, "quotas/team-a", nil)
+	assert.Equal(t, int64(2), response.Data["secrets"])
+	assert.Equal(t, maintained, response.Data["bytes"], "the maintained usage matches the counted usage")
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "quotas/team-a", map[string]interface{}{"max_secrets": 1})
+	assert.Contains(t, response.Warnings[0], "already over its quota")
+
+	response = sendRequest(t, b, storage, logical.ListOperation, "quotas/", nil)
+	assert.Equal(t, []string{"team-a/"}, response.Data["keys"])
+
+	assert.True(t, skipExport(quotaUsageStoragePrefix+"team-a"))
+	assert.False(t, skipExport(quotaStoragePrefix+"team-a"))
+
+	sendRequest(t, b, storage, logical.DeleteOperation, "quotas/team-a", nil)
+	assert.Nil(t, sendRequest(t, b, storage, logical.ReadOperation, "quotas/team-a", nil))
+	response = sendRequest(t, b, storage, logical.CreateOperation, "team-a/other", map[string]interface{}{"key": "k1"})
+	assert.Nil(t, response, "Response message %v", response)
+}
+
+// The metadata writes and the imports over a quota get an error response, and an import
+// tells what it wrote before it stopped
+func TestQuotaWriters(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.CreateOperation, "team-a/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "quotas/team-a", map[string]interface{}{"max_secrets": 2})
+	response := sendRequest(t, b, storage, logical.ReadOperation, "quotas/team-a", nil)
+	used := response.Data["bytes"].(int64)
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "importer", map[string]interface{}{
+		"format":  "kv-json",
+		"content": `{"team-a/a": {"key": "k1"}, "team-a/b": {"key": "k2"}}`,
+	})
+	assert.True(t, response.IsError())
+	assert.Equal(t, `importing "team-a/b" failed: quota of "team-a/" exceeded: 3 secrets, the limit is 2, the import stopped there after writing team-a/a`, response.Error().Error())
+	assert.Nil(t, sendRequest(t, b, storage, logical.ReadOperation, "team-a/b", nil))
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "quotas/team-a", map[string]interface{}{"max_bytes": used + 400})
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "metadata/team-a/db", map[string]interface{}{
+		"custom_metadata": map[string]interface{}{"owner": strings.Repeat("x", 500)},
+	})
+	assert.True(t, response.IsError())
+	assert.Contains(t, response.Error().Error(), `quota of "team-a/" exceeded`)
+
+	// a bundle import
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	source, sourceStorage := getBackend(t)
+	sendRequest(t, source, sourceStorage, logical.CreateOperation, "team-b/a", map[string]interface{}{"key": "k1"})
+	sendRequest(t, source, sourceStorage, logical.CreateOperation, "team-b/b", map[string]interface{}{"key": "k2"})
+	response = sendRequest(t, source, sourceStorage, logical.UpdateOperation, "export", map[string]interface{}{
+		"recipient": identity.Recipient().String(),
+	})
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "quotas/team-b", map[string]interface{}{"max_secrets": 1})
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "import", map[string]interface{}{
+		"bundle":      response.Data["bundle"].(string),
+		"private_key": identity.String(),
+	})
+	assert.True(t, response.IsError())
+	assert.Contains(t, response.Error().Error(), `quota of "team-b/" exceeded: 2 secrets, the limit is 1, the import stopped there after writing data/team-b/`)
+}
+
+// A write only waits for the writes of the same quotas
+func TestQuotaUsageLocks(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.UpdateOperation, "quotas/team-a", map[string]interface{}{"max_secrets": 10})
+	sendRequest(t, b, storage, logical.UpdateOperation, "quotas/team-b", map[string]interface{}{"max_secrets": 10})
+
+	// hold the usage of team-a as a write of team-a would
+	backend := b.(*scalesecSecretStoreBackend)
+	quotas, err := backend.loadQuotas(context.Background(), storage)
+	assert.Nil(t, err)
+	backend.quotaSetLock.RLock()
+	unlock := backend.lockQuotaUsage(appliedQuotas(quotas, []storageChange{{Key: secretStorageKey("team-a/db")}}))
+
+	write := func(path string) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sendRequest(t, b, storage, logical.CreateOperation, path, map[string]interface{}{"password": "p1"})
+		}()
+		return done
+	}
+	for _, path := range []string{"team-b/db", "other/db"} {
+		select {
+		case <-write(path):
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the write of %s waited for the usage of team-a", path)
+		}
+	}
+
+	blocked := write("team-a/db")
+	select {
+	case <-blocked:
+		t.Fatal("the write of team-a/db did not wait for the usage of team-a")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-blocked
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "quotas/team-a", nil)
+	assert.Equal(t, int64(1), response.Data["secrets"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "quotas/team-b", nil)
+	assert.Equal(t, int64(1), response.Data["secrets"])
+}
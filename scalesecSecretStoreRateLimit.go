@@ -0,0 +1,462 @@
+// ********************************************************************************
+// Rate limits of the requests
+//
+// A rate limit rule gives how many requests per second the paths under a prefix accept,
+// with a token bucket so short bursts are allowed:
+//
+//   vault write scalesecsecrets/rate_limit/db prefix="db/*" rate=10 burst=20
+//   vault write scalesecsecrets/rate_limit/db-per-job prefix="db/*" rate=1 burst=5 per_entity=true
+//
+// rate       : requests per second the bucket is refilled with
+// burst      : how many requests can be made at once (default: rate, at least 1)
+// entity_ids : the rule only applies to these entities (default: every caller)
+// per_entity : each entity has its own bucket instead of one bucket for all the callers
+//
+// A request has to get a token from the bucket of every rule that applies to it.  When one
+// is empty the request is rejected with a 429 (logical.ErrRateLimitQuotaExceeded) and a
+// Retry-After header with the seconds until the bucket has a token again.  The error
+// message has the seconds too.  Vault drops the headers a plugin sets unless the mount
+// allows them, so enable the mount with -allowed-response-headers=Retry-After, as
+// make-scalesec-secret-store-plugin.sh does, or tune an existing mount:
+//
+//   vault secrets tune -allowed-response-headers=Retry-After scalesecsecrets/
+//
+// The limits are enforced by a wrapper around all the handlers, except the rate_limit
+// paths so a rule can always be changed.
+//
+// The buckets are in memory: each node of the cluster limits the requests it serves.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Storage prefix for the rate limit rules
+const rateLimitStoragePrefix = "rate_limit/"
+
+// How many buckets are kept before the full ones are dropped
+const rateLimitMaxBuckets = 10000
+
+// rateLimitEntry is the storage entry for a rate limit rule
+type rateLimitEntry struct {
+	// Name is the storage key of the rule, it is not stored
+	Name string `json:"-"`
+
+	Prefix    string   `json:"prefix"`
+	Rate      float64  `json:"rate"`
+	Burst     int      `json:"burst"`
+	EntityIDs []string `json:"entity_ids,omitempty"`
+	PerEntity bool     `json:"per_entity"`
+}
+
+// tokenBucket has the tokens left of a rule, refilled at the rate of the rule
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimitPaths returns the paths to manage the rate limit rules.
+func (b *scalesecSecretStoreBackend) rateLimitPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.rateLimitPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "rate_limit/?$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.handleRateLimitList,
+					Summary:  "Lists the rate limit rules.",
+				},
+			},
+		},
+		{
+			Pattern: "rate_limit/" + framework.GenericNameRegex("name"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the rule.",
+				},
+				"prefix": {
+					Type:        framework.TypeString,
+					Description: "Path prefix of the requests the rule applies to.  IE: db/ or db/*",
+				},
+				"rate": {
+					Type:        framework.TypeFloat,
+					Description: "Requests per second.",
+				},
+				"burst": {
+					Type:        framework.TypeInt,
+					Description: "How many requests can be made at once.  Defaults to the rate, at least 1.",
+				},
+				"entity_ids": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "IDs of the entities the rule applies to.  Defaults to every caller.",
+				},
+				"per_entity": {
+					Type:        framework.TypeBool,
+					Description: "Give each entity its own bucket instead of one bucket for all the callers.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleRateLimitRead,
+					Summary:  "Read a rate limit rule.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleRateLimitWrite,
+					Summary:  "Write a rate limit rule for a path prefix.",
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.handleRateLimitDelete,
+					Summary:  "Delete a rate limit rule.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.rateLimitPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleRateLimitWrite: Write a rate limit rule for a path prefix
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleRateLimitWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleRateLimitWrite:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRateLimitWrite:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	name := data.Get("name").(string)
+	entry := &rateLimitEntry{
+		Prefix:    strings.TrimSuffix(data.Get("prefix").(string), "*"),
+		Rate:      data.Get("rate").(float64),
+		Burst:     data.Get("burst").(int),
+		EntityIDs: strutil.RemoveDuplicates(data.Get("entity_ids").([]string), false),
+		PerEntity: data.Get("per_entity").(bool),
+	}
+	if entry.Rate <= 0 {
+		return logical.ErrorResponse("rate must be positive"), nil
+	}
+	if entry.Burst < 0 {
+		return logical.ErrorResponse("burst must not be negative"), nil
+	}
+	if entry.Burst == 0 {
+		entry.Burst = int(math.Max(1, math.Ceil(entry.Rate)))
+	}
+
+	storageEntry, err := logical.StorageEntryJSON(rateLimitStoragePrefix+name, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	b.rateLimitLock.Lock()
+	defer b.rateLimitLock.Unlock()
+
+	if err := req.Storage.Put(ctx, storageEntry); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleRateLimitWrite:-> Leaving with error")
+		return nil, fmt.Errorf("storing rate limit rule failed: %w", err)
+	}
+	b.rateLimits = nil
+
+	b.Logger().Debug("scalesecSecretStore.handleRateLimitWrite:-> Leaving")
+	return nil, nil
+}
+
+// ============================================================================================
+// handleRateLimitRead: Read a rate limit rule
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleRateLimitRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleRateLimitRead:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRateLimitRead:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	storageEntry, err := req.Storage.Get(ctx, rateLimitStoragePrefix+data.Get("name").(string))
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleRateLimitRead:-> Leaving with error")
+		return nil, fmt.Errorf("reading rate limit rule failed: %w", err)
+	}
+	if storageEntry == nil {
+		b.Logger().Debug("scalesecSecretStore.handleRateLimitRead:-> Leaving no rule")
+		return nil, nil
+	}
+
+	var entry rateLimitEntry
+	if err := storageEntry.DecodeJSON(&entry); err != nil {
+		return nil, fmt.Errorf("decoding rate limit rule failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleRateLimitRead:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"prefix":     entry.Prefix,
+			"rate":       entry.Rate,
+			"burst":      entry.Burst,
+			"entity_ids": entry.EntityIDs,
+			"per_entity": entry.PerEntity,
+		},
+	}, nil
+}
+
+// ============================================================================================
+// handleRateLimitDelete: Delete a rate limit rule
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleRateLimitDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleRateLimitDelete:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRateLimitDelete:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	b.rateLimitLock.Lock()
+	defer b.rateLimitLock.Unlock()
+
+	if err := req.Storage.Delete(ctx, rateLimitStoragePrefix+data.Get("name").(string)); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleRateLimitDelete:-> Leaving with error")
+		return nil, fmt.Errorf("deleting rate limit rule failed: %w", err)
+	}
+	b.rateLimits = nil
+
+	b.Logger().Debug("scalesecSecretStore.handleRateLimitDelete:-> Leaving")
+	return nil, nil
+}
+
+// ============================================================================================
+// handleRateLimitList: List the rate limit rules
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleRateLimitList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleRateLimitList:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRateLimitList:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	names, err := req.Storage.List(ctx, rateLimitStoragePrefix)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleRateLimitList:-> Leaving with error")
+		return nil, fmt.Errorf("listing rate limit rules failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleRateLimitList:-> Leaving")
+	return logical.ListResponse(names), nil
+}
+
+// loadRateLimits returns the rate limit rules.  They are read once and kept until a rule is
+// written or deleted.
+func (b *scalesecSecretStoreBackend) loadRateLimits(ctx context.Context, s logical.Storage) ([]*rateLimitEntry, error) {
+	b.rateLimitLock.RLock()
+	rules := b.rateLimits
+	b.rateLimitLock.RUnlock()
+	if rules != nil {
+		return rules, nil
+	}
+
+	b.rateLimitLock.Lock()
+	defer b.rateLimitLock.Unlock()
+
+	// another request may have loaded them while we waited for the lock
+	if b.rateLimits != nil {
+		return b.rateLimits, nil
+	}
+
+	names, err := s.List(ctx, rateLimitStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing rate limit rules failed: %w", err)
+	}
+
+	rules = []*rateLimitEntry{}
+	for _, name := range names {
+		storageEntry, err := s.Get(ctx, rateLimitStoragePrefix+name)
+		if err != nil {
+			return nil, err
+		}
+		if storageEntry == nil {
+			continue
+		}
+
+		entry := &rateLimitEntry{Name: name}
+		if err := storageEntry.DecodeJSON(entry); err != nil {
+			return nil, fmt.Errorf("decoding rate limit rule %q failed: %w", name, err)
+		}
+		rules = append(rules, entry)
+	}
+
+	b.rateLimits = rules
+	return rules, nil
+}
+
+// resetRateLimits drops the rules and their buckets so they are read again from storage
+func (b *scalesecSecretStoreBackend) resetRateLimits() {
+	b.rateLimitLock.Lock()
+	b.rateLimits = nil
+	b.rateLimitLock.Unlock()
+
+	b.bucketLock.Lock()
+	b.buckets = nil
+	b.bucketLock.Unlock()
+}
+
+// limitRate returns the paths with their handlers wrapped by the rate limits
+func (b *scalesecSecretStoreBackend) limitRate(paths []*framework.Path) []*framework.Path {
+	for _, path := range paths {
+		for operation, handler := range path.Operations {
+			if pathOperation, ok := handler.(*framework.PathOperation); ok {
+				pathOperation.Callback = b.rateLimited(pathOperation.Callback)
+				path.Operations[operation] = pathOperation
+			}
+		}
+	}
+	return paths
+}
+
+// rateLimited returns the handler rejecting the requests over a rate limit
+func (b *scalesecSecretStoreBackend) rateLimited(handler framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		if strings.HasPrefix(req.Path, rateLimitStoragePrefix) {
+			return handler(ctx, req, data)
+		}
+
+		rule, retryAfter, err := b.takeToken(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if rule == "" {
+			return handler(ctx, req, data)
+		}
+
+		b.metrics.incrCounter("rate_limited", []metrics.Label{{Name: "rule", Value: rule}})
+		seconds := int64(math.Ceil(retryAfter.Seconds()))
+		b.requestLogger(req).Debug("scalesecSecretStore.rateLimited:-> request rejected", "rule", rule, "retry_after", seconds)
+
+		resp := logical.ErrorResponse("rate limit %q exceeded, retry after %ds", rule, seconds)
+		resp.Headers = map[string][]string{"Retry-After": {strconv.FormatInt(seconds, 10)}}
+		return resp, logical.ErrRateLimitQuotaExceeded
+	}
+}
+
+// takeToken takes a token from the bucket of every rule that applies to the request.  When
+// one is empty nothing is taken and the name of its rule is returned with how long until it
+// has a token again.
+func (b *scalesecSecretStoreBackend) takeToken(ctx context.Context, req *logical.Request) (string, time.Duration, error) {
+	rules, err := b.loadRateLimits(ctx, req.Storage)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var applied []*rateLimitEntry
+	var keys []string
+	for _, rule := range rules {
+		if !strings.HasPrefix(req.Path, rule.Prefix) {
+			continue
+		}
+		if len(rule.EntityIDs) > 0 && !strutil.StrListContains(rule.EntityIDs, req.EntityID) {
+			continue
+		}
+		key := rule.Name
+		if rule.PerEntity {
+			key += "/" + req.EntityID
+		}
+		applied = append(applied, rule)
+		keys = append(keys, key)
+	}
+	if len(applied) == 0 {
+		return "", 0, nil
+	}
+
+	now := b.now()
+	b.bucketLock.Lock()
+	defer b.bucketLock.Unlock()
+
+	if b.buckets == nil {
+		b.buckets = map[string]*tokenBucket{}
+	}
+
+	buckets := make([]*tokenBucket, len(applied))
+	for i, rule := range applied {
+		bucket, ok := b.buckets[keys[i]]
+		if !ok {
+			if len(b.buckets) >= rateLimitMaxBuckets {
+				b.dropFullBuckets(rules, now)
+			}
+			bucket = &tokenBucket{tokens: float64(rule.Burst), updated: now}
+			b.buckets[keys[i]] = bucket
+		}
+		bucket.refill(rule, now)
+		buckets[i] = bucket
+	}
+
+	// the request is only counted when every bucket has a token
+	rejected := ""
+	var retryAfter time.Duration
+	for i, bucket := range buckets {
+		if bucket.tokens >= 1 {
+			continue
+		}
+		wait := time.Duration((1 - bucket.tokens) / applied[i].Rate * float64(time.Second))
+		if wait > retryAfter {
+			rejected, retryAfter = applied[i].Name, wait
+		}
+	}
+	if rejected != "" {
+		return rejected, retryAfter, nil
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return "", 0, nil
+}
+
+// refill adds the tokens of the time since the last refill, up to the burst of the rule
+func (bucket *tokenBucket) refill(rule *rateLimitEntry, now time.Time) {
+	if elapsed := now.Sub(bucket.updated); elapsed > 0 {
+		bucket.tokens = math.Min(float64(rule.Burst), bucket.tokens+elapsed.Seconds()*rule.Rate)
+	}
+	bucket.updated = now
+}
+
+// dropFullBuckets drops the buckets that are full: they are the same as a new bucket.  The
+// caller holds the bucket lock.
+func (b *scalesecSecretStoreBackend) dropFullBuckets(rules []*rateLimitEntry, now time.Time) {
+	byName := make(map[string]*rateLimitEntry, len(rules))
+	for _, rule := range rules {
+		byName[rule.Name] = rule
+	}
+	for key, bucket := range b.buckets {
+		rule, ok := byName[strings.SplitN(key, "/", 2)[0]]
+		if !ok {
+			delete(b.buckets, key)
+			continue
+		}
+		bucket.refill(rule, now)
+		if bucket.tokens >= float64(rule.Burst) {
+			delete(b.buckets, key)
+		}
+	}
+}
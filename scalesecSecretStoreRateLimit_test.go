@@ -0,0 +1,114 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// read a secret as the entity and return the response and the error
+func readLimited(b logical.Backend, storage logical.Storage, entityID string, path string) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation:   logical.ReadOperation,
+		Path:        path,
+		MountPoint:  MOUNT_POINT,
+		Storage:     storage,
+		ClientToken: "test_token",
+		EntityID:    entityID,
+	})
+}
+
+// The requests over the rate of a prefix are rejected until the bucket refills
+func TestRateLimit(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.CreateOperation, "other/db", map[string]interface{}{"password": "p2"})
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "rate_limit/app", map[string]interface{}{
+		"prefix": "app/*",
+		"rate":   0.5,
+		"burst":  2,
+	})
+	assert.Nil(t, response, "Response message %v", response)
+
+	for i := 0; i < 2; i++ {
+		response, err := readLimited(b, storage, "", "app/db")
+		assert.Nil(t, err)
+		assert.Equal(t, "p1", response.Data["password"])
+	}
+
+	response, err := readLimited(b, storage, "", "app/db")
+	assert.Equal(t, logical.ErrRateLimitQuotaExceeded, err)
+	assert.True(t, response.IsError())
+	assert.Equal(t, `rate limit "app" exceeded, retry after 2s`, response.Error().Error())
+	assert.Equal(t, []string{"2"}, response.Headers["Retry-After"])
+	assert.Nil(t, response.Data["password"])
+
+	// other prefixes and the rules themselves are not limited
+	response, err = readLimited(b, storage, "", "other/db")
+	assert.Nil(t, err)
+	assert.Equal(t, "p2", response.Data["password"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "rate_limit/app", nil)
+	assert.Equal(t, 2, response.Data["burst"])
+
+	// the bucket refills at the rate
+	now = now.Add(2 * time.Second)
+	response, err = readLimited(b, storage, "", "app/db")
+	assert.Nil(t, err)
+	assert.Equal(t, "p1", response.Data["password"])
+
+	// without the rule the requests are not limited
+	sendRequest(t, b, storage, logical.DeleteOperation, "rate_limit/app", nil)
+	for i := 0; i < 5; i++ {
+		_, err := readLimited(b, storage, "", "app/db")
+		assert.Nil(t, err)
+	}
+}
+
+// With per_entity each entity has its own bucket, and entity_ids restricts the callers
+func TestRateLimitPerEntity(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "rate_limit/per-job", map[string]interface{}{
+		"prefix":     "app/",
+		"rate":       1,
+		"per_entity": true,
+	})
+	sendRequest(t, b, storage, logical.UpdateOperation, "rate_limit/batch", map[string]interface{}{
+		"prefix":     "",
+		"rate":       2,
+		"burst":      1,
+		"entity_ids": "batch-job",
+	})
+
+	_, err := readLimited(b, storage, "job-1", "app/db")
+	assert.Nil(t, err)
+	_, err = readLimited(b, storage, "job-1", "app/db")
+	assert.Equal(t, logical.ErrRateLimitQuotaExceeded, err, "job-1 used its token")
+	_, err = readLimited(b, storage, "job-2", "app/db")
+	assert.Nil(t, err, "job-2 has its own bucket")
+
+	// a rejected request takes no token from the other buckets
+	_, err = readLimited(b, storage, "batch-job", "other/path")
+	assert.Nil(t, err)
+	_, err = readLimited(b, storage, "batch-job", "app/db")
+	assert.Equal(t, logical.ErrRateLimitQuotaExceeded, err)
+	now = now.Add(500 * time.Millisecond)
+	_, err = readLimited(b, storage, "batch-job", "app/db")
+	assert.Nil(t, err, "the per-job bucket still has the token of batch-job")
+
+	// a rule write with an invalid rate is rejected
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "rate_limit/bad", map[string]interface{}{"rate": 0})
+	assert.True(t, response.IsError())
+}
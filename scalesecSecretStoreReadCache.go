@@ -0,0 +1,332 @@
+// ********************************************************************************
+// Read cache of the secrets
+//
+// The stored secrets are kept in memory in an LRU cache so the reads do not go to the
+// storage, which can be slow when vault stores in a remote system.  The cache is set on
+// the config path:
+//
+//   vault write scalesecsecrets/config cache_size=1000 cache_ttl=60s
+//
+// cache_size : how many secrets are kept; 0 turns the cache off
+// cache_ttl  : how long a secret is kept
+//
+// A path without a secret is cached too (negative caching) so repeated reads of a missing
+// secret do not go to the storage either.  Concurrent misses of the same path share one
+// read of the storage.  That read is not tied to the request that started it, so a caller
+// that gives up does not fail the others; it is bounded by cacheLoadTimeout instead.  Every
+// write of a secret drops it from the cache, and on the other nodes vault calls Invalidate
+// with its storage key.
+//
+// The cache keeps the stored JSON, not the decoded secret, so a caller can change the
+// secret it gets without changing the cache.  It only fronts the reads of the secrets from
+// the vault storage; the calls to the upstream providers (the rotation hooks and the
+// generator hook) are never cached.
+//
+//   vault read scalesecsecrets/status/cache
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/sync/singleflight"
+)
+
+// Default settings of the read cache
+const (
+	defaultCacheSize = 1000
+	defaultCacheTTL  = time.Minute
+
+	// cacheLoadTimeout bounds the storage read shared by the misses of a path
+	cacheLoadTimeout = 30 * time.Second
+)
+
+// secretCache is the read cache of the stored secrets by path
+type secretCache struct {
+	entries *lru.Cache
+	size    int
+	ttl     time.Duration
+
+	// loads shares the storage read of concurrent misses of a path
+	loads singleflight.Group
+
+	// loading has the paths being loaded.  Their generation changes on every removal so a
+	// load that started before a write of the path does not put the old value in the cache.
+	// lock makes the check of the generation and the add of the loaded value one step for
+	// remove.
+	lock    sync.Mutex
+	loading map[string]*pathLoad
+
+	// statistics, updated atomically
+	hits          uint64
+	negativeHits  uint64
+	misses        uint64
+	sharedLoads   uint64
+	evictions     uint64
+	invalidations uint64
+}
+
+// pathLoad counts the loads in progress of a path and the removals of the path since
+// the first of them started
+type pathLoad struct {
+	count      int
+	generation uint64
+}
+
+// cachedSecret is a stored secret and when it leaves the cache.  A nil value caches that
+// there is no secret.
+type cachedSecret struct {
+	value   []byte
+	expires time.Time
+}
+
+// newSecretCache returns a cache of size secrets kept for ttl
+func newSecretCache(size int, ttl time.Duration) (*secretCache, error) {
+	entries, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &secretCache{entries: entries, size: size, ttl: ttl, loading: map[string]*pathLoad{}}, nil
+}
+
+// get returns the cached value of path, or reads it with load and caches it.  The caller
+// stops waiting when ctx is done but the load goes on for the other callers.
+func (c *secretCache) get(ctx context.Context, path string, now time.Time, load func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if cached, ok := c.entries.Get(path); ok {
+		entry := cached.(*cachedSecret)
+		if now.Before(entry.expires) {
+			if entry.value == nil {
+				atomic.AddUint64(&c.negativeHits, 1)
+			} else {
+				atomic.AddUint64(&c.hits, 1)
+			}
+			return entry.value, nil
+		}
+		c.entries.Remove(path)
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	results := c.loads.DoChan(path, func() (interface{}, error) {
+		c.lock.Lock()
+		loading, ok := c.loading[path]
+		if !ok {
+			loading = &pathLoad{}
+			c.loading[path] = loading
+		}
+		loading.count++
+		generation := loading.generation
+		c.lock.Unlock()
+
+		loadCtx, cancel := context.WithTimeout(detachedContext{ctx}, cacheLoadTimeout)
+		defer cancel()
+		value, err := load(loadCtx)
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		loading.count--
+		if loading.count == 0 {
+			delete(c.loading, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if loading.generation == generation {
+			if evicted := c.entries.Add(path, &cachedSecret{value: value, expires: now.Add(c.ttl)}); evicted {
+				atomic.AddUint64(&c.evictions, 1)
+			}
+		}
+		return value, nil
+	})
+
+	select {
+	case result := <-results:
+		if result.Shared {
+			atomic.AddUint64(&c.sharedLoads, 1)
+		}
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.([]byte), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// detachedContext keeps the values of a context, like its trace span, without its deadline
+// and cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// remove drops path from the cache and from the loads in progress
+func (c *secretCache) remove(path string) {
+	c.lock.Lock()
+	if loading, ok := c.loading[path]; ok {
+		loading.generation++
+	}
+	c.loads.Forget(path)
+	c.entries.Remove(path)
+	c.lock.Unlock()
+	atomic.AddUint64(&c.invalidations, 1)
+}
+
+// readCachePaths returns the path of the cache statistics.
+func (b *scalesecSecretStoreBackend) readCachePaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.readCachePaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "status/cache$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleCacheStatus,
+					Summary:  "Read the settings and the hit and miss counts of the read cache.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.readCachePaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleCacheStatus: Read the statistics of the read cache
+//
+// GOAL:  	Report how well the cache works so its size and TTL can be tuned
+// Return:
+// 			*logical.Response := the settings, the number of cached secrets and the counts
+// 			error := Error with details if the read failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleCacheStatus(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleCacheStatus:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleCacheStatus:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	cache, err := b.getReadCache(ctx, req.Storage)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleCacheStatus:-> Leaving with error")
+		return nil, err
+	}
+	if cache == nil {
+		b.Logger().Debug("scalesecSecretStore.handleCacheStatus:-> Leaving cache off")
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"enabled": false,
+			},
+		}, nil
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleCacheStatus:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"enabled":       true,
+			"size":          cache.size,
+			"ttl":           int64(cache.ttl.Seconds()),
+			"entries":       cache.entries.Len(),
+			"hits":          atomic.LoadUint64(&cache.hits),
+			"negative_hits": atomic.LoadUint64(&cache.negativeHits),
+			"misses":        atomic.LoadUint64(&cache.misses),
+			"shared_loads":  atomic.LoadUint64(&cache.sharedLoads),
+			"evictions":     atomic.LoadUint64(&cache.evictions),
+			"invalidations": atomic.LoadUint64(&cache.invalidations),
+		},
+	}, nil
+}
+
+// getReadCache returns the read cache with the settings of the config, or nil if it is
+// off.  A cache is created when the settings change.
+func (b *scalesecSecretStoreBackend) getReadCache(ctx context.Context, s logical.Storage) (*secretCache, error) {
+	config, err := b.getConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	b.readCacheLock.RLock()
+	cache := b.readCache
+	b.readCacheLock.RUnlock()
+	if config.CacheSize <= 0 {
+		return nil, nil
+	}
+	if cache != nil && cache.size == config.CacheSize && cache.ttl == config.CacheTTL {
+		return cache, nil
+	}
+
+	b.readCacheLock.Lock()
+	defer b.readCacheLock.Unlock()
+	if b.readCache != nil && b.readCache.size == config.CacheSize && b.readCache.ttl == config.CacheTTL {
+		return b.readCache, nil
+	}
+	cache, err = newSecretCache(config.CacheSize, config.CacheTTL)
+	if err != nil {
+		return nil, fmt.Errorf("creating the read cache failed: %w", err)
+	}
+	b.readCache = cache
+	return cache, nil
+}
+
+// readSecretValue returns the stored JSON of the secret at path from the cache or the
+// storage.  nil if there is no secret.
+func (b *scalesecSecretStoreBackend) readSecretValue(ctx context.Context, s logical.Storage, path string) ([]byte, error) {
+	load := func(ctx context.Context) (value []byte, err error) {
+		ctx, end := b.startProviderCall(ctx, "storage", "get")
+		defer func() { end(err) }()
+
+		entry, err := s.Get(ctx, secretStorageKey(path))
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		return entry.Value, nil
+	}
+
+	cache, err := b.getReadCache(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if cache == nil {
+		return load(ctx)
+	}
+	return cache.get(ctx, strings.TrimSuffix(path, "/"), b.now(), load)
+}
+
+// forgetSecret drops the secret stored at the storage key from the read cache.  Keys that
+// are not secrets are ignored.
+func (b *scalesecSecretStoreBackend) forgetSecret(key string) {
+	if !strings.HasPrefix(key, secretStoragePrefix) {
+		return
+	}
+
+	b.readCacheLock.RLock()
+	cache := b.readCache
+	b.readCacheLock.RUnlock()
+	if cache != nil {
+		cache.remove(strings.TrimPrefix(key, secretStoragePrefix))
+	}
+}
+
+// resetReadCache drops the read cache
+func (b *scalesecSecretStoreBackend) resetReadCache() {
+	b.readCacheLock.Lock()
+	b.readCache = nil
+	b.readCacheLock.Unlock()
+}
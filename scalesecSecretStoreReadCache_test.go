@@ -0,0 +1,271 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// countingStorage counts the reads of the secrets and can hold them until release is closed
+type countingStorage struct {
+	logical.Storage
+	secretReads int64
+	release     chan struct{}
+}
+
+func (s *countingStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	if key == "data/app/db" {
+		atomic.AddInt64(&s.secretReads, 1)
+		if s.release != nil {
+			<-s.release
+		}
+	}
+	return s.Storage.Get(ctx, key)
+}
+
+// read the statistics of the read cache
+func cacheStatus(t *testing.T, b logical.Backend, storage logical.Storage) map[string]interface{} {
+	return sendRequest(t, b, storage, logical.ReadOperation, "status/cache", nil).Data
+}
+
+// Reads are served from the cache until the TTL passes and a write drops the secret
+func TestReadCache(t *testing.T) {
+
+	b, inmem := getBackend(t)
+	storage := &countingStorage{Storage: inmem}
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	reads := atomic.LoadInt64(&storage.secretReads)
+
+	for i := 0; i < 3; i++ {
+		response := sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+		assert.Equal(t, "p1", response.Data["password"])
+	}
+	assert.Equal(t, reads+1, atomic.LoadInt64(&storage.secretReads), "only the first read goes to the storage")
+
+	// a write drops the secret so the next read sees it
+	sendRequest(t, b, storage, logical.UpdateOperation, "app/db", map[string]interface{}{"password": "p2"})
+	response := sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p2", response.Data["password"])
+
+	// after the TTL the secret is read again
+	reads = atomic.LoadInt64(&storage.secretReads)
+	now = now.Add(2 * time.Minute)
+	sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, reads+1, atomic.LoadInt64(&storage.secretReads))
+
+	// a delete drops it too
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/db", nil)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Nil(t, response)
+
+	status := cacheStatus(t, b, storage)
+	assert.Equal(t, true, status["enabled"])
+	assert.Equal(t, 1000, status["size"])
+	assert.True(t, status["hits"].(uint64) >= 2)
+	assert.True(t, status["invalidations"].(uint64) >= 2)
+}
+
+// A missing secret is cached too until it is written
+func TestReadCacheNegative(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "app/missing", nil)
+	assert.Nil(t, response)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/missing", nil)
+	assert.Nil(t, response)
+	assert.Equal(t, uint64(1), cacheStatus(t, b, storage)["negative_hits"])
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/missing", map[string]interface{}{"key": "k1"})
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/missing", nil)
+	assert.Equal(t, "k1", response.Data["key"])
+}
+
+// Concurrent misses of a path share one read of the storage
+func TestReadCacheSingleflight(t *testing.T) {
+
+	b, inmem := getBackend(t)
+	sendRequest(t, b, inmem, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	b.(*scalesecSecretStoreBackend).resetReadCache()
+
+	storage := &countingStorage{Storage: inmem, release: make(chan struct{})}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation:   logical.ReadOperation,
+				Path:        "app/db",
+				Storage:     storage,
+				ClientToken: "root",
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, "p1", response.Data["password"])
+		}()
+	}
+
+	// let the readers pile up on the held read
+	for atomic.LoadInt64(&storage.secretReads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(storage.release)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&storage.secretReads))
+}
+
+// Another node wrote the secret: the invalidation drops it from the cache
+func TestReadCacheInvalidate(t *testing.T) {
+
+	active, storage := getBackend(t)
+	standby := getStandbyBackend(t)
+
+	sendRequest(t, active, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	response := sendRequest(t, standby, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p1", response.Data["password"])
+
+	sendRequest(t, active, storage, logical.UpdateOperation, "app/db", map[string]interface{}{"password": "p2"})
+	response = sendRequest(t, standby, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p1", response.Data["password"], "the standby serves its cache until it is invalidated")
+
+	standby.InvalidateKey(context.Background(), "data/app/db")
+	response = sendRequest(t, standby, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "p2", response.Data["password"])
+}
+
+// The least recently used secrets leave a full cache and cache_size=0 turns it off
+func TestReadCacheSize(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"cache_size": 2})
+
+	for _, path := range []string{"app/a", "app/b", "app/c"} {
+		sendRequest(t, b, storage, logical.CreateOperation, path, map[string]interface{}{"key": "k1"})
+		sendRequest(t, b, storage, logical.ReadOperation, path, nil)
+	}
+	status := cacheStatus(t, b, storage)
+	assert.Equal(t, 2, status["entries"])
+	assert.True(t, status["evictions"].(uint64) >= 1)
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"cache_size": 0})
+	status = cacheStatus(t, b, storage)
+	assert.Equal(t, false, status["enabled"])
+	response := sendRequest(t, b, storage, logical.ReadOperation, "app/a", nil)
+	assert.Equal(t, "k1", response.Data["key"])
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"cache_size": -1})
+	assert.True(t, response.IsError())
+}
+
+// A removal during a load keeps the loaded value out of the cache
+func TestReadCacheRemoveDuringLoad(t *testing.T) {
+
+	cache, err := newSecretCache(10, time.Minute)
+	assert.Nil(t, err)
+	now := time.Now()
+
+	loading := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		value, err := cache.get(context.Background(), "app/db", now, func(ctx context.Context) ([]byte, error) {
+			close(loading)
+			<-release
+			return []byte("old"), nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("old"), value)
+	}()
+
+	<-loading
+	cache.remove("app/db")
+	close(release)
+	<-done
+
+	_, ok := cache.entries.Get("app/db")
+	assert.False(t, ok, "the value loaded before the removal is not cached")
+}
+
+// The removal of another path does not drop the value being loaded
+func TestReadCacheRemoveOtherDuringLoad(t *testing.T) {
+
+	cache, err := newSecretCache(10, time.Minute)
+	assert.Nil(t, err)
+	now := time.Now()
+
+	loading := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := cache.get(context.Background(), "app/db", now, func(ctx context.Context) ([]byte, error) {
+			close(loading)
+			<-release
+			return []byte("p1"), nil
+		})
+		assert.Nil(t, err)
+	}()
+
+	<-loading
+	cache.remove("app/api")
+	close(release)
+	<-done
+
+	_, ok := cache.entries.Get("app/db")
+	assert.True(t, ok, "the value is cached")
+	assert.Empty(t, cache.loading)
+}
+
+// A caller that gives up does not cancel the load shared with the other callers
+func TestReadCacheLoadDetached(t *testing.T) {
+
+	cache, err := newSecretCache(10, time.Minute)
+	assert.Nil(t, err)
+	now := time.Now()
+
+	release := make(chan struct{})
+	load := func(ctx context.Context) ([]byte, error) {
+		select {
+		case <-release:
+			return []byte("p1"), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := cache.get(ctx, "app/db", now, load)
+		first <- err
+	}()
+	second := make(chan []byte)
+	go func() {
+		value, err := cache.get(context.Background(), "app/db", now, load)
+		assert.Nil(t, err)
+		second <- value
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-first)
+	close(release)
+	assert.Equal(t, []byte("p1"), <-second)
+
+	value, err := cache.get(context.Background(), "app/db", now, load)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("p1"), value)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&cache.hits))
+}
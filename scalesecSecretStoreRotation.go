@@ -0,0 +1,701 @@
+// ********************************************************************************
+// Automatic rotation of stored secrets
+//
+// A secret is marked for rotation by writing the rotation settings to rotation/<path>:
+//
+//   vault write scalesecsecrets/rotation/app/db key=password rotation_period=720h \
+//     generator=password_policy password_policy=app-policy grace_period=1h
+//
+// The periodic function of the backend rotates the secrets that are due: a new value for
+// the key is generated and stored as a new version of the secret.  The value before the
+// rotation stays readable with previous=true for the grace period.
+//
+// Generators:
+//   password_policy : vault password policy named by password_policy
+//   random_bytes    : bytes random bytes, base64 encoded
+//   hook            : GET generator_url returning {"value": "<new value>"}
+//
+// Reading rotation/<path> returns the settings, the last rotation and the last error.
+//
+// A failed rotation is retried with a backoff that doubles with each failure in a row, from
+// 1m up to 6h but never longer than the rotation period, so a consumer that is down is not
+// called every minute.
+//
+// The rotation entries hold the connection URL of the sql hook, with its credentials.  They
+// are seal wrapped (PathsSpecial.SealWrapStorage) like the WAL entries that copy them.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Storage prefix for the rotation settings and state
+const rotationStoragePrefix = "rotation/"
+
+// The generators of new secret values
+const (
+	generatorPasswordPolicy = "password_policy"
+	generatorRandomBytes    = "random_bytes"
+	generatorHook           = "hook"
+)
+
+// The backoff of the retries of a failed rotation
+const (
+	rotationRetryMinBackoff = time.Minute
+	rotationRetryMaxBackoff = 6 * time.Hour
+)
+
+// rotationEntry is the storage entry for the rotation of a secret
+type rotationEntry struct {
+	Key            string        `json:"key"`
+	Period         time.Duration `json:"period"`
+	GracePeriod    time.Duration `json:"grace_period"`
+	Generator      string        `json:"generator"`
+	PasswordPolicy string        `json:"password_policy,omitempty"`
+	Bytes          int           `json:"bytes,omitempty"`
+	GeneratorURL   string        `json:"generator_url,omitempty"`
+
+	// Hook pushes the rotated secret to the system that consumes it.  nil for no hook.
+	Hook *rotationHookConfig `json:"hook,omitempty"`
+
+	LastRotated   time.Time `json:"last_rotated"`
+	NextRotation  time.Time `json:"next_rotation"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time"`
+
+	// Failures counts the failed rotations since the last one that worked
+	Failures int `json:"failures,omitempty"`
+}
+
+// retryBackoff returns how long to wait before the rotation is retried after its last failure
+func (rotation *rotationEntry) retryBackoff() time.Duration {
+	backoff := rotationRetryMinBackoff
+	for i := 1; i < rotation.Failures && backoff < rotationRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > rotationRetryMaxBackoff {
+		backoff = rotationRetryMaxBackoff
+	}
+	if rotation.Period > 0 && backoff > rotation.Period {
+		backoff = rotation.Period
+	}
+	return backoff
+}
+
+// rotationPaths returns the paths to manage the rotation of secrets.
+func (b *scalesecSecretStoreBackend) rotationPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.rotationPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "rotation/" + framework.MatchAllRegex("path"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Specifies the path of the secret to rotate.",
+				},
+				"key": {
+					Type:        framework.TypeString,
+					Default:     "password",
+					Description: "Key of the secret that is rotated.",
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Time between rotations.",
+				},
+				"grace_period": {
+					Type:        framework.TypeDurationSecond,
+					Default:     3600,
+					Description: "Time the value before a rotation stays readable with previous=true.",
+				},
+				"generator": {
+					Type:        framework.TypeString,
+					Default:     generatorRandomBytes,
+					Description: "Generator of the new value: password_policy, random_bytes or hook.",
+				},
+				"password_policy": {
+					Type:        framework.TypeString,
+					Description: "Name of the vault password policy for the password_policy generator.",
+				},
+				"bytes": {
+					Type:        framework.TypeInt,
+					Default:     32,
+					Description: "Number of random bytes for the random_bytes generator.",
+				},
+				"generator_url": {
+					Type:        framework.TypeString,
+					Description: "URL the hook generator gets the new value from.",
+				},
+				"hook_type": {
+					Type:        framework.TypeString,
+					Description: "Type of the hook that pushes the rotated secret to its consumer: http, sql, file or none.",
+				},
+				"hook_url": {
+					Type:        framework.TypeString,
+					Description: "URL the http hook posts the rotated secret to.",
+				},
+				"hook_verify_url": {
+					Type:        framework.TypeString,
+					Description: "URL the http hook posts the rotated secret to to verify it was accepted.",
+				},
+				"hook_driver": {
+					Type:        framework.TypeString,
+					Description: "database/sql driver of the sql hook.  IE: postgres, mysql",
+				},
+				"hook_connection_url": {
+					Type:        framework.TypeString,
+					Description: "Connection string of the sql hook.",
+				},
+				"hook_statement": {
+					Type:        framework.TypeString,
+					Description: "Statement the sql hook runs to set the rotated secret.  {{key}} is replaced by the value of key.",
+				},
+				"hook_verify_statement": {
+					Type:        framework.TypeString,
+					Description: "Statement the sql hook runs to verify the rotated secret.  It must return a row.",
+				},
+				"hook_file_path": {
+					Type:        framework.TypeString,
+					Description: "File the file hook writes the rotated secret to, relative to the hook_file_dir option of the mount.",
+				},
+				"rotate_now": {
+					Type:        framework.TypeBool,
+					Description: "Rotate the secret now instead of waiting for the rotation period.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleRotationRead,
+					Summary:  "Read the rotation settings and state of a secret.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleRotationWrite,
+					Summary:  "Set the rotation of a secret.",
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.handleRotationDelete,
+					Summary:  "Stop rotating a secret.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.rotationPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// rotationStorageKey returns the storage key for the rotation of the secret at path
+func rotationStorageKey(path string) string {
+	return rotationStoragePrefix + strings.Trim(path, "/")
+}
+
+// getRotation reads the rotation of the secret at path.  Returns nil if it is not rotated.
+func (b *scalesecSecretStoreBackend) getRotation(ctx context.Context, s logical.Storage, path string) (*rotationEntry, error) {
+	entry, err := s.Get(ctx, rotationStorageKey(path))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var rotation rotationEntry
+	if err := entry.DecodeJSON(&rotation); err != nil {
+		return nil, fmt.Errorf("decoding rotation %q failed: %w", path, err)
+	}
+	return &rotation, nil
+}
+
+// putRotation writes the rotation of the secret at path
+func (b *scalesecSecretStoreBackend) putRotation(ctx context.Context, s logical.Storage, path string, rotation *rotationEntry) error {
+	entry, err := logical.StorageEntryJSON(rotationStorageKey(path), rotation)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// ============================================================================================
+// handleRotationWrite: Set the rotation of a secret
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleRotationWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleRotationWrite:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRotationWrite:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	path := data.Get("path").(string)
+
+	// a periodic rotation writes the same entry, so it is read and written under the lock
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	rotation, err := b.getRotation(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// A new rotation starts with the defaults.  Only the fields that are passed change the
+	// settings of an existing rotation.
+	if rotation == nil {
+		rotation = &rotationEntry{
+			Key:         data.Get("key").(string),
+			GracePeriod: time.Duration(data.Get("grace_period").(int)) * time.Second,
+			Generator:   data.Get("generator").(string),
+			Bytes:       data.Get("bytes").(int),
+		}
+	}
+	if value, ok := data.GetOk("key"); ok {
+		rotation.Key = value.(string)
+	}
+	if value, ok := data.GetOk("rotation_period"); ok {
+		rotation.Period = time.Duration(value.(int)) * time.Second
+	}
+	if value, ok := data.GetOk("grace_period"); ok {
+		rotation.GracePeriod = time.Duration(value.(int)) * time.Second
+	}
+	if value, ok := data.GetOk("generator"); ok {
+		rotation.Generator = value.(string)
+	}
+	if value, ok := data.GetOk("password_policy"); ok {
+		rotation.PasswordPolicy = value.(string)
+	}
+	if value, ok := data.GetOk("bytes"); ok {
+		rotation.Bytes = value.(int)
+	}
+	if value, ok := data.GetOk("generator_url"); ok {
+		rotation.GeneratorURL = value.(string)
+	}
+
+	if value, ok := data.GetOk("hook_type"); ok {
+		switch value.(string) {
+		case "", "none":
+			rotation.Hook = nil
+		default:
+			rotation.Hook = &rotationHookConfig{Type: value.(string)}
+		}
+	}
+	if rotation.Hook != nil {
+		if value, ok := data.GetOk("hook_url"); ok {
+			rotation.Hook.URL = value.(string)
+		}
+		if value, ok := data.GetOk("hook_verify_url"); ok {
+			rotation.Hook.VerifyURL = value.(string)
+		}
+		if value, ok := data.GetOk("hook_driver"); ok {
+			rotation.Hook.Driver = value.(string)
+		}
+		if value, ok := data.GetOk("hook_connection_url"); ok {
+			rotation.Hook.ConnectionURL = value.(string)
+		}
+		if value, ok := data.GetOk("hook_statement"); ok {
+			rotation.Hook.Statement = value.(string)
+		}
+		if value, ok := data.GetOk("hook_verify_statement"); ok {
+			rotation.Hook.VerifyStatement = value.(string)
+		}
+		if value, ok := data.GetOk("hook_file_path"); ok {
+			rotation.Hook.FilePath = value.(string)
+		}
+		if err := rotation.Hook.validate(b.hookFileDir); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	if rotation.Key == "" {
+		return logical.ErrorResponse("key must be provided"), nil
+	}
+	if rotation.Period <= 0 {
+		return logical.ErrorResponse("rotation_period must be greater than 0"), nil
+	}
+	switch rotation.Generator {
+	case generatorPasswordPolicy:
+		if rotation.PasswordPolicy == "" {
+			return logical.ErrorResponse("password_policy is required for the password_policy generator"), nil
+		}
+	case generatorRandomBytes:
+		if rotation.Bytes <= 0 {
+			return logical.ErrorResponse("bytes must be greater than 0"), nil
+		}
+	case generatorHook:
+		if rotation.GeneratorURL == "" {
+			return logical.ErrorResponse("generator_url is required for the hook generator"), nil
+		}
+	default:
+		return logical.ErrorResponse("generator must be password_policy, random_bytes or hook"), nil
+	}
+
+	config, err := b.getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.checkRotationUpstreams(rotation); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	// The first rotation happens a full period after the secret is marked for rotation
+	now := b.now()
+	if rotation.LastRotated.IsZero() {
+		rotation.NextRotation = now.Add(rotation.Period)
+	} else {
+		rotation.NextRotation = rotation.LastRotated.Add(rotation.Period)
+	}
+	if data.Get("rotate_now").(bool) {
+		rotation.NextRotation = now
+	}
+
+	if err := b.putRotation(ctx, req.Storage, path, rotation); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleRotationWrite:-> Leaving with error")
+		return nil, fmt.Errorf("storing rotation failed: %w", err)
+	}
+
+	if data.Get("rotate_now").(bool) {
+		if err := b.rotateSecretLocked(ctx, req.Storage, path); err != nil {
+			b.Logger().Debug("scalesecSecretStore.handleRotationWrite:-> Leaving with rotation error")
+			return logical.ErrorResponse("rotation failed: %s", err), nil
+		}
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleRotationWrite:-> Leaving")
+	return nil, nil
+}
+
+// ============================================================================================
+// handleRotationRead: Read the rotation settings and state of a secret
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleRotationRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleRotationRead:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRotationRead:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	rotation, err := b.getRotation(ctx, req.Storage, data.Get("path").(string))
+	if err != nil {
+		return nil, err
+	}
+	if rotation == nil {
+		b.Logger().Debug("scalesecSecretStore.handleRotationRead:-> Leaving rotation not found")
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"key":             rotation.Key,
+			"rotation_period": int64(rotation.Period.Seconds()),
+			"grace_period":    int64(rotation.GracePeriod.Seconds()),
+			"generator":       rotation.Generator,
+			"next_rotation":   rotation.NextRotation.Format(time.RFC3339),
+			"last_error":      rotation.LastError,
+			"failures":        rotation.Failures,
+		},
+	}
+	switch rotation.Generator {
+	case generatorPasswordPolicy:
+		resp.Data["password_policy"] = rotation.PasswordPolicy
+	case generatorRandomBytes:
+		resp.Data["bytes"] = rotation.Bytes
+	case generatorHook:
+		resp.Data["generator_url"] = rotation.GeneratorURL
+	}
+	// The connection url of the sql hook has credentials so it is not returned
+	if rotation.Hook != nil {
+		resp.Data["hook_type"] = rotation.Hook.Type
+		switch rotation.Hook.Type {
+		case hookTypeHTTP:
+			resp.Data["hook_url"] = rotation.Hook.URL
+			resp.Data["hook_verify_url"] = rotation.Hook.VerifyURL
+		case hookTypeSQL:
+			resp.Data["hook_driver"] = rotation.Hook.Driver
+			resp.Data["hook_statement"] = rotation.Hook.Statement
+			resp.Data["hook_verify_statement"] = rotation.Hook.VerifyStatement
+		case hookTypeFile:
+			resp.Data["hook_file_path"] = rotation.Hook.FilePath
+		}
+	}
+	if !rotation.LastRotated.IsZero() {
+		resp.Data["last_rotated"] = rotation.LastRotated.Format(time.RFC3339)
+	}
+	if !rotation.LastErrorTime.IsZero() {
+		resp.Data["last_error_time"] = rotation.LastErrorTime.Format(time.RFC3339)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleRotationRead:-> Leaving")
+	return resp, nil
+}
+
+// ============================================================================================
+// handleRotationDelete: Stop rotating a secret.  The secret itself is not changed.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleRotationDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleRotationDelete:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleRotationDelete:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	path := data.Get("path").(string)
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := req.Storage.Delete(ctx, rotationStorageKey(path)); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleRotationDelete:-> Leaving with error")
+		return nil, fmt.Errorf("deleting rotation failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleRotationDelete:-> Leaving")
+	return nil, nil
+}
+
+// rotateDueSecrets rotates every secret whose next rotation has passed.  A failed rotation
+// is recorded on the rotation and retried after a backoff; it does not stop the others.
+func (b *scalesecSecretStoreBackend) rotateDueSecrets(ctx context.Context, s logical.Storage) error {
+	paths, err := logical.CollectKeysWithPrefix(ctx, logical.NewStorageView(s, rotationStoragePrefix), "")
+	if err != nil {
+		return fmt.Errorf("listing rotations failed: %w", err)
+	}
+
+	now := b.now()
+	for _, path := range paths {
+		rotation, err := b.getRotation(ctx, s, path)
+		if err != nil {
+			return err
+		}
+		if rotation == nil || now.Before(rotation.NextRotation) {
+			continue
+		}
+
+		// a deleted secret is not rotated until it is undeleted
+		secret, err := b.getSecretIncludingDeleted(ctx, s, path)
+		if err != nil {
+			return err
+		}
+		if secret != nil && secret.DeletedTime != nil {
+			continue
+		}
+
+		if err := b.rotateSecret(ctx, s, path); err != nil {
+			b.Logger().Warn("scalesecSecretStore.rotateDueSecrets:-> rotation failed", "path", path, "error", err)
+		}
+	}
+	return nil
+}
+
+// rotateSecret generates a new value for the rotated key of the secret at path and stores
+// it as a new version.  The rotation state is updated with the result.
+func (b *scalesecSecretStoreBackend) rotateSecret(ctx context.Context, s logical.Storage, path string) error {
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return b.rotateSecretLocked(ctx, s, path)
+}
+
+// rotateSecretLocked rotates the secret at path and records the result on its rotation.
+// The caller holds the lock of the secret.
+func (b *scalesecSecretStoreBackend) rotateSecretLocked(ctx context.Context, s logical.Storage, path string) error {
+	rotation, err := b.getRotation(ctx, s, path)
+	if err != nil {
+		return err
+	}
+	if rotation == nil {
+		return fmt.Errorf("secret %q is not rotated", path)
+	}
+
+	rotateErr := b.rotate(ctx, s, path, rotation)
+
+	now := b.now()
+	if rotateErr != nil {
+		rotation.LastError = rotateErr.Error()
+		rotation.LastErrorTime = now
+		rotation.Failures++
+		rotation.NextRotation = now.Add(rotation.retryBackoff())
+	} else {
+		rotation.LastError = ""
+		rotation.Failures = 0
+		rotation.LastRotated = now
+		rotation.NextRotation = now.Add(rotation.Period)
+	}
+
+	if err := b.putRotation(ctx, s, path, rotation); err != nil {
+		return fmt.Errorf("storing rotation state failed: %w", err)
+	}
+	return rotateErr
+}
+
+// rotate does the rotation.  The caller holds the lock of the secret.
+func (b *scalesecSecretStoreBackend) rotate(ctx context.Context, s logical.Storage, path string, rotation *rotationEntry) error {
+	secret, err := b.getSecretIncludingDeleted(ctx, s, path)
+	if err != nil {
+		return err
+	}
+	if secret != nil && secret.DeletedTime != nil {
+		return fmt.Errorf("secret %q is deleted", path)
+	}
+
+	// upstream_hosts may have changed since the rotation was written
+	config, err := b.getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	if err := config.checkRotationUpstreams(rotation); err != nil {
+		return err
+	}
+
+	value, err := b.generateValue(ctx, rotation)
+	if err != nil {
+		return fmt.Errorf("generating value failed: %w", err)
+	}
+
+	secretData := map[string]interface{}{}
+	if secret != nil {
+		for key, existing := range secret.Data {
+			secretData[key] = existing
+		}
+	}
+	secretData[rotation.Key] = value
+
+	if resp, err := b.validateSecret(ctx, s, path, secretData); err != nil {
+		return err
+	} else if resp != nil {
+		return fmt.Errorf("%s", resp.Data["error"])
+	}
+
+	now := b.now()
+	next := secret.nextVersion(secretData, now)
+	var previousData map[string]interface{}
+	if secret != nil {
+		previousData = secret.Data
+		next.Previous = &previousSecret{
+			Data:          secret.Data,
+			Version:       secret.Version,
+			ReadableUntil: now.Add(rotation.GracePeriod),
+		}
+	}
+
+	if rotation.Hook == nil {
+		return b.putSecret(ctx, s, path, next)
+	}
+
+	hook, err := b.newRotationHook(rotation.Hook)
+	if err != nil {
+		return err
+	}
+	defer hook.Close()
+
+	// The WAL entry lets vault push the previous data back if we die before the commit
+	walID, err := framework.PutWAL(ctx, s, walKindRotation, &rotationWAL{
+		Path:        path,
+		Hook:        rotation.Hook,
+		Previous:    previousData,
+		NextVersion: next.Version,
+	})
+	if err != nil {
+		return fmt.Errorf("writing rotation WAL failed: %w", err)
+	}
+
+	// set and verify
+	if err, rollbackErr := pushRotation(ctx, hook, path, previousData, secretData); err != nil {
+		if rollbackErr != nil {
+			// leave the WAL entry so vault retries the rollback
+			return fmt.Errorf("%s; rollback failed: %w", err, rollbackErr)
+		}
+		if walErr := framework.DeleteWAL(ctx, s, walID); walErr != nil {
+			b.Logger().Warn("scalesecSecretStore.rotateSecretLocked:-> deleting WAL failed", "error", walErr)
+		}
+		return err
+	}
+
+	// commit
+	if err := b.putSecret(ctx, s, path, next); err != nil {
+		if rollbackErr := rollbackRotation(ctx, hook, path, previousData); rollbackErr != nil {
+			return fmt.Errorf("storing rotated secret failed: %s; rollback failed: %w", err, rollbackErr)
+		}
+		if walErr := framework.DeleteWAL(ctx, s, walID); walErr != nil {
+			b.Logger().Warn("scalesecSecretStore.rotateSecretLocked:-> deleting WAL failed", "error", walErr)
+		}
+		return fmt.Errorf("storing rotated secret failed: %w", err)
+	}
+
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		b.Logger().Warn("scalesecSecretStore.rotateSecretLocked:-> deleting WAL failed", "error", err)
+	}
+	return nil
+}
+
+// generateValue returns a new value from the generator of the rotation
+func (b *scalesecSecretStoreBackend) generateValue(ctx context.Context, rotation *rotationEntry) (string, error) {
+	switch rotation.Generator {
+	case generatorPasswordPolicy:
+		return b.System().GeneratePasswordFromPolicy(ctx, rotation.PasswordPolicy)
+
+	case generatorRandomBytes:
+		buf := make([]byte, rotation.Bytes)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(buf), nil
+
+	case generatorHook:
+		return b.callGeneratorHook(ctx, rotation)
+	}
+
+	return "", fmt.Errorf("unknown generator %q", rotation.Generator)
+}
+
+// callGeneratorHook gets a value from the generator hook of the rotation
+func (b *scalesecSecretStoreBackend) callGeneratorHook(ctx context.Context, rotation *rotationEntry) (value string, err error) {
+	ctx, end := b.startProviderCall(ctx, "generator_hook", "get")
+	defer func() { end(err) }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rotation.GeneratorURL, nil)
+	if err != nil {
+		return "", err
+	}
+	injectTraceContext(ctx, req)
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("generator hook returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding generator hook response failed: %w", err)
+	}
+	if body.Value == "" {
+		return "", fmt.Errorf("generator hook returned an empty value")
+	}
+	return body.Value, nil
+}
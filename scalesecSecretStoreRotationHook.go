@@ -0,0 +1,547 @@
+// ********************************************************************************
+// Rotation hooks: push a rotated secret to the system that consumes it
+//
+// A rotation can have a hook that updates the consumer of the secret when it rotates.
+// The rotation is done in two phases so the secret in vault and the consumer stay in step:
+//
+//   1. set    : the hook pushes the new value to the consumer
+//   2. verify : the hook checks the consumer accepts the new value
+//   3. commit : the new value is stored in vault
+//
+// A WAL entry with the previous value is written before the push.  If the push, the verify
+// or the commit fails the hook pushes the previous value back and the WAL entry is removed.
+// If the plugin dies in the middle vault rolls the push back from the WAL entry (see
+// scalesecSecretStoreWAL.go).
+//
+// Hook types (hook_type on rotation/<path>):
+//   http : POST {"path": ..., "data": {...}} to hook_url.  hook_verify_url gets the same body.
+//   sql  : run hook_statement IE: UPDATE credentials SET password = {{password}} WHERE name = {{username}}
+//          on hook_driver/hook_connection_url.  hook_verify_statement must return a row.
+//   file : write the secret as JSON to hook_file_path and read it back to verify.  The path is
+//          relative to the directory the mount is enabled with, -options=hook_file_dir=<dir>.
+//          Without that option file hooks are refused.
+//
+// The {{key}} placeholders of the SQL statements are replaced with the keys of the secret.
+// A value is passed to the driver as a bind parameter ($n for postgres, ? for the others) so
+// it can never change the statement:
+//   '{{key}}' or {{key}} : a value, the quotes are dropped
+//   "{{key}}"            : an identifier (a value for mysql)
+//   `{{key}}`            : an identifier for mysql
+// The database must take a bind parameter where a value goes.  Postgres does not in ALTER
+// ROLE, call a function that sets the password instead.
+// The SQL drivers are linked in by plugin/main.go.
+//
+// The generator and the hooks only call the hosts in upstream_hosts of the config (see
+// scalesecSecretStoreConfig.go).  It is checked when the rotation is written and again before
+// each call.  The connection URL of the sql hook must be a postgres:// URL for postgres so its
+// host can be read; the other drivers are refused.  Redirects are not followed.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/lib/pq"
+)
+
+// The types of rotation hooks
+const (
+	hookTypeHTTP = "http"
+	hookTypeSQL  = "sql"
+	hookTypeFile = "file"
+)
+
+// rotationHookConfig is the configuration of the hook of a rotation.  It is stored with the rotation.
+type rotationHookConfig struct {
+	Type string `json:"type"`
+
+	// http
+	URL       string `json:"url,omitempty"`
+	VerifyURL string `json:"verify_url,omitempty"`
+
+	// sql
+	Driver          string `json:"driver,omitempty"`
+	ConnectionURL   string `json:"connection_url,omitempty"`
+	Statement       string `json:"statement,omitempty"`
+	VerifyStatement string `json:"verify_statement,omitempty"`
+
+	// file
+	FilePath string `json:"file_path,omitempty"`
+}
+
+// validate checks the settings needed by the hook type are there.  fileDir is the directory
+// of the file hooks.
+func (c *rotationHookConfig) validate(fileDir string) error {
+	switch c.Type {
+	case hookTypeHTTP:
+		if c.URL == "" {
+			return fmt.Errorf("hook_url is required for the http hook")
+		}
+	case hookTypeSQL:
+		if c.Driver == "" || c.ConnectionURL == "" || c.Statement == "" {
+			return fmt.Errorf("hook_driver, hook_connection_url and hook_statement are required for the sql hook")
+		}
+	case hookTypeFile:
+		if c.FilePath == "" {
+			return fmt.Errorf("hook_file_path is required for the file hook")
+		}
+		if _, err := hookFilePath(fileDir, c.FilePath); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("hook_type must be http, sql or file")
+	}
+	return nil
+}
+
+// Kind of the WAL entry written before a rotation is pushed to a hook
+const walKindRotation = "rotation"
+
+// rotationWAL is the WAL entry written before a rotation is pushed to a hook.  It has what is
+// needed to push the previous data back to the consumer.
+type rotationWAL struct {
+	Path     string                 `json:"path"`
+	Hook     *rotationHookConfig    `json:"hook"`
+	Previous map[string]interface{} `json:"previous"`
+
+	// NextVersion is the version of the rotated secret.  Once it is stored the rotation is
+	// committed and there is nothing to roll back.
+	NextVersion int `json:"next_version"`
+}
+
+// rotationHook updates the consumer of a secret with its rotated value
+type rotationHook interface {
+	// Push sets the secret data on the consumer
+	Push(ctx context.Context, path string, data map[string]interface{}) error
+	// Verify checks the consumer accepts the secret data that was pushed
+	Verify(ctx context.Context, path string, data map[string]interface{}) error
+	// Close releases what the hook holds IE: the database connections
+	Close() error
+}
+
+// newRotationHook returns the hook for the configuration.  Its calls are measured (see
+// scalesecSecretStoreMetrics.go).
+func (b *scalesecSecretStoreBackend) newRotationHook(config *rotationHookConfig) (rotationHook, error) {
+	var hook rotationHook
+	switch config.Type {
+	case hookTypeHTTP:
+		hook = &httpRotationHook{client: b.httpClient, url: config.URL, verifyURL: config.VerifyURL}
+	case hookTypeSQL:
+		// the database is opened once for the push, the verify and the rollback
+		db, err := sql.Open(config.Driver, config.ConnectionURL)
+		if err != nil {
+			return nil, err
+		}
+		hook = &sqlRotationHook{db: db, driver: config.Driver, statement: config.Statement, verifyStatement: config.VerifyStatement}
+	case hookTypeFile:
+		path, err := hookFilePath(b.hookFileDir, config.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		hook = &fileRotationHook{path: path}
+	default:
+		return nil, fmt.Errorf("unknown hook type %q", config.Type)
+	}
+	return &measuredRotationHook{b: b, hook: hook, provider: "hook_" + config.Type}, nil
+}
+
+// pushRotation does the set and verify phases with the new data.  If either fails the
+// previous data is pushed back to the consumer; rollbackErr is set if that failed too.
+func pushRotation(ctx context.Context, hook rotationHook, path string, previous map[string]interface{}, next map[string]interface{}) (pushErr error, rollbackErr error) {
+	if err := hook.Push(ctx, path, next); err != nil {
+		pushErr = fmt.Errorf("pushing rotated secret failed: %w", err)
+	} else if err := hook.Verify(ctx, path, next); err != nil {
+		pushErr = fmt.Errorf("verifying rotated secret failed: %w", err)
+	}
+	if pushErr == nil {
+		return nil, nil
+	}
+
+	return pushErr, rollbackRotation(ctx, hook, path, previous)
+}
+
+// rollbackRotation pushes the previous data back to the consumer
+func rollbackRotation(ctx context.Context, hook rotationHook, path string, previous map[string]interface{}) error {
+	if rollback, ok := hook.(interface {
+		Rollback(ctx context.Context, path string, previous map[string]interface{}) error
+	}); ok {
+		return rollback.Rollback(ctx, path, previous)
+	}
+	if previous == nil {
+		return nil
+	}
+	return hook.Push(ctx, path, previous)
+}
+
+// --------------------------------------------------------------------------------------------
+// upstream hosts
+// --------------------------------------------------------------------------------------------
+
+// connectionHosts return the host and port a sql connection URL connects to, by driver
+var connectionHosts = map[string]func(connectionURL string) (string, string, error){
+	"postgres": postgresHost,
+	"mysql":    mysqlHost,
+}
+
+// checkRotationUpstreams returns an error if the generator or the hook of the rotation calls
+// a host that is not in the upstream hosts
+func (c *mountConfig) checkRotationUpstreams(rotation *rotationEntry) error {
+	if rotation.Generator == generatorHook {
+		if err := c.checkUpstreamURL("generator_url", rotation.GeneratorURL); err != nil {
+			return err
+		}
+	}
+	if rotation.Hook == nil {
+		return nil
+	}
+	return c.checkHookUpstreams(rotation.Hook)
+}
+
+// checkHookUpstreams returns an error if the hook calls a host that is not in the upstream hosts
+func (c *mountConfig) checkHookUpstreams(hook *rotationHookConfig) error {
+	switch hook.Type {
+	case hookTypeHTTP:
+		if err := c.checkUpstreamURL("hook_url", hook.URL); err != nil {
+			return err
+		}
+		if hook.VerifyURL != "" {
+			return c.checkUpstreamURL("hook_verify_url", hook.VerifyURL)
+		}
+	case hookTypeSQL:
+		connectionHost, ok := connectionHosts[hook.Driver]
+		if !ok {
+			return fmt.Errorf("the host of a %s connection can not be checked against upstream_hosts", hook.Driver)
+		}
+		host, port, err := connectionHost(hook.ConnectionURL)
+		if err != nil {
+			return err
+		}
+		return c.checkUpstream("hook_connection_url", host, port)
+	}
+	return nil
+}
+
+// checkUpstreamURL returns an error if the URL is not an http URL of an upstream host
+func (c *mountConfig) checkUpstreamURL(setting string, rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return fmt.Errorf("%s must be an http or https URL", setting)
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = "80"
+		if parsed.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return c.checkUpstream(setting, parsed.Hostname(), port)
+}
+
+// checkUpstream returns an error if the host and port are not in the upstream hosts
+func (c *mountConfig) checkUpstream(setting string, host string, port string) error {
+	if !c.allowsUpstream(host, port) {
+		return fmt.Errorf("%s calls %s that is not in upstream_hosts of the config", setting, net.JoinHostPort(host, port))
+	}
+	return nil
+}
+
+// postgresHost returns the host and port of a postgres:// connection URL.  The parse errors
+// are not returned as they can show the password.
+func postgresHost(connectionURL string) (string, string, error) {
+	parsed, err := url.Parse(connectionURL)
+	if err != nil || (parsed.Scheme != "postgres" && parsed.Scheme != "postgresql") || parsed.Hostname() == "" {
+		return "", "", fmt.Errorf("hook_connection_url must be a postgres:// URL with a host")
+	}
+	// the driver lets the parameters of the URL replace its host
+	query := parsed.Query()
+	for _, key := range []string{"host", "hostaddr", "port"} {
+		if _, ok := query[key]; ok {
+			return "", "", fmt.Errorf("hook_connection_url must not set %s as a parameter", key)
+		}
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = "5432"
+	}
+	return parsed.Hostname(), port, nil
+}
+
+// mysqlHost returns the host and port of a mysql DSN
+func mysqlHost(connectionURL string) (string, string, error) {
+	config, err := mysql.ParseDSN(connectionURL)
+	if err != nil || config.Net != "tcp" {
+		return "", "", fmt.Errorf("hook_connection_url must be a mysql DSN that connects over tcp")
+	}
+	host, port, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return "", "", fmt.Errorf("hook_connection_url must be a mysql DSN that connects over tcp")
+	}
+	return host, port, nil
+}
+
+// --------------------------------------------------------------------------------------------
+// http hook
+// --------------------------------------------------------------------------------------------
+
+type httpRotationHook struct {
+	client    *http.Client
+	url       string
+	verifyURL string
+}
+
+func (h *httpRotationHook) Push(ctx context.Context, path string, data map[string]interface{}) error {
+	return h.post(ctx, h.url, path, data)
+}
+
+func (h *httpRotationHook) Verify(ctx context.Context, path string, data map[string]interface{}) error {
+	if h.verifyURL == "" {
+		return nil
+	}
+	return h.post(ctx, h.verifyURL, path, data)
+}
+
+func (h *httpRotationHook) Close() error {
+	return nil
+}
+
+// post sends the secret to the url.  Any status other than 2xx is an error.
+func (h *httpRotationHook) post(ctx context.Context, url string, path string, data map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"path": path,
+		"data": data,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	injectTraceContext(ctx, req)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("hook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------
+// sql hook
+// --------------------------------------------------------------------------------------------
+
+type sqlRotationHook struct {
+	db              *sql.DB
+	driver          string
+	statement       string
+	verifyStatement string
+}
+
+func (h *sqlRotationHook) Push(ctx context.Context, path string, data map[string]interface{}) error {
+	statement, args, err := renderStatement(h.driver, h.statement, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.ExecContext(ctx, statement, args...)
+	return err
+}
+
+func (h *sqlRotationHook) Verify(ctx context.Context, path string, data map[string]interface{}) error {
+	if h.verifyStatement == "" {
+		return nil
+	}
+
+	statement, args, err := renderStatement(h.driver, h.verifyStatement, data)
+	if err != nil {
+		return err
+	}
+
+	rows, err := h.db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("verify statement returned no rows")
+	}
+	return nil
+}
+
+func (h *sqlRotationHook) Close() error {
+	return h.db.Close()
+}
+
+// statementPlaceholder matches a {{key}} placeholder with the quotes around it
+var statementPlaceholder = regexp.MustCompile(`'\{\{([^{}]+)\}\}'|"\{\{([^{}]+)\}\}"|` + "`\\{\\{([^{}]+)\\}\\}`" + `|\{\{([^{}]+)\}\}`)
+
+// renderStatement replaces the {{key}} placeholders of the statement with the bind parameters
+// of the driver and returns the secret values to pass for them.  The identifiers are quoted in
+// the statement.  A placeholder of a key the secret does not have is an error.
+func renderStatement(driver string, statement string, data map[string]interface{}) (string, []interface{}, error) {
+	var renderErr error
+	var args []interface{}
+	rendered := statementPlaceholder.ReplaceAllStringFunc(statement, func(placeholder string) string {
+		match := statementPlaceholder.FindStringSubmatch(placeholder)
+
+		var key string
+		for _, group := range match[1:] {
+			if group != "" {
+				key = strings.TrimSpace(group)
+			}
+		}
+		value, ok := data[key]
+		if !ok {
+			if renderErr == nil {
+				renderErr = fmt.Errorf("the statement references %q that is not a key of the secret", key)
+			}
+			return placeholder
+		}
+
+		switch {
+		case match[2] != "" && driver != "mysql", match[3] != "":
+			return quoteIdentifier(driver, fmt.Sprint(value))
+		default:
+			args = append(args, fmt.Sprint(value))
+			return bindParameter(driver, len(args))
+		}
+	})
+	return rendered, args, renderErr
+}
+
+// bindParameter returns the bind parameter n of the SQL dialect of the driver, from 1
+func bindParameter(driver string, n int) string {
+	if driver == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// quoteIdentifier returns the value as an identifier of the SQL dialect of the driver
+func quoteIdentifier(driver string, value string) string {
+	if driver == "mysql" {
+		return "`" + strings.ReplaceAll(value, "`", "``") + "`"
+	}
+	return pq.QuoteIdentifier(value)
+}
+
+// --------------------------------------------------------------------------------------------
+// file hook
+// --------------------------------------------------------------------------------------------
+
+type fileRotationHook struct {
+	path string
+}
+
+// hookFilePath returns the file of a file hook: the path joined to the directory of the file
+// hooks.  A path that is absolute or goes up with .. is an error so a hook can only write
+// in that directory.
+func hookFilePath(dir string, path string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("file hooks are off: the mount was not enabled with the hook_file_dir option")
+	}
+	cleaned := filepath.Clean(path)
+	if filepath.IsAbs(cleaned) || cleaned == "." {
+		return "", fmt.Errorf("hook_file_path must be a file relative to the hook_file_dir of the mount")
+	}
+	for _, element := range strings.Split(filepath.ToSlash(cleaned), "/") {
+		if element == ".." {
+			return "", fmt.Errorf("hook_file_path must not contain ..")
+		}
+	}
+	return filepath.Join(dir, cleaned), nil
+}
+
+// Push writes the file next to the target and renames it so a reader never sees half a file
+func (h *fileRotationHook) Push(ctx context.Context, path string, data map[string]interface{}) error {
+	content, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(h.path), filepath.Base(h.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), h.path)
+}
+
+func (h *fileRotationHook) Verify(ctx context.Context, path string, data map[string]interface{}) error {
+	content, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+
+	var written, expected map[string]interface{}
+	if err := jsonutil.DecodeJSON(content, &written); err != nil {
+		return err
+	}
+	// round trip the expected data so the types compare the same way
+	expectedJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := jsonutil.DecodeJSON(expectedJSON, &expected); err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(written, expected) {
+		return fmt.Errorf("file %s does not contain the rotated secret", h.path)
+	}
+	return nil
+}
+
+func (h *fileRotationHook) Close() error {
+	return nil
+}
+
+// Rollback writes the previous data back.  The file is removed if there was no secret before.
+func (h *fileRotationHook) Rollback(ctx context.Context, path string, previous map[string]interface{}) error {
+	if previous == nil {
+		if err := os.Remove(h.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return h.Push(ctx, path, previous)
+}
@@ -0,0 +1,223 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// run the periodic function of the backend like vault does
+func runPeriodic(t *testing.T, b logical.Backend, storage logical.Storage) {
+	err := b.(*scalesecSecretStoreBackend).periodicFunc(context.Background(), &logical.Request{Storage: storage})
+	assert.Nil(t, err, "periodic error %s", err)
+}
+
+// vault write scalesecsecrets/rotation/app/db rotation_period=1h generator=random_bytes
+func TestRotationRandomBytes(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{
+		"user":     "app",
+		"password": "initial",
+	})
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "rotation/app/db", map[string]interface{}{
+		"rotation_period": "1h",
+		"grace_period":    "10m",
+		"generator":       "random_bytes",
+		"bytes":           16,
+	})
+	assert.Nil(t, response, "Response message %v", response)
+
+	// nothing is due yet
+	runPeriodic(t, b, storage)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "initial", response.Data["password"])
+
+	now = now.Add(61 * time.Minute)
+	runPeriodic(t, b, storage)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.NotEqual(t, "initial", response.Data["password"])
+	assert.Len(t, response.Data["password"], 24, "16 bytes base64 encoded")
+	assert.Equal(t, "app", response.Data["user"], "other keys are not changed")
+
+	// the previous value is readable during the grace period only
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", map[string]interface{}{"previous": true})
+	assert.Equal(t, "initial", response.Data["password"])
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "rotation/app/db", nil)
+	assert.Equal(t, now.Format(time.RFC3339), response.Data["last_rotated"])
+	assert.Equal(t, now.Add(time.Hour).Format(time.RFC3339), response.Data["next_rotation"])
+	assert.Equal(t, "", response.Data["last_error"])
+
+	now = now.Add(11 * time.Minute)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", map[string]interface{}{"previous": true})
+	assert.Nil(t, response, "previous version should expire after the grace period")
+}
+
+// vault write scalesecsecrets/rotation/app/db generator=password_policy password_policy=app rotate_now=true
+func TestRotationPasswordPolicy(t *testing.T) {
+
+	b, storage := getBackend(t)
+	b.(*scalesecSecretStoreBackend).System().(*logical.StaticSystemView).SetPasswordPolicy("app", func() (string, error) {
+		return "policy-password", nil
+	})
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "rotation/app/db", map[string]interface{}{
+		"rotation_period": "24h",
+		"generator":       "password_policy",
+		"password_policy": "app",
+		"rotate_now":      true,
+	})
+	assert.Nil(t, response, "Response message %v", response)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "policy-password", response.Data["password"])
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "rotation/app/other", map[string]interface{}{
+		"rotation_period": "24h",
+		"generator":       "password_policy",
+	})
+	assert.True(t, response.IsError(), "password_policy should be required")
+}
+
+// A failing generator hook is recorded on the rotation and the secret is not changed
+func TestRotationHookError(t *testing.T) {
+
+	failing := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"value": "hook-value"})
+	}))
+	defer server.Close()
+
+	b, storage := getBackend(t)
+	allowUpstreams(t, b, storage)
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/api", map[string]interface{}{"api_key": "initial"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "rotation/app/api", map[string]interface{}{
+		"key":             "api_key",
+		"rotation_period": "1h",
+		"generator":       "hook",
+		"generator_url":   server.URL,
+	})
+
+	now = now.Add(2 * time.Hour)
+	runPeriodic(t, b, storage)
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "rotation/app/api", nil)
+	assert.Contains(t, response.Data["last_error"], "status 503")
+	assert.NotContains(t, response.Data, "last_rotated")
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/api", nil)
+	assert.Equal(t, "initial", response.Data["api_key"])
+
+	// the rotation is retried after a backoff that grows with each failure
+	response = sendRequest(t, b, storage, logical.ReadOperation, "rotation/app/api", nil)
+	assert.Equal(t, 1, response.Data["failures"])
+	assert.Equal(t, now.Add(time.Minute).Format(time.RFC3339), response.Data["next_rotation"])
+	runPeriodic(t, b, storage)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "rotation/app/api", nil)
+	assert.Equal(t, 1, response.Data["failures"], "not retried before the backoff")
+
+	now = now.Add(time.Minute)
+	runPeriodic(t, b, storage)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "rotation/app/api", nil)
+	assert.Equal(t, 2, response.Data["failures"])
+	assert.Equal(t, now.Add(2*time.Minute).Format(time.RFC3339), response.Data["next_rotation"])
+
+	failing = false
+	now = now.Add(2 * time.Minute)
+	runPeriodic(t, b, storage)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "rotation/app/api", nil)
+	assert.Equal(t, "", response.Data["last_error"])
+	assert.Equal(t, 0, response.Data["failures"])
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/api", nil)
+	assert.Equal(t, "hook-value", response.Data["api_key"])
+}
+
+// A rotation write waits for a periodic rotation of the secret so neither loses the
+// changes of the other
+func TestRotationWriteDuringRotation(t *testing.T) {
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		json.NewEncoder(w).Encode(map[string]string{"value": "hook-value"})
+	}))
+	defer server.Close()
+
+	b, storage := getBackend(t)
+	allowUpstreams(t, b, storage)
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/api", map[string]interface{}{"api_key": "initial"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "rotation/app/api", map[string]interface{}{
+		"key":             "api_key",
+		"rotation_period": "1h",
+		"generator":       "hook",
+		"generator_url":   server.URL,
+	})
+	now = now.Add(2 * time.Hour)
+
+	rotated := make(chan struct{})
+	go func() {
+		defer close(rotated)
+		runPeriodic(t, b, storage)
+	}()
+	<-entered
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		sendRequest(t, b, storage, logical.UpdateOperation, "rotation/app/api", map[string]interface{}{"grace_period": "2h"})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-rotated
+	<-written
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "rotation/app/api", nil)
+	assert.Equal(t, int64(7200), response.Data["grace_period"], "the write is not lost")
+	assert.Equal(t, now.Format(time.RFC3339), response.Data["last_rotated"], "the rotation is not lost")
+}
+
+// The backoff doubles with each failure up to the max and never goes past the period
+func TestRotationRetryBackoff(t *testing.T) {
+
+	rotation := &rotationEntry{Period: 24 * time.Hour}
+	for failures, expected := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		4:  8 * time.Minute,
+		20: rotationRetryMaxBackoff,
+	} {
+		rotation.Failures = failures
+		assert.Equal(t, expected, rotation.retryBackoff(), "failures %d", failures)
+	}
+
+	rotation.Period = 5 * time.Minute
+	rotation.Failures = 20
+	assert.Equal(t, 5*time.Minute, rotation.retryBackoff())
+
+	b, _ := getBackend(t)
+	assert.Contains(t, b.SpecialPaths().SealWrapStorage, rotationStoragePrefix)
+}
@@ -0,0 +1,307 @@
+// ********************************************************************************
+// Schema validation of the secret values
+//
+// A JSON Schema document can be registered against a path prefix.  Every write or patch
+// of a secret under the prefix is validated against the schema and rejected with the
+// errors of each field that does not conform.
+//
+//   vault write scalesecsecrets/schema/db prefix="db/*" schema=@db-schema.json
+//
+// All the schemas with a matching prefix are applied.  Note the vault CLI sends key=value
+// pairs as strings so secrets with typed values (integer, boolean) should be written as JSON.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Storage prefix for the registered schemas
+const schemaStoragePrefix = "schema/"
+
+// schemaEntry is the storage entry for a registered schema
+type schemaEntry struct {
+	Prefix string `json:"prefix"`
+	Schema string `json:"schema"`
+}
+
+// compiledSchema is a registered schema ready to validate secrets
+type compiledSchema struct {
+	name   string
+	prefix string
+	schema *gojsonschema.Schema
+}
+
+// schemaPaths returns the paths to manage the schemas.
+func (b *scalesecSecretStoreBackend) schemaPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.schemaPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "schema/?$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.handleSchemaList,
+					Summary:  "Lists the registered schemas.",
+				},
+			},
+		},
+		{
+			Pattern: "schema/" + framework.GenericNameRegex("name"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the schema.",
+				},
+				"prefix": {
+					Type:        framework.TypeString,
+					Description: "Path prefix of the secrets the schema applies to.  IE: db/ or db/*",
+				},
+				"schema": {
+					Type:        framework.TypeString,
+					Description: "JSON Schema document the secret values must conform to.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleSchemaRead,
+					Summary:  "Read a registered schema.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleSchemaWrite,
+					Summary:  "Register a schema against a path prefix.",
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.handleSchemaDelete,
+					Summary:  "Delete a registered schema.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.schemaPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleSchemaWrite: Register a schema against a path prefix
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleSchemaWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleSchemaWrite:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleSchemaWrite:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	name := data.Get("name").(string)
+	entry := &schemaEntry{
+		Prefix: strings.TrimSuffix(data.Get("prefix").(string), "*"),
+		Schema: data.Get("schema").(string),
+	}
+	if entry.Schema == "" {
+		return logical.ErrorResponse("schema must be provided"), nil
+	}
+
+	// Make sure the document is a valid schema before it is stored
+	if _, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(entry.Schema)); err != nil {
+		return logical.ErrorResponse("invalid schema: %s", err), nil
+	}
+
+	storageEntry, err := logical.StorageEntryJSON(schemaStoragePrefix+name, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	b.schemaLock.Lock()
+	defer b.schemaLock.Unlock()
+
+	if err := req.Storage.Put(ctx, storageEntry); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleSchemaWrite:-> Leaving with error")
+		return nil, fmt.Errorf("storing schema failed: %w", err)
+	}
+	b.schemas = nil
+
+	b.Logger().Debug("scalesecSecretStore.handleSchemaWrite:-> Leaving")
+	return nil, nil
+}
+
+// ============================================================================================
+// handleSchemaRead: Read a registered schema
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleSchemaRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleSchemaRead:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleSchemaRead:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	storageEntry, err := req.Storage.Get(ctx, schemaStoragePrefix+data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if storageEntry == nil {
+		b.Logger().Debug("scalesecSecretStore.handleSchemaRead:-> Leaving schema not found")
+		return nil, nil
+	}
+
+	var entry schemaEntry
+	if err := storageEntry.DecodeJSON(&entry); err != nil {
+		return nil, err
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleSchemaRead:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"prefix": entry.Prefix,
+			"schema": entry.Schema,
+		},
+	}, nil
+}
+
+// ============================================================================================
+// handleSchemaDelete: Delete a registered schema
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleSchemaDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleSchemaDelete:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleSchemaDelete:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	b.schemaLock.Lock()
+	defer b.schemaLock.Unlock()
+
+	if err := req.Storage.Delete(ctx, schemaStoragePrefix+data.Get("name").(string)); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleSchemaDelete:-> Leaving with error")
+		return nil, fmt.Errorf("deleting schema failed: %w", err)
+	}
+	b.schemas = nil
+
+	b.Logger().Debug("scalesecSecretStore.handleSchemaDelete:-> Leaving")
+	return nil, nil
+}
+
+// ============================================================================================
+// handleSchemaList: List the registered schemas
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleSchemaList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleSchemaList:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleSchemaList:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	names, err := req.Storage.List(ctx, schemaStoragePrefix)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleSchemaList:-> Leaving with error")
+		return nil, fmt.Errorf("listing schemas failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleSchemaList:-> Leaving")
+	return logical.ListResponse(names), nil
+}
+
+// loadSchemas returns the compiled schemas.  They are compiled once and kept until a schema
+// is written or deleted.
+func (b *scalesecSecretStoreBackend) loadSchemas(ctx context.Context, s logical.Storage) ([]*compiledSchema, error) {
+	b.schemaLock.RLock()
+	schemas := b.schemas
+	b.schemaLock.RUnlock()
+	if schemas != nil {
+		return schemas, nil
+	}
+
+	b.schemaLock.Lock()
+	defer b.schemaLock.Unlock()
+
+	// another request may have loaded them while we waited for the lock
+	if b.schemas != nil {
+		return b.schemas, nil
+	}
+
+	names, err := s.List(ctx, schemaStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing schemas failed: %w", err)
+	}
+
+	schemas = []*compiledSchema{}
+	for _, name := range names {
+		storageEntry, err := s.Get(ctx, schemaStoragePrefix+name)
+		if err != nil {
+			return nil, err
+		}
+		if storageEntry == nil {
+			continue
+		}
+
+		var entry schemaEntry
+		if err := storageEntry.DecodeJSON(&entry); err != nil {
+			return nil, fmt.Errorf("decoding schema %q failed: %w", name, err)
+		}
+
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(entry.Schema))
+		if err != nil {
+			return nil, fmt.Errorf("compiling schema %q failed: %w", name, err)
+		}
+		schemas = append(schemas, &compiledSchema{name: name, prefix: entry.Prefix, schema: schema})
+	}
+
+	b.schemas = schemas
+	return schemas, nil
+}
+
+// validateSecret validates the secret data against every schema registered for a prefix of
+// path.  Returns an error response listing the fields that do not conform, or nil if the
+// data is valid.  The values themselves are never included in the errors.
+func (b *scalesecSecretStoreBackend) validateSecret(ctx context.Context, s logical.Storage, path string, secretData map[string]interface{}) (*logical.Response, error) {
+	schemas, err := b.loadSchemas(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	path = strings.TrimPrefix(path, "/")
+
+	var fieldErrors []string
+	for _, schema := range schemas {
+		if !strings.HasPrefix(path, schema.prefix) {
+			continue
+		}
+
+		result, err := schema.schema.Validate(gojsonschema.NewGoLoader(secretData))
+		if err != nil {
+			return nil, fmt.Errorf("validating against schema %q failed: %w", schema.name, err)
+		}
+		for _, resultError := range result.Errors() {
+			fieldErrors = append(fieldErrors, fmt.Sprintf("%s: %s: %s", schema.name, resultError.Field(), resultError.Description()))
+		}
+	}
+
+	if len(fieldErrors) == 0 {
+		return nil, nil
+	}
+
+	// vault only treats a response as an error if error is the only key so the field errors
+	// are part of the message
+	sort.Strings(fieldErrors)
+	return logical.ErrorResponse("secret does not match the schema: %s", strings.Join(fieldErrors, "; ")), nil
+}
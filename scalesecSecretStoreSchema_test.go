@@ -0,0 +1,99 @@
+package scalesecSecretStore
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const DB_SCHEMA = `{
+	"type": "object",
+	"required": ["host", "port", "password"],
+	"properties": {
+		"host": {"type": "string"},
+		"port": {"type": "integer"},
+		"password": {"type": "string", "minLength": 8}
+	}
+}`
+
+// vault write scalesecsecrets/schema/db prefix="db/*" schema=@db-schema.json
+func TestSchemaWrite(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "schema/db", map[string]interface{}{
+		"prefix": "db/*",
+		"schema": DB_SCHEMA,
+	})
+	assert.Nil(t, response, "Response message %v", response)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "schema/db", nil)
+	assert.Equal(t, "db/", response.Data["prefix"])
+
+	response = sendRequest(t, b, storage, logical.ListOperation, "schema/", nil)
+	assert.Equal(t, []string{"db"}, response.Data["keys"])
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "schema/bad", map[string]interface{}{
+		"prefix": "bad/",
+		"schema": `{"type": 12}`,
+	})
+	assert.True(t, response.IsError(), "invalid schema should be rejected")
+}
+
+func TestSchemaValidation(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "schema/db", map[string]interface{}{
+		"prefix": "db/*",
+		"schema": DB_SCHEMA,
+	})
+
+	// a conforming secret is stored
+	response := sendRequest(t, b, storage, logical.CreateOperation, "db/orders", map[string]interface{}{
+		"host":     "db.example.com",
+		"port":     json.Number("5432"),
+		"password": "s3cr3t-password",
+	})
+	assert.Nil(t, response, "Response message %v", response)
+
+	// the errors name each field that does not conform without the values
+	response = sendRequest(t, b, storage, logical.CreateOperation, "db/billing", map[string]interface{}{
+		"host": "db.example.com",
+		"port": "not-a-port",
+	})
+	assert.True(t, response.IsError(), "non conforming secret should be rejected")
+	assert.Equal(t, "secret does not match the schema: db: (root): password is required; db: port: Invalid type. Expected: integer, given: string", response.Data["error"])
+	assert.NotContains(t, response.Data["error"], "not-a-port")
+	assert.Nil(t, sendRequest(t, b, storage, logical.ReadOperation, "db/billing", nil), "rejected secret should not be stored")
+
+	// a patch is validated against the patched secret
+	response = sendRequest(t, b, storage, logical.PatchOperation, "db/orders", map[string]interface{}{
+		"password": nil,
+	})
+	assert.True(t, response.IsError(), "patch removing a required key should be rejected")
+
+	response = sendRequest(t, b, storage, logical.PatchOperation, "db/orders", map[string]interface{}{
+		"port": json.Number("6432"),
+	})
+	assert.Nil(t, response, "Response message %v", response)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "db/orders", nil)
+	assert.Equal(t, json.Number("6432"), response.Data["port"])
+	assert.Equal(t, "db.example.com", response.Data["host"])
+
+	// paths outside of the prefix are not validated
+	response = sendRequest(t, b, storage, logical.CreateOperation, "app/config", map[string]interface{}{
+		"port": "any",
+	})
+	assert.Nil(t, response, "Response message %v", response)
+
+	// deleting the schema stops the validation
+	sendRequest(t, b, storage, logical.DeleteOperation, "schema/db", nil)
+	response = sendRequest(t, b, storage, logical.CreateOperation, "db/billing", map[string]interface{}{
+		"host": "db.example.com",
+	})
+	assert.Nil(t, response, "Response message %v", response)
+}
@@ -0,0 +1,236 @@
+// ********************************************************************************
+// Search of the secrets by path, tag, metadata and last modified time
+//
+//   vault read scalesecsecrets/search path_glob="app/*" tag=prod metadata=team=payments \
+//     updated_before=2021-06-01T00:00:00Z limit=50
+//
+// All the criteria given must match.  The search reads the index (scalesecSecretStoreIndex.go),
+// never the secrets, so the response only has the paths and their metadata.
+//
+// Vault only checks the policy of the search path, so a secret is only returned if the
+// caller has read or list on its path.  The search fails unless access_check_token is set
+// in the config (see scalesecSecretStoreTemplate.go).
+//
+// The results are sorted by path.  If there are more than limit results the response has
+// next; pass it as after to get the next page.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	glob "github.com/ryanuber/go-glob"
+)
+
+// Number of results of a page
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// searchQuery has the criteria of a search
+type searchQuery struct {
+	PathGlob      string
+	Tag           string
+	Metadata      map[string]string
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+}
+
+// searchPaths returns the path to search the secrets.
+func (b *scalesecSecretStoreBackend) searchPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.searchPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "search$",
+
+			Fields: map[string]*framework.FieldSchema{
+				"path_glob": {
+					Type:        framework.TypeString,
+					Description: "Glob the path of the secrets must match.  * matches any characters including /.",
+				},
+				"tag": {
+					Type:        framework.TypeString,
+					Description: "Tag the secrets must have.",
+				},
+				"metadata": {
+					Type:        framework.TypeKVPairs,
+					Description: "Custom metadata values the secrets must have.  IE: team=payments",
+				},
+				"updated_after": {
+					Type:        framework.TypeTime,
+					Description: "Only the secrets changed after this time.  RFC3339 or unix seconds.",
+				},
+				"updated_before": {
+					Type:        framework.TypeTime,
+					Description: "Only the secrets last changed before this time.  RFC3339 or unix seconds.",
+				},
+				"after": {
+					Type:        framework.TypeString,
+					Description: "Return the results after this path: the next value of the previous page.",
+				},
+				"limit": {
+					Type:        framework.TypeInt,
+					Default:     defaultSearchLimit,
+					Description: "Maximum number of results.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleSearch,
+					Summary:  "Find secrets by path glob, tag, metadata and last modified time.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.searchPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleSearch: Find secrets by path glob, tag, metadata and last modified time
+//
+// GOAL:  	Return a page of the paths that match all the criteria with their metadata
+// Return:
+// 			*logical.Response := keys, key_info and next if there are more results
+// 			error := Error with details if the search failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleSearch(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleSearch:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleSearch:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	query := &searchQuery{
+		PathGlob: data.Get("path_glob").(string),
+		Tag:      data.Get("tag").(string),
+		Metadata: data.Get("metadata").(map[string]string),
+	}
+	if value, ok := data.GetOk("updated_after"); ok {
+		query.UpdatedAfter = value.(time.Time)
+	}
+	if value, ok := data.GetOk("updated_before"); ok {
+		query.UpdatedBefore = value.(time.Time)
+	}
+
+	limit := data.Get("limit").(int)
+	if limit <= 0 || limit > maxSearchLimit {
+		return logical.ErrorResponse("limit must be between 1 and %d", maxSearchLimit), nil
+	}
+	after := data.Get("after").(string)
+
+	paths, err := b.searchCandidates(ctx, req.Storage, query)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleSearch:-> Leaving with error")
+		return nil, fmt.Errorf("searching the index failed: %w", err)
+	}
+
+	keys := []string{}
+	keyInfo := map[string]interface{}{}
+	next := ""
+	for _, path := range paths {
+		if path <= after || (query.PathGlob != "" && !glob.Glob(query.PathGlob, path)) {
+			continue
+		}
+
+		entry, err := b.getIndexEntry(ctx, req.Storage, path)
+		if err != nil {
+			b.Logger().Debug("scalesecSecretStore.handleSearch:-> Leaving with error")
+			return nil, fmt.Errorf("reading the index failed: %w", err)
+		}
+		if entry == nil || !query.matches(entry) {
+			continue
+		}
+		allowed, err := b.canAccess(ctx, req, path, "read", "list")
+		if err != nil {
+			b.Logger().Debug("scalesecSecretStore.handleSearch:-> Leaving with error")
+			return nil, err
+		}
+		if !allowed {
+			continue
+		}
+
+		if len(keys) == limit {
+			next = keys[len(keys)-1]
+			break
+		}
+		keys = append(keys, path)
+		keyInfo[path] = map[string]interface{}{
+			"tags":            entry.Tags,
+			"custom_metadata": entry.CustomMetadata,
+			"version":         entry.Version,
+			"updated_time":    entry.UpdatedTime.Format(time.RFC3339Nano),
+		}
+	}
+
+	resp := logical.ListResponseWithInfo(keys, keyInfo)
+	if next != "" {
+		resp.Data["next"] = next
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleSearch:-> Leaving")
+	return resp, nil
+}
+
+// searchCandidates returns the sorted paths of the secrets with the tag and metadata of the
+// query, or of all the indexed secrets if the query has neither
+func (b *scalesecSecretStoreBackend) searchCandidates(ctx context.Context, s logical.Storage, query *searchQuery) ([]string, error) {
+	var prefixes []string
+	if query.Tag != "" {
+		prefixes = append(prefixes, indexTagPrefix(query.Tag))
+	}
+	for key, value := range query.Metadata {
+		prefixes = append(prefixes, indexMetadataValuePrefix(key, value))
+	}
+	if len(prefixes) == 0 {
+		prefixes = append(prefixes, indexSecretsPrefix)
+	}
+
+	// keep the paths found under every prefix
+	var candidates map[string]bool
+	for _, prefix := range prefixes {
+		paths, err := logical.CollectKeysWithPrefix(ctx, logical.NewStorageView(s, prefix), "")
+		if err != nil {
+			return nil, err
+		}
+
+		found := make(map[string]bool, len(paths))
+		for _, path := range paths {
+			if candidates == nil || candidates[path] {
+				found[path] = true
+			}
+		}
+		candidates = found
+	}
+
+	paths := make([]string, 0, len(candidates))
+	for path := range candidates {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// matches checks the last modified time of the indexed secret is in the range of the query
+func (query *searchQuery) matches(entry *indexEntry) bool {
+	if !query.UpdatedAfter.IsZero() && !entry.UpdatedTime.After(query.UpdatedAfter) {
+		return false
+	}
+	if !query.UpdatedBefore.IsZero() && !entry.UpdatedTime.Before(query.UpdatedBefore) {
+		return false
+	}
+	return true
+}
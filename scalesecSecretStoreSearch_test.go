@@ -0,0 +1,118 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// write the secrets searched by the tests.  app/db is a year older than the others.
+func writeSearchSecrets(t *testing.T, b logical.Backend, storage logical.Storage) time.Time {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "p1"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "metadata/app/db", map[string]interface{}{
+		"custom_metadata": map[string]interface{}{"team": "payments"},
+		"tags":            "prod,database",
+	})
+
+	now = now.AddDate(1, 0, 0)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/api", map[string]interface{}{"key": "k1"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "metadata/app/api", map[string]interface{}{
+		"custom_metadata": map[string]interface{}{"team": "payments", "url": "https://api/v1"},
+		"tags":            "prod",
+	})
+	sendRequest(t, b, storage, logical.CreateOperation, "web/db", map[string]interface{}{"password": "p2"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "metadata/web/db", map[string]interface{}{
+		"custom_metadata": map[string]interface{}{"team": "web"},
+		"tags":            "prod,database",
+	})
+	return now
+}
+
+// vault read scalesecsecrets/search tag=... metadata=... path_glob=... updated_before=...
+func TestSearch(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := writeSearchSecrets(t, b, storage)
+
+	search := func(data map[string]interface{}) []string {
+		response := sendRequest(t, b, storage, logical.ReadOperation, "search", data)
+		assert.False(t, response.IsError(), "Response message %v", response)
+		return response.Data["keys"].([]string)
+	}
+
+	assert.Equal(t, []string{"app/api", "app/db", "web/db"}, search(nil))
+	assert.Equal(t, []string{"app/db", "web/db"}, search(map[string]interface{}{"tag": "database"}))
+	assert.Equal(t, []string{"app/api", "app/db"}, search(map[string]interface{}{"metadata": "team=payments"}))
+	assert.Equal(t, []string{"app/api"}, search(map[string]interface{}{"metadata": "url=https://api/v1"}))
+	assert.Equal(t, []string{"app/db"}, search(map[string]interface{}{"tag": "database", "metadata": "team=payments"}))
+	assert.Equal(t, []string{"app/db", "web/db"}, search(map[string]interface{}{"path_glob": "*/db"}))
+	assert.Equal(t, []string{"app/db"}, search(map[string]interface{}{
+		"metadata":       "team=payments",
+		"updated_before": now.AddDate(0, 0, -90).Format(time.RFC3339),
+	}))
+	assert.Equal(t, []string{"app/api", "web/db"}, search(map[string]interface{}{"updated_after": now.AddDate(0, 0, -1).Unix()}))
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "search", map[string]interface{}{"tag": "prod", "limit": 1})
+	assert.Equal(t, []string{"app/api"}, response.Data["keys"])
+	assert.Equal(t, "app/api", response.Data["next"])
+	info := response.Data["key_info"].(map[string]interface{})["app/api"].(map[string]interface{})
+	assert.Equal(t, []string{"prod"}, info["tags"])
+	assert.NotContains(t, info, "key", "values are never returned")
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "search", map[string]interface{}{"tag": "prod", "limit": 2, "after": "app/api"})
+	assert.Equal(t, []string{"app/db", "web/db"}, response.Data["keys"])
+	assert.NotContains(t, response.Data, "next")
+}
+
+// The index follows the changes of tags and metadata, deletes and undeletes
+func TestSearchIndexUpdates(t *testing.T) {
+
+	b, storage := getBackend(t)
+	writeSearchSecrets(t, b, storage)
+
+	search := func(data map[string]interface{}) []string {
+		response := sendRequest(t, b, storage, logical.ReadOperation, "search", data)
+		keys, _ := response.Data["keys"].([]string)
+		return keys
+	}
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "metadata/web/db", map[string]interface{}{"tags": "staging"})
+	assert.Equal(t, []string{"app/db"}, search(map[string]interface{}{"tag": "database"}))
+	assert.Equal(t, []string{"web/db"}, search(map[string]interface{}{"tag": "staging"}))
+
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/db", nil)
+	assert.Empty(t, search(map[string]interface{}{"tag": "database"}))
+	assert.Equal(t, []string{"app/api"}, search(map[string]interface{}{"metadata": "team=payments"}))
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "undelete/app/db", nil)
+	assert.Equal(t, []string{"app/db"}, search(map[string]interface{}{"tag": "database"}))
+
+	// removing the metadata removes the markers
+	sendRequest(t, b, storage, logical.DeleteOperation, "metadata/app/api", nil)
+	keys, err := logical.CollectKeysWithPrefix(context.Background(), storage, "index/tags/prod/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"index/tags/prod/app/db"}, keys)
+	assert.Empty(t, listWAL(t, storage))
+}
+
+// The secrets the caller can not read or list are left out of the results
+func TestSearchAccess(t *testing.T) {
+
+	b, storage := getBackend(t)
+	writeSearchSecrets(t, b, storage)
+	checker := b.(*scalesecSecretStoreBackend).accessChecker.(*staticAccessChecker)
+	checker.capabilities["app/db"] = []string{"deny"}
+	checker.capabilities["web/db"] = []string{"list"}
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "search", map[string]interface{}{"tag": "database", "limit": 1})
+	assert.Equal(t, []string{"web/db"}, response.Data["keys"])
+	assert.NotContains(t, response.Data, "next", "the hidden secrets do not count toward the limit")
+	assert.NotContains(t, response.Data["key_info"], "app/db")
+}
@@ -0,0 +1,299 @@
+// ********************************************************************************
+// One-time secrets: share/<path>
+//
+// A share holds a value that can be read exactly once, IE: a credential handed to a
+// vendor.  The read deletes it, so a second read, by the vendor or by someone who
+// intercepted the link, finds nothing:
+//
+//   vault write scalesecsecrets/share/vendor/acme data=@credential.json ttl=72h min_wrap_ttl=1h
+//   vault read scalesecsecrets/share/vendor/acme
+//
+// ttl          : how long the share can be read before it is dropped unread (default 168h)
+// min_wrap_ttl : when set, the read is always response wrapped, with a wrapping TTL of at
+//                least this duration, so the value only travels inside a wrapping token
+//
+// The read and the delete are done under the lock of the share, and the value is only
+// returned once the delete succeeded.  Expired shares are purged by the periodic function.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/wrapping"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Storage prefix for the shares
+const shareStoragePrefix = "share/"
+
+// Default time a share can be read: 7 days
+const defaultShareTTL = 7 * 24 * 60 * 60
+
+// shareEntry is the storage entry for a share
+type shareEntry struct {
+	Data        map[string]interface{} `json:"data"`
+	CreatedTime time.Time              `json:"created_time"`
+	ExpiresAt   time.Time              `json:"expires_at"`
+	MinWrapTTL  time.Duration          `json:"min_wrap_ttl"`
+}
+
+// sharePaths returns the path of the shares.
+func (b *scalesecSecretStoreBackend) sharePaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.sharePaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "share/" + framework.MatchAllRegex("path"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"path": {
+					Type:        framework.TypeString,
+					Description: "Path of the share.",
+				},
+				"data": {
+					Type:        framework.TypeMap,
+					Description: "Key value pairs of the value to share.",
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Default:     defaultShareTTL,
+					Description: "How long the share can be read before it is dropped.  Defaults to 168h.",
+				},
+				"min_wrap_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "When set the read is always response wrapped with at least this wrapping TTL.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleShareWrite,
+					Summary:  "Store a value that can be read once.",
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleShareRead,
+					Summary:  "Read the value of the share and delete it.",
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.handleShareDelete,
+					Summary:  "Delete the share without reading it.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.sharePaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// handleShareWrite: Store a value that can be read once
+//
+// GOAL:  	Store the share unless there is already one at the path that was not read
+// Return:
+// 			*logical.Response := when the share expires or an error response if it is invalid
+// 			error := Error with details if the write failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleShareWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleShareWrite:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleShareWrite:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	path := data.Get("path").(string)
+	shareData := data.Get("data").(map[string]interface{})
+	if len(shareData) == 0 {
+		return logical.ErrorResponse("data must be provided"), nil
+	}
+	ttl := time.Duration(data.Get("ttl").(int)) * time.Second
+	if ttl <= 0 {
+		return logical.ErrorResponse("ttl must be positive"), nil
+	}
+	minWrapTTL := time.Duration(data.Get("min_wrap_ttl").(int)) * time.Second
+	if minWrapTTL < 0 {
+		return logical.ErrorResponse("min_wrap_ttl must not be negative"), nil
+	}
+
+	lock := locksutil.LockForKey(b.secretLocks, shareStoragePrefix+path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	now := b.now()
+	current, err := b.getShare(ctx, req.Storage, path)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleShareWrite:-> Leaving with error")
+		return nil, err
+	}
+	if current != nil && now.Before(current.ExpiresAt) {
+		b.Logger().Debug("scalesecSecretStore.handleShareWrite:-> Leaving share exists")
+		return logical.ErrorResponse("share %q was not read yet, delete it first to replace it", path), nil
+	}
+
+	entry := &shareEntry{
+		Data:        shareData,
+		CreatedTime: now,
+		ExpiresAt:   now.Add(ttl),
+		MinWrapTTL:  minWrapTTL,
+	}
+	storageEntry, err := logical.StorageEntryJSON(shareStoragePrefix+path, entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, storageEntry); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleShareWrite:-> Leaving with error")
+		return nil, fmt.Errorf("storing share failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleShareWrite:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"expires_at":   entry.ExpiresAt.Format(time.RFC3339Nano),
+			"min_wrap_ttl": int64(minWrapTTL.Seconds()),
+		},
+	}, nil
+}
+
+// ============================================================================================
+// handleShareRead: Read the value of the share and delete it
+//
+// GOAL:  	Return the value once: it is deleted before it is returned
+// Return:
+// 			*logical.Response := the value, wrapped if the share requires it, or nil if there is no share
+// 			error := Error with details if the read or the delete failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleShareRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleShareRead:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleShareRead:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	path := data.Get("path").(string)
+
+	lock := locksutil.LockForKey(b.secretLocks, shareStoragePrefix+path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, err := b.getShare(ctx, req.Storage, path)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleShareRead:-> Leaving with error")
+		return nil, err
+	}
+	if entry == nil {
+		b.Logger().Debug("scalesecSecretStore.handleShareRead:-> Leaving no share")
+		return nil, nil
+	}
+
+	// the value is only returned once nobody else can read it
+	if err := req.Storage.Delete(ctx, shareStoragePrefix+path); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleShareRead:-> Leaving with error")
+		return nil, fmt.Errorf("deleting share failed: %w", err)
+	}
+	if !b.now().Before(entry.ExpiresAt) {
+		b.Logger().Debug("scalesecSecretStore.handleShareRead:-> Leaving share expired")
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: entry.Data,
+	}
+	if entry.MinWrapTTL > 0 {
+		wrapTTL := entry.MinWrapTTL
+		if req.WrapInfo != nil && req.WrapInfo.TTL > wrapTTL {
+			wrapTTL = req.WrapInfo.TTL
+		}
+		resp.WrapInfo = &wrapping.ResponseWrapInfo{TTL: wrapTTL}
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleShareRead:-> Leaving")
+	return resp, nil
+}
+
+// ============================================================================================
+// handleShareDelete: Delete the share without reading it
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleShareDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleShareDelete:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleShareDelete:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	path := data.Get("path").(string)
+
+	lock := locksutil.LockForKey(b.secretLocks, shareStoragePrefix+path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := req.Storage.Delete(ctx, shareStoragePrefix+path); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleShareDelete:-> Leaving with error")
+		return nil, fmt.Errorf("deleting share failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleShareDelete:-> Leaving")
+	return nil, nil
+}
+
+// getShare reads the share at path.  Returns nil if there is none.
+func (b *scalesecSecretStoreBackend) getShare(ctx context.Context, s logical.Storage, path string) (*shareEntry, error) {
+	storageEntry, err := s.Get(ctx, shareStoragePrefix+path)
+	if err != nil {
+		return nil, fmt.Errorf("reading share failed: %w", err)
+	}
+	if storageEntry == nil {
+		return nil, nil
+	}
+
+	var entry shareEntry
+	if err := storageEntry.DecodeJSON(&entry); err != nil {
+		return nil, fmt.Errorf("decoding share %q failed: %w", path, err)
+	}
+	return &entry, nil
+}
+
+// purgeExpiredShares deletes the shares that expired without being read.  Called by the
+// periodic function.
+func (b *scalesecSecretStoreBackend) purgeExpiredShares(ctx context.Context, s logical.Storage) error {
+	paths, err := logical.CollectKeysWithPrefix(ctx, logical.NewStorageView(s, shareStoragePrefix), "")
+	if err != nil {
+		return fmt.Errorf("listing shares failed: %w", err)
+	}
+
+	now := b.now()
+	for _, path := range paths {
+		if err := b.purgeShare(ctx, s, path, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeShare deletes the share at path if it expired before now
+func (b *scalesecSecretStoreBackend) purgeShare(ctx context.Context, s logical.Storage, path string, now time.Time) error {
+	lock := locksutil.LockForKey(b.secretLocks, shareStoragePrefix+path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, err := b.getShare(ctx, s, path)
+	if err != nil || entry == nil || now.Before(entry.ExpiresAt) {
+		return err
+	}
+	if err := s.Delete(ctx, shareStoragePrefix+path); err != nil {
+		return fmt.Errorf("purging share %q failed: %w", path, err)
+	}
+	return nil
+}
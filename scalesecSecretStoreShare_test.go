@@ -0,0 +1,146 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// A share is read once
+func TestShareReadOnce(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "share/vendor/acme", map[string]interface{}{
+		"data": map[string]interface{}{"api_key": "k1"},
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+	assert.NotEmpty(t, response.Data["expires_at"])
+
+	// an unread share can not be replaced
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "share/vendor/acme", map[string]interface{}{
+		"data": map[string]interface{}{"api_key": "k2"},
+	})
+	assert.True(t, response.IsError())
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "share/vendor/acme", nil)
+	assert.Equal(t, "k1", response.Data["api_key"])
+	assert.Nil(t, response.WrapInfo)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "share/vendor/acme", nil)
+	assert.Nil(t, response, "the share is gone after the first read")
+
+	// the share is not a secret of the mount
+	response = sendRequest(t, b, storage, logical.ReadOperation, "vendor/acme", nil)
+	assert.Nil(t, response)
+}
+
+// Concurrent reads: only one gets the value
+func TestShareConcurrentReads(t *testing.T) {
+
+	b, storage := getBackend(t)
+	sendRequest(t, b, storage, logical.UpdateOperation, "share/vendor/acme", map[string]interface{}{
+		"data": map[string]interface{}{"api_key": "k1"},
+	})
+
+	var got int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation:   logical.ReadOperation,
+				Path:        "share/vendor/acme",
+				Storage:     storage,
+				ClientToken: "test_token",
+			})
+			assert.Nil(t, err)
+			if response != nil {
+				atomic.AddInt64(&got, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), got)
+}
+
+// min_wrap_ttl forces the response wrapping with at least that TTL
+func TestShareForcedWrapping(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	for _, path := range []string{"share/a", "share/b"} {
+		sendRequest(t, b, storage, logical.UpdateOperation, path, map[string]interface{}{
+			"data":         map[string]interface{}{"api_key": "k1"},
+			"min_wrap_ttl": "1h",
+		})
+	}
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "share/a", nil)
+	assert.Equal(t, time.Hour, response.WrapInfo.TTL)
+
+	// a longer wrapping TTL asked by the caller is kept, a shorter one is raised
+	response, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation:   logical.ReadOperation,
+		Path:        "share/b",
+		Storage:     storage,
+		ClientToken: "test_token",
+		WrapInfo:    &logical.RequestWrapInfo{TTL: 2 * time.Hour},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Hour, response.WrapInfo.TTL)
+}
+
+// An expired share is not returned and is purged by the periodic function
+func TestShareExpiry(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	for _, path := range []string{"share/a", "share/b"} {
+		sendRequest(t, b, storage, logical.UpdateOperation, path, map[string]interface{}{
+			"data": map[string]interface{}{"api_key": "k1"},
+			"ttl":  "1h",
+		})
+	}
+
+	now = now.Add(2 * time.Hour)
+	response := sendRequest(t, b, storage, logical.ReadOperation, "share/a", nil)
+	assert.Nil(t, response)
+
+	runPeriodic(t, b, storage)
+	keys, err := storage.List(context.Background(), shareStoragePrefix)
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+
+	// an expired share can be replaced
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "share/b", map[string]interface{}{
+		"data": map[string]interface{}{"api_key": "k2"},
+	})
+	assert.False(t, response.IsError(), "Response message %v", response)
+}
+
+// A share can be deleted unread and needs data
+func TestShareDeleteAndInvalid(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "share/a", nil)
+	assert.True(t, response.IsError())
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "share/a", map[string]interface{}{
+		"data": map[string]interface{}{"api_key": "k1"},
+	})
+	sendRequest(t, b, storage, logical.DeleteOperation, "share/a", nil)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "share/a", nil)
+	assert.Nil(t, response)
+}
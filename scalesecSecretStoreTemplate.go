@@ -0,0 +1,328 @@
+// ********************************************************************************
+// Templated composite secrets
+//
+// A secret value can be a Go template that references other secrets in the mount.  For
+// example a JDBC URL built from the entries of the db secret:
+//
+//   vault write scalesecsecrets/app/jdbc \
+//     url='jdbc:postgresql://{{ secret "db" "host" }}/app?user={{ secret "db" "user" }}&password={{ secret "db" "password" }}'
+//
+// The value is stored as written.  It is only rendered when read with render=true:
+//
+//   vault read scalesecsecrets/app/jdbc render=true
+//
+// The plugin can read any path in its own storage so rendering must not be a way around
+// the Vault policies.  Every referenced path is checked against the capabilities of the
+// caller's token before it is read.  Vault only gives the plugin a salted copy of the
+// caller's token, so the check is made with sys/capabilities-accessor and the accessor of
+// the caller's token, using a token owned by the plugin that is set in the config:
+//
+//   vault policy write scalesec-access-check - <<EOF
+//   path "sys/capabilities-accessor" { capabilities = ["update"] }
+//   EOF
+//   vault write scalesecsecrets/config \
+//     access_check_token=$(vault token create -orphan -period=768h -policy=scalesec-access-check -field=token)
+//
+// In a Vault Enterprise namespace the check is made in the namespace of the request.  Vault
+// only gives its namespace to the plugin in the header, so the mount must pass it:
+//
+//   vault secrets tune -passthrough-request-headers=X-Vault-Namespace scalesecsecrets/
+//
+// Referenced secrets that are templates themselves are rendered too; a reference back to a
+// secret that is being rendered is an error (cycle).  An expired referenced secret is
+// handled like a read of it: a warning or an error depending on expired_read.  A template
+// that can not be rendered (a cycle, a missing reference or key) is an error response, a
+// failure to read the storage or the capabilities is an error.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// accessChecker returns the capabilities the caller of a request has on another path of the
+// mount.  It is used where one request reads or changes many secrets: templates, batches and
+// imports.
+type accessChecker interface {
+	Capabilities(ctx context.Context, req *logical.Request, path string) ([]string, error)
+}
+
+// canAccess reports if the caller of the request has one of the capabilities on the path.
+// root allows everything.
+func (b *scalesecSecretStoreBackend) canAccess(ctx context.Context, req *logical.Request, path string, capabilities ...string) (bool, error) {
+	granted, err := b.accessChecker.Capabilities(ctx, req, path)
+	if err != nil {
+		return false, err
+	}
+	return hasCapability(granted, capabilities...), nil
+}
+
+// hasCapability reports if the granted capabilities have one of the capabilities.  root
+// allows everything.
+func hasCapability(granted []string, capabilities ...string) bool {
+	if strutil.StrListContains(granted, "root") {
+		return true
+	}
+	for _, capability := range capabilities {
+		if strutil.StrListContains(granted, capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// vaultAccessChecker asks Vault for the capabilities of the caller's token on the path.
+// This is the same check Vault does when the caller reads the path directly.
+type vaultAccessChecker struct {
+	// Address of the Vault API.  Empty uses VAULT_ADDR from the environment.
+	address string
+
+	// token returns the token of the plugin used to call Vault
+	token func(ctx context.Context, s logical.Storage) (string, error)
+
+	// client is created on the first check and shared by the checks that follow
+	client     *api.Client
+	clientErr  error
+	clientOnce sync.Once
+}
+
+func newVaultAccessChecker(address string, token func(ctx context.Context, s logical.Storage) (string, error)) *vaultAccessChecker {
+	return &vaultAccessChecker{address: address, token: token}
+}
+
+// getClient returns the Vault client of the checker
+func (c *vaultAccessChecker) getClient() (*api.Client, error) {
+	c.clientOnce.Do(func() {
+		config := api.DefaultConfig()
+		if config.Error != nil {
+			c.clientErr = config.Error
+			return
+		}
+		if c.address != "" {
+			config.Address = c.address
+		}
+
+		c.client, c.clientErr = api.NewClient(config)
+		if c.clientErr != nil {
+			c.clientErr = fmt.Errorf("creating vault client failed: %w", c.clientErr)
+		}
+	})
+	return c.client, c.clientErr
+}
+
+// Capabilities calls sys/capabilities-accessor with the accessor of the caller's token
+func (c *vaultAccessChecker) Capabilities(ctx context.Context, req *logical.Request, path string) ([]string, error) {
+	if req.ClientTokenAccessor == "" {
+		return nil, fmt.Errorf("the request has no token accessor to check the access of the caller")
+	}
+
+	token, err := c.token(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, fmt.Errorf("access_check_token must be set in the config to check the access of the caller")
+	}
+
+	client, err := c.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// the request carries its own token so the shared client is not changed
+	request := client.NewRequest(http.MethodPost, "/v1/sys/capabilities-accessor")
+	request.ClientToken = token
+	if namespace := requestHeader(req, consts.NamespaceHeaderName); namespace != "" {
+		if request.Headers == nil {
+			request.Headers = http.Header{}
+		}
+		request.Headers.Set(consts.NamespaceHeaderName, namespace)
+	}
+	if err := request.SetJSONBody(map[string]interface{}{
+		"accessor": req.ClientTokenAccessor,
+		"paths":    []string{req.MountPoint + path},
+	}); err != nil {
+		return nil, err
+	}
+
+	response, err := client.RawRequestWithContext(ctx, request)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading capabilities failed: %w", err)
+	}
+
+	secret, err := api.ParseSecret(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading capabilities failed: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("reading capabilities failed: empty response")
+	}
+
+	var capabilities []string
+	if raw, ok := secret.Data["capabilities"].([]interface{}); ok {
+		for _, capability := range raw {
+			capabilities = append(capabilities, fmt.Sprint(capability))
+		}
+	}
+	return capabilities, nil
+}
+
+// requestHeader returns the first value of the header of the request, or "" if vault did
+// not pass it to the plugin
+func requestHeader(req *logical.Request, name string) string {
+	for header, values := range req.Headers {
+		if strings.EqualFold(header, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// templateError is returned when a template can not be rendered because of what it holds:
+// a cycle, a missing reference or key, an expired reference.  The other render errors are
+// failures of the storage or of the access check.
+type templateError struct {
+	message string
+}
+
+func (e *templateError) Error() string {
+	return e.message
+}
+
+// isTemplate reports if a secret value needs to be rendered
+func isTemplate(value interface{}) bool {
+	s, ok := value.(string)
+	return ok && strings.Contains(s, "{{")
+}
+
+// renderSecret renders the template values of the secret at path.  Values that are not
+// templates are returned unchanged.  stack holds the paths that are being rendered and is
+// used to detect cycles.  The warnings are about the referenced secrets IE: expired ones.
+func (b *scalesecSecretStoreBackend) renderSecret(ctx context.Context, req *logical.Request, path string, data map[string]interface{}, stack []string) (map[string]interface{}, []string, error) {
+	path = strings.Trim(path, "/")
+	if strutil.StrListContains(stack, path) {
+		return nil, nil, &templateError{fmt.Sprintf("template cycle detected: %s -> %s", strings.Join(stack, " -> "), path)}
+	}
+	stack = append(stack, path)
+
+	// The referenced secrets are only read once per render
+	rendered := map[string]map[string]interface{}{}
+	var warnings []string
+
+	// failure is the error of a reference that is not about the template, so it is not
+	// reported as one
+	var failure error
+
+	funcs := template.FuncMap{
+		"secret": func(ref string, key string) (string, error) {
+			ref = strings.Trim(ref, "/")
+
+			refData, ok := rendered[ref]
+			if !ok {
+				var refWarnings []string
+				var err error
+				refData, refWarnings, err = b.renderReference(ctx, req, ref, stack)
+				if err != nil {
+					var templateErr *templateError
+					if !errors.As(err, &templateErr) && !errors.Is(err, logical.ErrPermissionDenied) {
+						failure = err
+					}
+					return "", err
+				}
+				rendered[ref] = refData
+				warnings = append(warnings, refWarnings...)
+			}
+
+			value, ok := refData[key]
+			if !ok {
+				return "", &templateError{fmt.Sprintf("secret %q does not have key %q", ref, key)}
+			}
+			return fmt.Sprint(value), nil
+		},
+	}
+
+	result := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		if !isTemplate(value) {
+			result[key] = value
+			continue
+		}
+
+		tmpl, err := template.New(key).Option("missingkey=error").Funcs(funcs).Parse(value.(string))
+		if err != nil {
+			return nil, nil, &templateError{fmt.Sprintf("parsing template %q of %q failed: %s", key, path, err)}
+		}
+
+		var out strings.Builder
+		if err := tmpl.Execute(&out, nil); err != nil {
+			if failure != nil {
+				return nil, nil, failure
+			}
+			if errors.Is(err, logical.ErrPermissionDenied) {
+				return nil, nil, fmt.Errorf("rendering template %q of %q failed: %w", key, path, err)
+			}
+			return nil, nil, &templateError{fmt.Sprintf("rendering template %q of %q failed: %s", key, path, err)}
+		}
+		result[key] = out.String()
+	}
+
+	return result, warnings, nil
+}
+
+// renderReference checks the caller can read the referenced secret, then reads and renders it
+func (b *scalesecSecretStoreBackend) renderReference(ctx context.Context, req *logical.Request, ref string, stack []string) (map[string]interface{}, []string, error) {
+	allowed, err := b.canAccess(ctx, req, ref, "read")
+	if err != nil {
+		return nil, nil, err
+	}
+	if !allowed {
+		return nil, nil, fmt.Errorf("permission denied reading %q: %w", ref, logical.ErrPermissionDenied)
+	}
+
+	secret, err := b.getSecret(ctx, req.Storage, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	if secret == nil {
+		return nil, nil, &templateError{fmt.Sprintf("referenced secret %q does not exist", ref)}
+	}
+
+	// an expired secret is handled like a read of it
+	expiryWarning, rejectExpired, err := b.checkExpiry(ctx, req.Storage, ref, secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rejectExpired {
+		return nil, nil, &templateError{"referenced " + expiryWarning}
+	}
+
+	// the caller only gets the fields of the referenced secret the field ACL allows
+	refData, _, err := b.redactFields(ctx, req, ref, secret.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rendered, warnings, err := b.renderSecret(ctx, req, ref, refData, stack)
+	if err != nil {
+		return nil, nil, err
+	}
+	if expiryWarning != "" {
+		warnings = append([]string{"referenced " + expiryWarning}, warnings...)
+	}
+	return rendered, warnings, nil
+}
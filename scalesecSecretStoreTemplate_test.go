@@ -0,0 +1,200 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// get a backend with the db secret and a jdbc secret that is a template referencing it
+func getTemplateBackend(t *testing.T, denied ...string) (logical.Backend, logical.Storage) {
+	b, storage := getBackend(t)
+
+	checker := b.(*scalesecSecretStoreBackend).accessChecker.(*staticAccessChecker)
+	for _, path := range denied {
+		checker.capabilities[path] = []string{"deny"}
+	}
+
+	sendRequest(t, b, storage, logical.CreateOperation, "db", map[string]interface{}{
+		"host":     "db.example.com",
+		"user":     "app",
+		"password": "s3cr3t",
+	})
+	sendRequest(t, b, storage, logical.CreateOperation, "app/jdbc", map[string]interface{}{
+		"url":  `jdbc:postgresql://{{ secret "db" "host" }}/app?user={{ secret "db" "user" }}&password={{ secret "db" "password" }}`,
+		"pool": "10",
+	})
+	return b, storage
+}
+
+// vault read scalesecsecrets/app/jdbc render=true
+func TestTemplateRender(t *testing.T) {
+
+	b, storage := getTemplateBackend(t)
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "app/jdbc", map[string]interface{}{"render": "true"})
+	assert.Equal(t, "jdbc:postgresql://db.example.com/app?user=app&password=s3cr3t", response.Data["url"])
+	assert.Equal(t, "10", response.Data["pool"])
+
+	// without render the template is returned as written
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/jdbc", nil)
+	assert.Contains(t, response.Data["url"], `{{ secret "db" "host" }}`)
+}
+
+// A caller that can not read the referenced path can not read it through a template
+func TestTemplateRenderDenied(t *testing.T) {
+
+	b, storage := getTemplateBackend(t, "db")
+
+	request := &logical.Request{
+		Operation:   logical.ReadOperation,
+		Path:        "app/jdbc",
+		MountPoint:  MOUNT_POINT,
+		Storage:     storage,
+		ClientToken: "test_token",
+		Data:        map[string]interface{}{"render": true},
+	}
+
+	response, err := b.HandleRequest(context.Background(), request)
+	assert.Equal(t, logical.ErrPermissionDenied, err)
+	assert.Contains(t, response.Error().Error(), "permission denied reading")
+}
+
+func TestTemplateRenderCycle(t *testing.T) {
+
+	b, storage := getTemplateBackend(t)
+
+	sendRequest(t, b, storage, logical.CreateOperation, "a", map[string]interface{}{"value": `{{ secret "b" "value" }}`})
+	sendRequest(t, b, storage, logical.CreateOperation, "b", map[string]interface{}{"value": `{{ secret "a" "value" }}`})
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "a", map[string]interface{}{"render": true})
+	assert.True(t, response.IsError(), "cycle should be an error")
+	assert.Contains(t, response.Data["error"], "cycle")
+}
+
+// failingAccessChecker fails every check like a vault that can not be reached
+type failingAccessChecker struct{}
+
+func (failingAccessChecker) Capabilities(ctx context.Context, req *logical.Request, path string) ([]string, error) {
+	return nil, fmt.Errorf("connection refused")
+}
+
+// A template that can not be rendered is an error response, a failure to check or read a
+// reference is an error
+func TestTemplateRenderErrors(t *testing.T) {
+
+	b, storage := getTemplateBackend(t)
+	sendRequest(t, b, storage, logical.CreateOperation, "app/missing", map[string]interface{}{"url": `{{ secret "nothing" "host" }}`})
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "app/missing", map[string]interface{}{"render": true})
+	assert.True(t, response.IsError())
+	assert.Contains(t, response.Error().Error(), `referenced secret "nothing" does not exist`)
+
+	b.(*scalesecSecretStoreBackend).accessChecker = failingAccessChecker{}
+	response, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation:   logical.ReadOperation,
+		Path:        "app/jdbc",
+		MountPoint:  MOUNT_POINT,
+		Storage:     storage,
+		ClientToken: "test_token",
+		Data:        map[string]interface{}{"render": true},
+	})
+	assert.Nil(t, response)
+	assert.Contains(t, err.Error(), "connection refused")
+}
+
+// A referenced secret that expired is handled like a read of it
+func TestTemplateRenderExpired(t *testing.T) {
+
+	b, storage := getTemplateBackend(t)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "metadata/db", map[string]interface{}{"expires_at": "2021-01-02T00:00:00Z"})
+	now = now.Add(48 * time.Hour)
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "app/jdbc", map[string]interface{}{"render": true})
+	assert.Equal(t, "jdbc:postgresql://db.example.com/app?user=app&password=s3cr3t", response.Data["url"])
+	assert.Equal(t, []string{`referenced secret "db" expired at 2021-01-02T00:00:00Z`}, response.Warnings)
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"expired_read": "fail"})
+	response = sendRequest(t, b, storage, logical.ReadOperation, "app/jdbc", map[string]interface{}{"render": true})
+	assert.True(t, response.IsError())
+	assert.Contains(t, response.Error().Error(), `referenced secret "db" expired`)
+	assert.NotContains(t, response.Data, "url")
+}
+
+// The vault access checker asks vault for the capabilities of the caller's token by its
+// accessor, with the token of the plugin
+func TestVaultAccessChecker(t *testing.T) {
+
+	requests := 0
+	namespace := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		namespace = r.Header.Get("X-Vault-Namespace")
+		assert.Equal(t, "/v1/sys/capabilities-accessor", r.URL.Path)
+		assert.Equal(t, "plugin_token", r.Header.Get("X-Vault-Token"))
+
+		var body struct {
+			Accessor string   `json:"accessor"`
+			Paths    []string `json:"paths"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		assert.Equal(t, "caller_accessor", body.Accessor)
+		path := body.Paths[0]
+
+		capabilities := []string{"deny"}
+		if path == MOUNT_POINT+"db" {
+			capabilities = []string{"read", "list"}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"capabilities": capabilities,
+				path:           capabilities,
+			},
+		})
+	}))
+	defer server.Close()
+
+	token := ""
+	checker := newVaultAccessChecker(server.URL, func(ctx context.Context, s logical.Storage) (string, error) {
+		return token, nil
+	})
+	req := &logical.Request{MountPoint: MOUNT_POINT, ClientToken: "salted_token", ClientTokenAccessor: "caller_accessor"}
+
+	// without the token of the plugin the access can not be checked
+	_, err := checker.Capabilities(context.Background(), req, "db")
+	assert.Contains(t, err.Error(), "access_check_token")
+	assert.Equal(t, 0, requests)
+
+	token = "plugin_token"
+	capabilities, err := checker.Capabilities(context.Background(), req, "db")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"read", "list"}, capabilities)
+	client := checker.client
+
+	capabilities, err = checker.Capabilities(context.Background(), req, "other")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"deny"}, capabilities)
+	assert.Same(t, client, checker.client, "the client is created once")
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, "", namespace)
+
+	// the check is made in the namespace of the request
+	req.Headers = map[string][]string{"X-Vault-Namespace": {"team-a/"}}
+	_, err = checker.Capabilities(context.Background(), req, "db")
+	assert.Nil(t, err)
+	assert.Equal(t, "team-a/", namespace)
+
+	_, err = checker.Capabilities(context.Background(), &logical.Request{MountPoint: MOUNT_POINT, ClientToken: "salted_token"}, "db")
+	assert.Contains(t, err.Error(), "no token accessor")
+}
@@ -0,0 +1,574 @@
+// ********************************************************************************
+// TOTP support for the ScaleSec Secret Store
+//
+// Shared service accounts that are protected by MFA can have their TOTP seed stored
+// in the plugin so that generating a code is gated by Vault policy like any other secret.
+//
+// totp/keys/<name>  : create (generate=true) or import (url or key) a seed; read; delete; list
+// totp/code/<name>  : read to generate the current code; write code=<code> to validate it
+//
+// Validation allows for clock skew and rejects a code that was already used (replay
+// protection).  Used codes are persisted in the key entry until they can no longer be valid.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"image/png"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	otplib "github.com/pquerna/otp"
+	totplib "github.com/pquerna/otp/totp"
+)
+
+// Storage prefix for the TOTP keys.  Kept separate from the secret data.
+const totpKeyStoragePrefix = "totp/keys/"
+
+// totpKey is the storage entry for a TOTP seed
+type totpKey struct {
+	Issuer      string `json:"issuer"`
+	AccountName string `json:"account_name"`
+	Key         string `json:"key"`
+	Period      uint   `json:"period"`
+	Algorithm   string `json:"algorithm"`
+	Digits      int    `json:"digits"`
+	Skew        uint   `json:"skew"`
+
+	// UsedCodes maps a code that was successfully validated to the unix time after which it
+	// can no longer be valid and may be forgotten.
+	UsedCodes map[string]int64 `json:"used_codes,omitempty"`
+}
+
+// validateOpts converts the stored key settings to the options used by the totp library
+func (k *totpKey) validateOpts() totplib.ValidateOpts {
+	return totplib.ValidateOpts{
+		Period:    k.Period,
+		Skew:      k.Skew,
+		Digits:    otplib.Digits(k.Digits),
+		Algorithm: totpAlgorithm(k.Algorithm),
+	}
+}
+
+// totpAlgorithm maps the algorithm name to the totp library value.  Names are validated on write.
+func totpAlgorithm(name string) otplib.Algorithm {
+	switch strings.ToUpper(name) {
+	case "SHA256":
+		return otplib.AlgorithmSHA256
+	case "SHA512":
+		return otplib.AlgorithmSHA512
+	default:
+		return otplib.AlgorithmSHA1
+	}
+}
+
+// totpPaths returns the paths for the TOTP keys and codes.
+func (b *scalesecSecretStoreBackend) totpPaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.totpPaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "totp/keys/?$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.handleTotpKeyList,
+					Summary:  "Lists the TOTP keys.",
+				},
+			},
+		},
+		{
+			Pattern: "totp/keys/" + framework.GenericNameRegex("name"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the TOTP key.",
+				},
+				"generate": {
+					Type:        framework.TypeBool,
+					Default:     false,
+					Description: "Generate a new seed.  If false then url or key must be provided to import a seed.",
+				},
+				"url": {
+					Type:        framework.TypeString,
+					Description: "otpauth:// URL of the seed to import.",
+				},
+				"key": {
+					Type:        framework.TypeString,
+					Description: "Base32 encoded seed to import.",
+				},
+				"issuer": {
+					Type:        framework.TypeString,
+					Description: "Name of the issuing organization.  Required when generating.",
+				},
+				"account_name": {
+					Type:        framework.TypeString,
+					Description: "Name of the account.  Required when generating.",
+				},
+				"period": {
+					Type:        framework.TypeDurationSecond,
+					Default:     30,
+					Description: "Length of time a code is valid.",
+				},
+				"algorithm": {
+					Type:        framework.TypeString,
+					Default:     "SHA1",
+					Description: "Hash algorithm: SHA1, SHA256 or SHA512.",
+				},
+				"digits": {
+					Type:        framework.TypeInt,
+					Default:     6,
+					Description: "Number of digits in a code: 6 or 8.",
+				},
+				"skew": {
+					Type:        framework.TypeInt,
+					Default:     1,
+					Description: "Number of periods before and after the current one a code is accepted for: 0 or 1.",
+				},
+				"key_size": {
+					Type:        framework.TypeInt,
+					Default:     20,
+					Description: "Size in bytes of a generated seed.",
+				},
+				"qr_size": {
+					Type:        framework.TypeInt,
+					Default:     200,
+					Description: "Width and height in pixels of the PNG QR code returned when generating.  0 to disable.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleTotpKeyRead,
+					Summary:  "Read the settings of a TOTP key.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleTotpKeyWrite,
+					Summary:  "Create or import a TOTP key.",
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.handleTotpKeyDelete,
+					Summary:  "Delete a TOTP key.",
+				},
+			},
+		},
+		{
+			Pattern: "totp/code/" + framework.GenericNameRegex("name"),
+
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the TOTP key.",
+				},
+				"code": {
+					Type:        framework.TypeString,
+					Description: "Code to validate.",
+				},
+			},
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleTotpCodeRead,
+					Summary:  "Generate the current code for a TOTP key.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.handleTotpCodeValidate,
+					Summary:  "Validate a code for a TOTP key.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.totpPaths(): -> Leaving")
+	return frameworkPath
+}
+
+// getTotpKey reads the named key from storage.  Returns nil if the key does not exist.
+func (b *scalesecSecretStoreBackend) getTotpKey(ctx context.Context, s logical.Storage, name string) (*totpKey, error) {
+	entry, err := s.Get(ctx, totpKeyStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var key totpKey
+	if err := entry.DecodeJSON(&key); err != nil {
+		return nil, fmt.Errorf("decoding totp key %q failed: %w", name, err)
+	}
+	return &key, nil
+}
+
+// putTotpKey writes the key to storage
+func (b *scalesecSecretStoreBackend) putTotpKey(ctx context.Context, s logical.Storage, name string, key *totpKey) error {
+	entry, err := logical.StorageEntryJSON(totpKeyStoragePrefix+name, key)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// ============================================================================================
+// handleTotpKeyWrite: Create or import a TOTP key
+//
+// GOAL:  	Generate a new seed or import an existing one from an otpauth URL or base32 key
+// Return:
+// 			*logical.Response := The seed as an otpauth URL and a base64 PNG QR code when generated
+// 			error := Error with details if the key could not be stored
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleTotpKeyWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleTotpKeyWrite:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleTotpKeyWrite:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	name := data.Get("name").(string)
+	generate := data.Get("generate").(bool)
+	keyURL := data.Get("url").(string)
+	keyString := data.Get("key").(string)
+
+	key := &totpKey{
+		Issuer:      data.Get("issuer").(string),
+		AccountName: data.Get("account_name").(string),
+		Period:      uint(data.Get("period").(int)),
+		Algorithm:   strings.ToUpper(data.Get("algorithm").(string)),
+		Digits:      data.Get("digits").(int),
+		Skew:        uint(data.Get("skew").(int)),
+	}
+
+	// An imported URL carries its own settings which take the place of the field values
+	if !generate && keyURL != "" {
+		imported, err := parseTotpURL(keyURL)
+		if err != nil {
+			return logical.ErrorResponse("invalid url: %s", err), nil
+		}
+		imported.Skew = key.Skew
+		key = imported
+	}
+
+	switch key.Algorithm {
+	case "SHA1", "SHA256", "SHA512":
+	default:
+		return logical.ErrorResponse("algorithm must be SHA1, SHA256 or SHA512"), nil
+	}
+	if key.Digits != 6 && key.Digits != 8 {
+		return logical.ErrorResponse("digits must be 6 or 8"), nil
+	}
+	if key.Skew > 1 {
+		return logical.ErrorResponse("skew must be 0 or 1"), nil
+	}
+	if key.Period == 0 {
+		return logical.ErrorResponse("period must be greater than 0"), nil
+	}
+
+	var resp *logical.Response
+
+	switch {
+	case generate:
+		if keyURL != "" || keyString != "" {
+			return logical.ErrorResponse("url and key can not be provided when generate is true"), nil
+		}
+		if key.Issuer == "" || key.AccountName == "" {
+			return logical.ErrorResponse("issuer and account_name are required when generate is true"), nil
+		}
+		keySize := data.Get("key_size").(int)
+		if keySize <= 0 {
+			return logical.ErrorResponse("key_size must be greater than 0"), nil
+		}
+
+		generated, err := totplib.Generate(totplib.GenerateOpts{
+			Issuer:      key.Issuer,
+			AccountName: key.AccountName,
+			Period:      key.Period,
+			SecretSize:  uint(keySize),
+			Digits:      otplib.Digits(key.Digits),
+			Algorithm:   totpAlgorithm(key.Algorithm),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("generating totp key failed: %w", err)
+		}
+		key.Key = generated.Secret()
+
+		resp = &logical.Response{
+			Data: map[string]interface{}{
+				"url": generated.URL(),
+			},
+		}
+
+		if qrSize := data.Get("qr_size").(int); qrSize > 0 {
+			barcode, err := generated.Image(qrSize, qrSize)
+			if err != nil {
+				return nil, fmt.Errorf("generating qr code failed: %w", err)
+			}
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, barcode); err != nil {
+				return nil, fmt.Errorf("encoding qr code failed: %w", err)
+			}
+			resp.Data["barcode"] = base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+
+	case keyURL != "":
+		// settings were taken from the url above
+
+	case keyString != "":
+		keyString = strings.ToUpper(strings.TrimRight(keyString, "="))
+		if _, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(keyString); err != nil {
+			return logical.ErrorResponse("key must be base32 encoded"), nil
+		}
+		key.Key = keyString
+
+	default:
+		return logical.ErrorResponse("url or key must be provided when generate is false"), nil
+	}
+
+	if err := b.putTotpKey(ctx, req.Storage, name, key); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleTotpKeyWrite:-> Leaving with error")
+		return nil, fmt.Errorf("storing totp key failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleTotpKeyWrite:-> Leaving")
+	return resp, nil
+}
+
+// parseTotpURL reads the seed and settings out of an otpauth:// URL
+func parseTotpURL(keyURL string) (*totpKey, error) {
+	parsed, err := otplib.NewKeyFromURL(keyURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Type() != "totp" {
+		return nil, fmt.Errorf("url is not for a totp key")
+	}
+	if parsed.Secret() == "" {
+		return nil, fmt.Errorf("url does not contain a secret")
+	}
+
+	// The library does not expose digits and algorithm so read them from the query
+	u, err := url.Parse(keyURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+
+	key := &totpKey{
+		Issuer:      parsed.Issuer(),
+		AccountName: parsed.AccountName(),
+		Key:         strings.ToUpper(parsed.Secret()),
+		Period:      uint(parsed.Period()),
+		Algorithm:   "SHA1",
+		Digits:      6,
+	}
+	if algorithm := query.Get("algorithm"); algorithm != "" {
+		key.Algorithm = strings.ToUpper(algorithm)
+	}
+	if digits := query.Get("digits"); digits != "" {
+		key.Digits, err = strconv.Atoi(digits)
+		if err != nil {
+			return nil, fmt.Errorf("digits is not a number")
+		}
+	}
+	return key, nil
+}
+
+// ============================================================================================
+// handleTotpKeyRead: Read the settings of a TOTP key
+//
+// GOAL:  	Return the settings of the key.  The seed itself is never returned.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleTotpKeyRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleTotpKeyRead:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleTotpKeyRead:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	key, err := b.getTotpKey(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		b.Logger().Debug("scalesecSecretStore.handleTotpKeyRead:-> Leaving key not found")
+		return nil, nil
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleTotpKeyRead:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"issuer":       key.Issuer,
+			"account_name": key.AccountName,
+			"period":       key.Period,
+			"algorithm":    key.Algorithm,
+			"digits":       key.Digits,
+			"skew":         key.Skew,
+		},
+	}, nil
+}
+
+// ============================================================================================
+// handleTotpKeyDelete: Delete a TOTP key
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleTotpKeyDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleTotpKeyDelete:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleTotpKeyDelete:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	if err := req.Storage.Delete(ctx, totpKeyStoragePrefix+data.Get("name").(string)); err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleTotpKeyDelete:-> Leaving with error")
+		return nil, fmt.Errorf("deleting totp key failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleTotpKeyDelete:-> Leaving")
+	return nil, nil
+}
+
+// ============================================================================================
+// handleTotpKeyList: List the TOTP keys
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleTotpKeyList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleTotpKeyList:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleTotpKeyList:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	keys, err := req.Storage.List(ctx, totpKeyStoragePrefix)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleTotpKeyList:-> Leaving with error")
+		return nil, fmt.Errorf("listing totp keys failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleTotpKeyList:-> Leaving")
+	return logical.ListResponse(keys), nil
+}
+
+// ============================================================================================
+// handleTotpCodeRead: Generate the current code
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleTotpCodeRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleTotpCodeRead:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleTotpCodeRead:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	name := data.Get("name").(string)
+	key, err := b.getTotpKey(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return logical.ErrorResponse("unknown key: %s", name), nil
+	}
+
+	code, err := totplib.GenerateCodeCustom(key.Key, b.now(), key.validateOpts())
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleTotpCodeRead:-> Leaving with error")
+		return nil, fmt.Errorf("generating code failed: %w", err)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleTotpCodeRead:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"code": code,
+		},
+	}, nil
+}
+
+// ============================================================================================
+// handleTotpCodeValidate: Validate a code
+//
+// GOAL:  	Check the code against the key allowing for the configured skew.  A code that was
+// 			already accepted is rejected until it can no longer be valid.
+// Return:
+// 			*logical.Response := valid=true/false
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleTotpCodeValidate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleTotpCodeValidate:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleTotpCodeValidate:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	name := data.Get("name").(string)
+	code := data.Get("code").(string)
+	if code == "" {
+		return logical.ErrorResponse("code must be provided"), nil
+	}
+
+	// The read, check and update of the used codes has to be atomic or two requests could
+	// both accept the same code.
+	b.totpLock.Lock()
+	defer b.totpLock.Unlock()
+
+	key, err := b.getTotpKey(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return logical.ErrorResponse("unknown key: %s", name), nil
+	}
+
+	now := b.now()
+
+	// forget the codes that can no longer be valid
+	for usedCode, expiry := range key.UsedCodes {
+		if now.Unix() > expiry {
+			delete(key.UsedCodes, usedCode)
+		}
+	}
+
+	if _, used := key.UsedCodes[code]; used {
+		b.Logger().Debug("scalesecSecretStore.handleTotpCodeValidate:-> Leaving code already used")
+		return logical.ErrorResponse("code already used; wait until the next time period"), nil
+	}
+
+	valid, err := totplib.ValidateCustom(code, key.Key, now, key.validateOpts())
+	if err != nil && err != otplib.ErrValidateInputInvalidLength {
+		return nil, fmt.Errorf("validating code failed: %w", err)
+	}
+
+	if valid {
+		// A code is accepted for skew periods either side of the one it was generated in
+		if key.UsedCodes == nil {
+			key.UsedCodes = map[string]int64{}
+		}
+		key.UsedCodes[code] = now.Add(time.Duration((key.Skew+1)*key.Period) * time.Second).Unix()
+		if err := b.putTotpKey(ctx, req.Storage, name, key); err != nil {
+			return nil, fmt.Errorf("storing used code failed: %w", err)
+		}
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleTotpCodeValidate:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"valid": valid,
+		},
+	}, nil
+}
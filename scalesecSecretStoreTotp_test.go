@@ -0,0 +1,105 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	totplib "github.com/pquerna/otp/totp"
+)
+
+const TOTP_URL = "otpauth://totp/ScaleSec:svc-account?secret=JBSWY3DPEHPK3PXP&issuer=ScaleSec&algorithm=SHA1&digits=6&period=30"
+
+// vault write scalesecsecrets/totp/keys/svc generate=true issuer=ScaleSec account_name=svc-account
+func TestTotpGenerate(t *testing.T) {
+
+	b, storage := getBackend(t)
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "totp/keys/svc", map[string]interface{}{
+		"generate":     true,
+		"issuer":       "ScaleSec",
+		"account_name": "svc-account",
+	})
+
+	assert.NotNil(t, response, "Response should not be null")
+	assert.Contains(t, response.Data["url"], "otpauth://totp/ScaleSec:svc-account")
+	barcode, err := base64.StdEncoding.DecodeString(response.Data["barcode"].(string))
+	assert.Nil(t, err, "barcode should be base64 encoded")
+	assert.Equal(t, []byte("\x89PNG"), barcode[:4], "barcode should be a PNG")
+
+	// The seed is not returned when reading the key
+	response = sendRequest(t, b, storage, logical.ReadOperation, "totp/keys/svc", nil)
+	assert.Equal(t, "ScaleSec", response.Data["issuer"])
+	assert.NotContains(t, response.Data, "key")
+
+	response = sendRequest(t, b, storage, logical.ListOperation, "totp/keys/", nil)
+	assert.Equal(t, []string{"svc"}, response.Data["keys"])
+}
+
+// vault write scalesecsecrets/totp/keys/svc url=otpauth://...
+// vault read scalesecsecrets/totp/code/svc
+func TestTotpImportAndGenerateCode(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "totp/keys/svc", map[string]interface{}{
+		"url": TOTP_URL,
+	})
+	assert.Nil(t, response, "Response message %v", response)
+
+	expected, _ := totplib.GenerateCode("JBSWY3DPEHPK3PXP", now)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "totp/code/svc", nil)
+	assert.Equal(t, expected, response.Data["code"])
+
+	// Import the same seed as a plain key
+	sendRequest(t, b, storage, logical.UpdateOperation, "totp/keys/plain", map[string]interface{}{
+		"key": "jbswy3dpehpk3pxp",
+	})
+	response = sendRequest(t, b, storage, logical.ReadOperation, "totp/code/plain", nil)
+	assert.Equal(t, expected, response.Data["code"])
+
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "totp/keys/bad", map[string]interface{}{})
+	assert.True(t, response.IsError(), "url or key should be required")
+}
+
+// vault write scalesecsecrets/totp/code/svc code=123456
+func TestTotpValidate(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "totp/keys/svc", map[string]interface{}{
+		"url":  TOTP_URL,
+		"skew": 1,
+	})
+
+	// a code from the previous period is accepted with a skew of 1
+	previous, _ := totplib.GenerateCode("JBSWY3DPEHPK3PXP", now.Add(-30*time.Second))
+	response := sendRequest(t, b, storage, logical.UpdateOperation, "totp/code/svc", map[string]interface{}{"code": previous})
+	assert.Equal(t, true, response.Data["valid"])
+
+	// the same code is rejected the second time
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "totp/code/svc", map[string]interface{}{"code": previous})
+	assert.True(t, response.IsError(), "a used code should be rejected - %v", response.Data)
+
+	// a code from two periods ago is outside of the skew
+	old, _ := totplib.GenerateCode("JBSWY3DPEHPK3PXP", now.Add(-60*time.Second))
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "totp/code/svc", map[string]interface{}{"code": old})
+	assert.Equal(t, false, response.Data["valid"])
+
+	// once the used code can no longer be valid it is forgotten
+	now = now.Add(2 * time.Minute)
+	current, _ := totplib.GenerateCode("JBSWY3DPEHPK3PXP", now)
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "totp/code/svc", map[string]interface{}{"code": current})
+	assert.Equal(t, true, response.Data["valid"])
+	key, err := b.(*scalesecSecretStoreBackend).getTotpKey(context.Background(), storage, "svc")
+	assert.Nil(t, err)
+	assert.NotContains(t, key.UsedCodes, previous)
+}
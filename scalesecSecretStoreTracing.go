@@ -0,0 +1,218 @@
+// ********************************************************************************
+// Tracing of the plugin
+//
+// The requests on every path and the calls to the providers (the storage, the rotation hooks
+// and the generator hook) are traced with OpenTelemetry.  A provider span is a child of the
+// span of the handler that called it, and the calls to the hooks carry the trace context
+// in a traceparent header so the upstream spans join the trace.
+//
+// The exporter is set with the mount options:
+//
+//   vault secrets enable -path=scalesecsecrets \
+//     -options=tracing_exporter=otlp -options=tracing_endpoint=localhost:4318 scalesecSecretStore
+//
+// tracing_exporter : otlp sends the spans with OTLP over HTTP, file appends them as JSON
+//                    lines to tracing_file.  Tracing is off when it is not set.
+// tracing_endpoint : host:port of the OTLP collector (default localhost:4318)
+// tracing_insecure : true to send OTLP over plain HTTP, IE: to a local collector
+// tracing_file     : file the spans are written to by the file exporter
+//
+// The spans have the operation, the path and the request ID as attributes, never the
+// values of the secrets.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the tracer and of the service in the exported spans
+const tracerName = "scalesec-secret-store"
+
+// Default OTLP collector
+const defaultTracingEndpoint = "localhost:4318"
+
+// setupTracing creates the tracer of the backend from the mount options.  The tracer of
+// newBackend, that does nothing, is kept when no exporter is set.
+func (b *scalesecSecretStoreBackend) setupTracing(ctx context.Context, options map[string]string) error {
+	var exporter sdktrace.SpanExporter
+	var spanProcessor func(sdktrace.SpanExporter) sdktrace.TracerProviderOption
+
+	switch options["tracing_exporter"] {
+	case "":
+		return nil
+
+	case "otlp":
+		endpoint := options["tracing_endpoint"]
+		if endpoint == "" {
+			endpoint = defaultTracingEndpoint
+		}
+		clientOptions := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+		if options["tracing_insecure"] != "" {
+			insecure, err := strconv.ParseBool(options["tracing_insecure"])
+			if err != nil {
+				return fmt.Errorf("tracing_insecure %q is not a boolean", options["tracing_insecure"])
+			}
+			if insecure {
+				clientOptions = append(clientOptions, otlptracehttp.WithInsecure())
+			}
+		}
+		otlpExporter, err := otlptracehttp.New(ctx, clientOptions...)
+		if err != nil {
+			return fmt.Errorf("creating the OTLP exporter failed: %w", err)
+		}
+		exporter = otlpExporter
+		spanProcessor = func(exporter sdktrace.SpanExporter) sdktrace.TracerProviderOption {
+			return sdktrace.WithBatcher(exporter)
+		}
+
+	case "file":
+		if options["tracing_file"] == "" {
+			return fmt.Errorf("tracing_file must be set with the file exporter")
+		}
+		file, err := os.OpenFile(options["tracing_file"], os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("opening the tracing file failed: %w", err)
+		}
+		exporter = &fileSpanExporter{file: file}
+		// the spans are written when they end so the file is complete when a request returns
+		spanProcessor = func(exporter sdktrace.SpanExporter) sdktrace.TracerProviderOption {
+			return sdktrace.WithSyncer(exporter)
+		}
+
+	default:
+		return fmt.Errorf("unknown tracing_exporter %q, expected otlp or file", options["tracing_exporter"])
+	}
+
+	b.tracerProvider = sdktrace.NewTracerProvider(
+		spanProcessor(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", tracerName))),
+	)
+	b.tracer = b.tracerProvider.Tracer(tracerName)
+	return nil
+}
+
+// shutdownTracing sends the spans that were not exported yet and stops the exporter
+func (b *scalesecSecretStoreBackend) shutdownTracing(ctx context.Context) error {
+	if b.tracerProvider == nil {
+		return nil
+	}
+	return b.tracerProvider.Shutdown(ctx)
+}
+
+// startRequestSpan starts the span of a handler
+func (b *scalesecSecretStoreBackend) startRequestSpan(ctx context.Context, operation string, req *logical.Request) (context.Context, trace.Span) {
+	return b.tracer.Start(ctx, "scalesecSecretStore."+operation,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("operation", operation),
+			attribute.String("path", req.Path),
+			attribute.String("mount", req.MountPoint),
+			attribute.String("request_id", req.ID),
+		))
+}
+
+// endSpan ends the span with an error status if the call failed.  The status has no
+// description because an error can quote the data of the request.
+func endSpan(span trace.Span, failed bool) {
+	if failed {
+		span.SetStatus(codes.Error, "")
+	}
+	span.End()
+}
+
+// startProviderCall starts the span of a call to a provider.  The returned function ends
+// the span and measures the call.
+func (b *scalesecSecretStoreBackend) startProviderCall(ctx context.Context, provider string, call string) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, span := b.tracer.Start(ctx, provider+"."+call,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("provider", provider),
+			attribute.String("call", call),
+		))
+
+	return ctx, func(err error) {
+		endSpan(span, err != nil)
+		b.measureProvider(provider, call, start, err)
+	}
+}
+
+// injectTraceContext adds the traceparent header of the span in ctx to a request to an
+// upstream system
+func injectTraceContext(ctx context.Context, req *http.Request) {
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// fileSpanExporter writes the spans as JSON lines to a file
+type fileSpanExporter struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// exportedSpan is a span written by the file exporter
+type exportedSpan struct {
+	Name         string            `json:"name"`
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Kind         string            `json:"kind"`
+	StartTime    time.Time         `json:"start_time"`
+	EndTime      time.Time         `json:"end_time"`
+	Status       string            `json:"status"`
+	Attributes   map[string]string `json:"attributes"`
+}
+
+// ExportSpans writes the spans to the file
+func (e *fileSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	encoder := json.NewEncoder(e.file)
+	for _, span := range spans {
+		exported := exportedSpan{
+			Name:       span.Name(),
+			TraceID:    span.SpanContext().TraceID().String(),
+			SpanID:     span.SpanContext().SpanID().String(),
+			Kind:       span.SpanKind().String(),
+			StartTime:  span.StartTime(),
+			EndTime:    span.EndTime(),
+			Status:     span.Status().Code.String(),
+			Attributes: map[string]string{},
+		}
+		if span.Parent().IsValid() {
+			exported.ParentSpanID = span.Parent().SpanID().String()
+		}
+		for _, attr := range span.Attributes() {
+			exported.Attributes[string(attr.Key)] = attr.Value.Emit()
+		}
+		if err := encoder.Encode(exported); err != nil {
+			return fmt.Errorf("writing span failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// Shutdown closes the file
+func (e *fileSpanExporter) Shutdown(ctx context.Context) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.file.Close()
+}
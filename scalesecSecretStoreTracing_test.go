@@ -0,0 +1,151 @@
+package scalesecSecretStore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// create a backend that writes its spans to a file
+func getTracingBackend(t *testing.T) (logical.Backend, logical.Storage, string) {
+	file := filepath.Join(t.TempDir(), "spans.json")
+	backendConfig := &logical.BackendConfig{
+		Logger:      logging.NewVaultLogger(log.Trace),
+		System:      &logical.StaticSystemView{},
+		StorageView: &logical.InmemStorage{},
+		BackendUUID: "test",
+		Config: map[string]string{
+			"tracing_exporter": "file",
+			"tracing_file":     file,
+		},
+	}
+
+	b, err := Factory(context.Background(), backendConfig)
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+	t.Cleanup(func() { b.Cleanup(context.Background()) })
+	return b, backendConfig.StorageView, file
+}
+
+// read the spans written to the file
+func readSpans(t *testing.T, file string) []exportedSpan {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("unable to open the spans: %v", err)
+	}
+	defer f.Close()
+
+	var spans []exportedSpan
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var span exportedSpan
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &span))
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+// The handlers have a span with the storage calls as children, and no values
+func TestTracing(t *testing.T) {
+
+	b, storage, file := getTracingBackend(t)
+
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "hunter2"})
+	response := sendRequest(t, b, storage, logical.ReadOperation, "app/db", nil)
+	assert.Equal(t, "hunter2", response.Data["password"])
+
+	spans := readSpans(t, file)
+	byName := map[string]exportedSpan{}
+	for _, span := range spans {
+		byName[span.Name] = span
+		for _, value := range span.Attributes {
+			assert.NotContains(t, value, "hunter2", "values are never in the spans")
+		}
+	}
+
+	write, ok := byName["scalesecSecretStore.write"]
+	assert.True(t, ok, "the write has a span")
+	assert.Equal(t, "app/db", write.Attributes["path"])
+	assert.Equal(t, "write", write.Attributes["operation"])
+	assert.Equal(t, MOUNT_POINT, write.Attributes["mount"])
+	assert.Equal(t, "Unset", write.Status)
+
+	storageWrite, ok := byName["storage.write"]
+	assert.True(t, ok, "the storage write has a span")
+	assert.Equal(t, write.SpanID, storageWrite.ParentSpanID, "the storage span is a child of the handler span")
+	assert.Equal(t, write.TraceID, storageWrite.TraceID)
+
+	read, ok := byName["scalesecSecretStore.read"]
+	assert.True(t, ok, "the read has a span")
+	storageGet, ok := byName["storage.get"]
+	assert.True(t, ok, "the storage read has a span")
+	assert.Equal(t, read.SpanID, storageGet.ParentSpanID)
+}
+
+// The requests on the paths other than the secrets have a span too
+func TestTracingPaths(t *testing.T) {
+
+	b, storage, file := getTracingBackend(t)
+
+	sendRequest(t, b, storage, logical.ReadOperation, "config", nil)
+	sendRequest(t, b, storage, logical.ReadOperation, "search", nil)
+
+	paths := map[string]string{}
+	for _, span := range readSpans(t, file) {
+		if span.Name == "scalesecSecretStore.read" {
+			paths[span.Attributes["path"]] = span.Attributes["operation"]
+		}
+	}
+	assert.Equal(t, map[string]string{"config": "read", "search": "read"}, paths)
+}
+
+// The calls to a hook carry the trace context
+func TestTracingPropagation(t *testing.T) {
+
+	b, _, _ := getTracingBackend(t)
+	backend := b.(*scalesecSecretStoreBackend)
+
+	traceparent := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+		w.Write([]byte(`{"value": "generated"}`))
+	}))
+	defer server.Close()
+
+	value, err := backend.callGeneratorHook(context.Background(), &rotationEntry{Generator: generatorHook, GeneratorURL: server.URL})
+	assert.Nil(t, err)
+	assert.Equal(t, "generated", value)
+	assert.Regexp(t, "^00-[0-9a-f]{32}-[0-9a-f]{16}-01$", <-traceparent)
+}
+
+// An unknown exporter or a file exporter without a file fails the mount
+func TestTracingOptions(t *testing.T) {
+
+	for _, options := range []map[string]string{
+		{"tracing_exporter": "zipkin"},
+		{"tracing_exporter": "file"},
+		{"tracing_exporter": "otlp", "tracing_insecure": "maybe"},
+	} {
+		backendConfig := &logical.BackendConfig{
+			Logger:      logging.NewVaultLogger(log.Trace),
+			System:      &logical.StaticSystemView{},
+			StorageView: &logical.InmemStorage{},
+			BackendUUID: "test",
+			Config:      options,
+		}
+		_, err := Factory(context.Background(), backendConfig)
+		assert.NotNil(t, err, "options %v", options)
+	}
+}
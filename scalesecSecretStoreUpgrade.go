@@ -0,0 +1,376 @@
+// ********************************************************************************
+// Storage version and upgrade of the storage format
+//
+// The storage_version entry records the version of the storage format of the mount: the
+// number of migrations that were applied to it.  When the plugin starts, InitializeFunc
+// runs the migrations the mount does not have yet, in order, in the background:
+//
+//   1 : build the search index of the secrets written before the index existed
+//   2 : index the secrets deleted before the purge used the index of the deleted secrets
+//
+// A migration must be idempotent: it saves its progress (a cursor) in storage_version as it
+// goes and continues after the cursor when the plugin is restarted in the middle of it.  A
+// migration that fails is retried the next time the plugin starts.  A mount with a newer
+// storage version than the plugin knows is not touched.
+//
+//   vault read scalesecsecrets/status/upgrade
+//
+// To change the storage format, append a migration to storageMigrations.
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Storage key of the storage version
+const storageVersionKey = "storage_version"
+
+// A migration saves its progress every upgradeBatchSize secrets
+const upgradeBatchSize = 100
+
+// storageMigration changes the storage of the mount to the next version.  Run continues
+// after status.Cursor and saves its progress with saveUpgradeProgress.
+type storageMigration struct {
+	Name string
+	Run  func(ctx context.Context, s logical.Storage, status *storageVersion) error
+}
+
+// storageMigrations returns the migrations in order.  The storage version of a mount is the
+// number of them it has.
+func (b *scalesecSecretStoreBackend) storageMigrations() []storageMigration {
+	return []storageMigration{
+		{Name: "build the search index", Run: b.migrateSearchIndex},
+		{Name: "index the deleted secrets", Run: b.migrateDeletedIndex},
+	}
+}
+
+// storageVersion is the storage entry of the storage version and of the migration running
+type storageVersion struct {
+	Version       int        `json:"version"`
+	Migration     string     `json:"migration,omitempty"`
+	Cursor        string     `json:"cursor,omitempty"`
+	Processed     int        `json:"processed"`
+	StartedTime   *time.Time `json:"started_time,omitempty"`
+	CompletedTime *time.Time `json:"completed_time,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// upgradePaths returns the path of the upgrade status.
+func (b *scalesecSecretStoreBackend) upgradePaths(logger hclog.Logger) []*framework.Path {
+	logger.Debug("scalesecSecretStore.upgradePaths(): -> Enter")
+
+	frameworkPath := []*framework.Path{
+		{
+			Pattern: "status/upgrade$",
+
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.handleUpgradeStatus,
+					Summary:  "Read the storage version of the mount and the progress of its upgrade.",
+				},
+			},
+		},
+	}
+
+	logger.Debug("scalesecSecretStore.upgradePaths(): -> Leaving")
+	return frameworkPath
+}
+
+// ============================================================================================
+// initialize: Called by vault when the mount is set up
+//
+// GOAL:  	Start the migrations of the storage the mount does not have yet
+// Return:
+// 			error := Error if the storage is newer than the plugin or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	b.Logger().Debug("scalesecSecretStore.initialize:-> Enter")
+
+	// only the primary writes to storage
+	replicationState := b.System().ReplicationState()
+	if replicationState.HasState(consts.ReplicationPerformanceStandby) || replicationState.HasState(consts.ReplicationPerformanceSecondary) {
+		b.Logger().Debug("scalesecSecretStore.initialize:-> Leaving not the primary")
+		return nil
+	}
+
+	status, err := getStorageVersion(ctx, req.Storage)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.initialize:-> Leaving with error")
+		return fmt.Errorf("reading the storage version failed: %w", err)
+	}
+	latest := len(b.storageMigrations())
+	if status.Version > latest {
+		b.Logger().Debug("scalesecSecretStore.initialize:-> Leaving with a newer storage")
+		return fmt.Errorf("the storage version %d of the mount is newer than the version %d of the plugin", status.Version, latest)
+	}
+	if status.Version == latest {
+		b.Logger().Debug("scalesecSecretStore.initialize:-> Leaving up to date")
+		return nil
+	}
+
+	// the migrations run in the background so a large mount does not hold up vault
+	upgradeCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	b.upgradeLock.Lock()
+	b.upgradeCancel = cancel
+	b.upgradeDone = done
+	b.upgradeLock.Unlock()
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		if err := b.runStorageMigrations(upgradeCtx, req.Storage); err != nil {
+			b.Logger().Error("upgrading the storage failed, it is retried when the plugin starts", "error", err)
+		}
+	}()
+
+	b.Logger().Debug("scalesecSecretStore.initialize:-> Leaving")
+	return nil
+}
+
+// ============================================================================================
+// handleUpgradeStatus: Read the storage version and the progress of the upgrade
+//
+// GOAL:  	Report which migrations the mount has and how far the running one is
+// Return:
+// 			*logical.Response := the storage version, the latest version and the migration progress
+// 			error := Error with details if the read failed or nil if success.
+// ============================================================================================
+
+func (b *scalesecSecretStoreBackend) handleUpgradeStatus(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Debug("scalesecSecretStore.handleUpgradeStatus:-> Enter")
+	if req.ClientToken == "" {
+		err := fmt.Errorf("ClientToken is empty")
+		b.Logger().Debug(fmt.Sprintf("scalesecSecretStore.handleUpgradeStatus:-> Leaving with error: %s", err))
+		return nil, err
+	}
+
+	status, err := getStorageVersion(ctx, req.Storage)
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.handleUpgradeStatus:-> Leaving with error")
+		return nil, fmt.Errorf("reading the storage version failed: %w", err)
+	}
+
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+
+	b.Logger().Debug("scalesecSecretStore.handleUpgradeStatus:-> Leaving")
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"storage_version": status.Version,
+			"latest_version":  len(b.storageMigrations()),
+			"running":         b.upgradeRunning(),
+			"migration":       status.Migration,
+			"cursor":          status.Cursor,
+			"processed":       status.Processed,
+			"started_time":    formatTime(status.StartedTime),
+			"completed_time":  formatTime(status.CompletedTime),
+			"last_error":      status.Error,
+		},
+	}, nil
+}
+
+// upgradeRunning returns true while the migrations started by initialize run
+func (b *scalesecSecretStoreBackend) upgradeRunning() bool {
+	b.upgradeLock.Lock()
+	defer b.upgradeLock.Unlock()
+
+	if b.upgradeDone == nil {
+		return false
+	}
+	select {
+	case <-b.upgradeDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// runStorageMigrations applies the migrations the mount does not have, in order.  A failed
+// migration is recorded in the storage version and stops the upgrade.
+func (b *scalesecSecretStoreBackend) runStorageMigrations(ctx context.Context, s logical.Storage) error {
+	status, err := getStorageVersion(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	migrations := b.storageMigrations()
+	for status.Version < len(migrations) {
+		migration := migrations[status.Version]
+		if status.Migration != migration.Name {
+			// not a restart in the middle of this migration
+			now := b.now()
+			status.Migration = migration.Name
+			status.Cursor = ""
+			status.Processed = 0
+			status.StartedTime = &now
+			status.CompletedTime = nil
+		}
+		status.Error = ""
+		if err := saveUpgradeProgress(ctx, s, status); err != nil {
+			return err
+		}
+
+		b.Logger().Info("upgrading the storage", "version", status.Version+1, "migration", migration.Name)
+		if err := migration.Run(ctx, s, status); err != nil {
+			status.Error = err.Error()
+			if saveErr := saveUpgradeProgress(context.Background(), s, status); saveErr != nil {
+				b.Logger().Error("saving the upgrade progress failed", "error", saveErr)
+			}
+			return fmt.Errorf("migration %d %q failed: %w", status.Version+1, migration.Name, err)
+		}
+
+		now := b.now()
+		status.Version++
+		status.Migration = ""
+		status.Cursor = ""
+		status.CompletedTime = &now
+		if err := saveUpgradeProgress(ctx, s, status); err != nil {
+			return err
+		}
+	}
+
+	b.Logger().Info("the storage is up to date", "version", status.Version)
+	return nil
+}
+
+// getStorageVersion reads the storage version.  A mount without one has version 0.
+func getStorageVersion(ctx context.Context, s logical.Storage) (*storageVersion, error) {
+	storageEntry, err := s.Get(ctx, storageVersionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &storageVersion{}
+	if storageEntry == nil {
+		return status, nil
+	}
+	if err := storageEntry.DecodeJSON(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// saveUpgradeProgress writes the storage version and the progress of the migration
+func saveUpgradeProgress(ctx context.Context, s logical.Storage, status *storageVersion) error {
+	storageEntry, err := logical.StorageEntryJSON(storageVersionKey, status)
+	if err != nil {
+		return err
+	}
+	if err := s.Put(ctx, storageEntry); err != nil {
+		return fmt.Errorf("saving the upgrade progress failed: %w", err)
+	}
+	return nil
+}
+
+// migrateSearchIndex writes the search index entries of each secret, in path order after
+// the cursor.  The secrets written since the index exists are already indexed and left as
+// they are.
+func (b *scalesecSecretStoreBackend) migrateSearchIndex(ctx context.Context, s logical.Storage, status *storageVersion) error {
+	return b.migrateSecrets(ctx, s, status, b.indexSecret)
+}
+
+// migrateDeletedIndex writes the deleted index entry of each deleted secret, in path order
+// after the cursor
+func (b *scalesecSecretStoreBackend) migrateDeletedIndex(ctx context.Context, s logical.Storage, status *storageVersion) error {
+	return b.migrateSecrets(ctx, s, status, b.indexDeletedSecret)
+}
+
+// migrateSecrets runs migrate on each secret, in path order after the cursor
+func (b *scalesecSecretStoreBackend) migrateSecrets(ctx context.Context, s logical.Storage, status *storageVersion, migrate func(ctx context.Context, s logical.Storage, path string) error) error {
+	paths, err := logical.CollectKeysWithPrefix(ctx, logical.NewStorageView(s, secretStoragePrefix), "")
+	if err != nil {
+		return fmt.Errorf("listing secrets failed: %w", err)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if path <= status.Cursor {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := migrate(ctx, s, path); err != nil {
+			return fmt.Errorf("indexing %q failed: %w", path, err)
+		}
+
+		status.Cursor = path
+		status.Processed++
+		if status.Processed%upgradeBatchSize == 0 {
+			if err := saveUpgradeProgress(ctx, s, status); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexSecret brings the index entries of the secret at path up to date
+func (b *scalesecSecretStoreBackend) indexSecret(ctx context.Context, s logical.Storage, path string) error {
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	secret, err := b.getSecretIncludingDeleted(ctx, s, path)
+	if err != nil {
+		return err
+	}
+	changes, err := b.indexChanges(ctx, s, path, secret)
+	if err != nil {
+		return err
+	}
+
+	// leave the entries that already have their value
+	var writes []storageChange
+	for _, change := range changes {
+		current, err := s.Get(ctx, change.Key)
+		if err != nil {
+			return err
+		}
+		if current == nil && change.Value == nil {
+			continue
+		}
+		if current != nil && change.Value != nil && bytes.Equal(current.Value, change.Value) {
+			continue
+		}
+		writes = append(writes, change)
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return b.transactionalWrite(ctx, s, []string{path}, writes)
+}
+
+// indexDeletedSecret writes the deleted index entry of the secret at path if it is deleted
+func (b *scalesecSecretStoreBackend) indexDeletedSecret(ctx context.Context, s logical.Storage, path string) error {
+	lock := b.secretLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	secret, err := b.getSecretIncludingDeleted(ctx, s, path)
+	if err != nil || secret == nil || secret.DeletedTime == nil {
+		return err
+	}
+	change, err := deletedIndexChange(ctx, s, path, secret)
+	if err != nil || change == nil {
+		return err
+	}
+	return b.transactionalWrite(ctx, s, []string{path}, []storageChange{*change})
+}
@@ -0,0 +1,131 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// initialize the backend and wait for the migrations to end
+func initializeBackend(t *testing.T, b logical.Backend, storage logical.Storage) {
+	err := b.Initialize(context.Background(), &logical.InitializationRequest{Storage: storage})
+	assert.Nil(t, err)
+
+	backend := b.(*scalesecSecretStoreBackend)
+	backend.upgradeLock.Lock()
+	done := backend.upgradeDone
+	backend.upgradeLock.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// write tagged secrets and remove the index and the storage version like a mount written
+// before the search index existed
+func writeUnindexedMount(t *testing.T, b logical.Backend, storage logical.Storage) {
+	for _, path := range []string{"app/a", "app/b", "app/c"} {
+		sendRequest(t, b, storage, logical.CreateOperation, path, map[string]interface{}{"key": "k1"})
+		sendRequest(t, b, storage, logical.UpdateOperation, "metadata/"+path, map[string]interface{}{"tags": "prod"})
+	}
+
+	ctx := context.Background()
+	keys, err := logical.CollectKeysWithPrefix(ctx, storage, "index/")
+	assert.Nil(t, err)
+	for _, key := range keys {
+		assert.Nil(t, storage.Delete(ctx, key))
+	}
+	assert.Nil(t, storage.Delete(ctx, storageVersionKey))
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "search", map[string]interface{}{"tag": "prod"})
+	assert.Empty(t, response.Data["keys"])
+}
+
+// The migrations build the index of a mount written before it existed
+func TestUpgradeBuildsIndex(t *testing.T) {
+
+	b, storage := getBackend(t)
+	writeUnindexedMount(t, b, storage)
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "status/upgrade", nil)
+	assert.Equal(t, 0, response.Data["storage_version"])
+	assert.Equal(t, 2, response.Data["latest_version"])
+
+	initializeBackend(t, b, storage)
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "search", map[string]interface{}{"tag": "prod"})
+	assert.Equal(t, []string{"app/a", "app/b", "app/c"}, response.Data["keys"])
+
+	response = sendRequest(t, b, storage, logical.ReadOperation, "status/upgrade", nil)
+	assert.Equal(t, 2, response.Data["storage_version"])
+	assert.Equal(t, false, response.Data["running"])
+	assert.Equal(t, "", response.Data["migration"])
+	assert.Equal(t, 3, response.Data["processed"])
+	assert.NotEqual(t, "", response.Data["completed_time"])
+
+	// nothing is left to do the next time
+	initializeBackend(t, b, storage)
+	response = sendRequest(t, b, storage, logical.ReadOperation, "status/upgrade", nil)
+	assert.Equal(t, 2, response.Data["storage_version"])
+}
+
+// A migration stopped in the middle continues after its cursor
+func TestUpgradeResumes(t *testing.T) {
+
+	b, storage := getBackend(t)
+	writeUnindexedMount(t, b, storage)
+
+	// app/a was indexed before the plugin stopped
+	err := saveUpgradeProgress(context.Background(), storage, &storageVersion{
+		Migration: "build the search index",
+		Cursor:    "app/a",
+		Processed: 1,
+	})
+	assert.Nil(t, err)
+
+	initializeBackend(t, b, storage)
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "search", map[string]interface{}{"tag": "prod"})
+	assert.Equal(t, []string{"app/b", "app/c"}, response.Data["keys"], "the migration continued after app/a")
+	response = sendRequest(t, b, storage, logical.ReadOperation, "status/upgrade", nil)
+	assert.Equal(t, 2, response.Data["storage_version"])
+	assert.Equal(t, 3, response.Data["processed"])
+}
+
+// A mount written by a newer plugin is not touched
+func TestUpgradeNewerStorage(t *testing.T) {
+
+	b, storage := getBackend(t)
+	err := saveUpgradeProgress(context.Background(), storage, &storageVersion{Version: 99})
+	assert.Nil(t, err)
+
+	err = b.Initialize(context.Background(), &logical.InitializationRequest{Storage: storage})
+	assert.NotNil(t, err)
+}
+
+// The migrations index the secrets deleted before the deleted index existed
+func TestUpgradeIndexesDeleted(t *testing.T) {
+
+	b, storage := getBackend(t)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.(*scalesecSecretStoreBackend).now = func() time.Time { return now }
+	sendRequest(t, b, storage, logical.UpdateOperation, "config", map[string]interface{}{"delete_retention": "2h"})
+	sendRequest(t, b, storage, logical.CreateOperation, "app/old", map[string]interface{}{"key": "k1"})
+	sendRequest(t, b, storage, logical.DeleteOperation, "app/old", nil)
+
+	ctx := context.Background()
+	assert.Nil(t, storage.Delete(ctx, indexDeletedPrefix+"app/old"))
+	assert.Nil(t, saveUpgradeProgress(ctx, storage, &storageVersion{Version: 1}))
+
+	initializeBackend(t, b, storage)
+
+	response := sendRequest(t, b, storage, logical.ReadOperation, "status/upgrade", nil)
+	assert.Equal(t, 2, response.Data["storage_version"])
+	now = now.Add(3 * time.Hour)
+	runPeriodic(t, b, storage)
+	response = sendRequest(t, b, storage, logical.UpdateOperation, "undelete/app/old", nil)
+	assert.True(t, response.IsError(), "app/old should be purged")
+}
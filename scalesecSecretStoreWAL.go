@@ -0,0 +1,259 @@
+// ********************************************************************************
+// Write-ahead-log (WAL) rollback
+//
+// Operations that change more than one thing are not atomic: a rotation pushes to an external
+// system and then stores the secret, a transactional write puts several storage entries.
+// Before such an operation starts it writes a WAL entry (framework.PutWAL) with what is
+// needed to undo it and removes the entry when it is done.  If the plugin dies in the middle
+// the entry is left behind.  Vault regularly calls walRollback with the entries older than
+// WALRollbackMinAge and removes each one that was rolled back without error.
+//
+// WAL kinds:
+//   rotation : push the previous secret back to the rotation hook unless the rotation was committed
+//   storage  : put back the previous value of each storage entry a transactional write changed
+//              and count again the usage of the quotas of the secrets put back
+// ********************************************************************************
+
+package scalesecSecretStore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// walRollbackMinAge must be longer than the longest operation so vault does not roll back
+// an operation that is still running.
+const walRollbackMinAge = 5 * time.Minute
+
+// Kind of the WAL entry written before a transactional write
+const walKindStorage = "storage"
+
+// storageChange is a change to one storage entry.  A nil Value deletes the entry.
+type storageChange struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// storageWAL is the WAL entry written before a transactional write
+type storageWAL struct {
+	// LockPaths are the secret paths whose locks are held while the changes are made
+	LockPaths []string `json:"lock_paths"`
+
+	// Previous has the value of each entry before the write; Written what the write put there
+	Previous []storageChange `json:"previous"`
+	Written  []storageChange `json:"written"`
+}
+
+// walRollback is called by vault with the WAL entries that were not removed
+func (b *scalesecSecretStoreBackend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	b.Logger().Debug("scalesecSecretStore.walRollback:-> Enter", "kind", kind)
+
+	var err error
+	switch kind {
+	case walKindRotation:
+		var entry rotationWAL
+		if err = decodeWAL(data, &entry); err == nil {
+			err = b.rollbackRotationWAL(ctx, req.Storage, &entry)
+		}
+	case walKindStorage:
+		var entry storageWAL
+		if err = decodeWAL(data, &entry); err == nil {
+			err = b.rollbackStorageWAL(ctx, req.Storage, &entry)
+		}
+	default:
+		// an entry we do not know can never be rolled back so let vault remove it
+		b.Logger().Warn("scalesecSecretStore.walRollback:-> unknown WAL kind", "kind", kind)
+	}
+
+	if err != nil {
+		b.Logger().Debug("scalesecSecretStore.walRollback:-> Leaving with error")
+		return err
+	}
+	b.Logger().Debug("scalesecSecretStore.walRollback:-> Leaving")
+	return nil
+}
+
+// decodeWAL converts the data of a WAL entry, which vault hands over as decoded JSON, to
+// the typed entry
+func decodeWAL(data interface{}, out interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf, out); err != nil {
+		return fmt.Errorf("decoding WAL entry failed: %w", err)
+	}
+	return nil
+}
+
+// rollbackRotationWAL pushes the previous secret back to the hook.  If the rotated secret
+// was stored the rotation is complete and only the removal of the WAL entry was missed.
+func (b *scalesecSecretStoreBackend) rollbackRotationWAL(ctx context.Context, s logical.Storage, entry *rotationWAL) error {
+	lock := b.secretLock(entry.Path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	secret, err := b.getSecret(ctx, s, entry.Path)
+	if err != nil {
+		return err
+	}
+	if secret != nil && secret.Version >= entry.NextVersion {
+		return nil
+	}
+
+	config, err := b.getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	if err := config.checkHookUpstreams(entry.Hook); err != nil {
+		return err
+	}
+
+	hook, err := b.newRotationHook(entry.Hook)
+	if err != nil {
+		return err
+	}
+	defer hook.Close()
+	return rollbackRotation(ctx, hook, entry.Path, entry.Previous)
+}
+
+// rollbackStorageWAL puts back the previous value of the entries.  An entry that was
+// changed again after the write is left alone so a later change is never lost.
+//
+// The previous usage of the quotas is not put back: other writes may have changed it since.
+// The usage of the quotas of the secrets the write changed is counted again instead, which
+// also gives the right usage when a rollback that was cut short is run again.
+func (b *scalesecSecretStoreBackend) rollbackStorageWAL(ctx context.Context, s logical.Storage, entry *storageWAL) error {
+	for _, lock := range b.secretLocksFor(entry.LockPaths) {
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	b.quotaSetLock.RLock()
+	quotas, err := b.loadQuotas(ctx, s)
+	if err != nil {
+		b.quotaSetLock.RUnlock()
+		return err
+	}
+	applied := appliedQuotas(quotas, entry.Written)
+	defer b.lockQuotaUsage(applied)()
+
+	written := map[string][]byte{}
+	for _, change := range entry.Written {
+		written[change.Key] = change.Value
+	}
+
+	for _, previous := range entry.Previous {
+		if strings.HasPrefix(previous.Key, quotaUsageStoragePrefix) {
+			continue
+		}
+
+		current, err := s.Get(ctx, previous.Key)
+		if err != nil {
+			return err
+		}
+		value := written[previous.Key]
+		if (current == nil) != (value == nil) || (current != nil && !bytes.Equal(current.Value, value)) {
+			continue
+		}
+
+		if err := b.applyStorageChange(ctx, s, previous); err != nil {
+			return err
+		}
+	}
+	return b.recountQuotaUsage(ctx, s, applied)
+}
+
+// recountQuotaUsage counts again the usage of the quotas.  The caller holds their usage locks.
+func (b *scalesecSecretStoreBackend) recountQuotaUsage(ctx context.Context, s logical.Storage, quotas []*quotaEntry) error {
+	for _, quota := range quotas {
+		usage, err := b.countQuotaUsage(ctx, s, quota.Prefix)
+		if err != nil {
+			return err
+		}
+		storageEntry, err := logical.StorageEntryJSON(quotaKey(quotaUsageStoragePrefix, quota.Prefix), usage)
+		if err != nil {
+			return err
+		}
+		if err := s.Put(ctx, storageEntry); err != nil {
+			return fmt.Errorf("storing quota usage failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// applyStorageChange puts or deletes the storage entry and drops it from the read cache
+func (b *scalesecSecretStoreBackend) applyStorageChange(ctx context.Context, s logical.Storage, change storageChange) error {
+	defer b.forgetSecret(change.Key)
+
+	if change.Value == nil {
+		return s.Delete(ctx, change.Key)
+	}
+	return s.Put(ctx, &logical.StorageEntry{Key: change.Key, Value: change.Value})
+}
+
+// transactionalWrite applies all the changes or none of them.  The caller holds the locks of
+// lockPaths.  A WAL entry with the previous values is written first; if a change fails the
+// ones already made are undone, and if the plugin dies vault rolls them back from the WAL.
+func (b *scalesecSecretStoreBackend) transactionalWrite(ctx context.Context, s logical.Storage, lockPaths []string, changes []storageChange) (err error) {
+	ctx, end := b.startProviderCall(ctx, "storage", "write")
+	defer func() { end(err) }()
+
+	// the usage of the quotas is written with the secrets
+	quotaChanges, unlock, err := b.quotaChanges(ctx, s, changes)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	changes = append(changes, quotaChanges...)
+
+	wal := &storageWAL{
+		LockPaths: lockPaths,
+		Written:   changes,
+	}
+	for _, change := range changes {
+		current, err := s.Get(ctx, change.Key)
+		if err != nil {
+			return err
+		}
+		previous := storageChange{Key: change.Key}
+		if current != nil {
+			previous.Value = current.Value
+		}
+		wal.Previous = append(wal.Previous, previous)
+	}
+
+	walID, err := framework.PutWAL(ctx, s, walKindStorage, wal)
+	if err != nil {
+		return fmt.Errorf("writing WAL failed: %w", err)
+	}
+
+	for i, change := range changes {
+		if err := b.applyStorageChange(ctx, s, change); err != nil {
+			// undo the changes that were made, newest first
+			for j := i - 1; j >= 0; j-- {
+				if undoErr := b.applyStorageChange(ctx, s, wal.Previous[j]); undoErr != nil {
+					// leave the WAL entry so vault finishes the rollback
+					return fmt.Errorf("writing %q failed: %s; undo failed: %w", change.Key, err, undoErr)
+				}
+			}
+			if walErr := framework.DeleteWAL(ctx, s, walID); walErr != nil {
+				b.Logger().Warn("scalesecSecretStore.transactionalWrite:-> deleting WAL failed", "error", walErr)
+			}
+			return fmt.Errorf("writing %q failed: %w", change.Key, err)
+		}
+	}
+
+	// The write is only done once the WAL entry is gone.  If it can not be removed the
+	// write is reported as failed because vault will roll it back.
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		return fmt.Errorf("committing write failed: %w", err)
+	}
+	return nil
+}
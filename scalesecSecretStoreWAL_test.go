@@ -0,0 +1,186 @@
+package scalesecSecretStore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// roll back all the WAL entries whatever their age
+func rollbackWAL(t *testing.T, b logical.Backend, storage logical.Storage) {
+	sendRequest(t, b, storage, logical.RollbackOperation, "", map[string]interface{}{"immediate": true})
+}
+
+// A rotation interrupted after the push is rolled back: the previous secret goes back to the hook
+func TestWALRollbackRotation(t *testing.T) {
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app-db.json")
+	assert.Nil(t, ioutil.WriteFile(file, []byte(`{"password":"rotated"}`), 0600))
+
+	b, storage := getBackend(t)
+	b.(*scalesecSecretStoreBackend).hookFileDir = dir
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "initial"})
+
+	_, err := framework.PutWAL(context.Background(), storage, walKindRotation, &rotationWAL{
+		Path:        "app/db",
+		Hook:        &rotationHookConfig{Type: hookTypeFile, FilePath: "app-db.json"},
+		Previous:    map[string]interface{}{"password": "initial"},
+		NextVersion: 2,
+	})
+	assert.Nil(t, err)
+
+	rollbackWAL(t, b, storage)
+
+	content, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	var written map[string]interface{}
+	assert.Nil(t, json.Unmarshal(content, &written))
+	assert.Equal(t, "initial", written["password"])
+	assert.Empty(t, listWAL(t, storage), "WAL entry should be removed after the rollback")
+}
+
+// A rotation that was committed is not rolled back, only its WAL entry is removed
+func TestWALRollbackRotationCommitted(t *testing.T) {
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app-db.json")
+	assert.Nil(t, ioutil.WriteFile(file, []byte(`{"password":"rotated"}`), 0600))
+
+	b, storage := getBackend(t)
+	b.(*scalesecSecretStoreBackend).hookFileDir = dir
+	sendRequest(t, b, storage, logical.CreateOperation, "app/db", map[string]interface{}{"password": "initial"})
+	sendRequest(t, b, storage, logical.UpdateOperation, "app/db", map[string]interface{}{"password": "rotated"})
+
+	_, err := framework.PutWAL(context.Background(), storage, walKindRotation, &rotationWAL{
+		Path:        "app/db",
+		Hook:        &rotationHookConfig{Type: hookTypeFile, FilePath: "app-db.json"},
+		Previous:    map[string]interface{}{"password": "initial"},
+		NextVersion: 2,
+	})
+	assert.Nil(t, err)
+
+	rollbackWAL(t, b, storage)
+
+	content, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"password":"rotated"}`, string(content))
+	assert.Empty(t, listWAL(t, storage))
+}
+
+// A transactional write that completes leaves no WAL entry
+func TestTransactionalWrite(t *testing.T) {
+
+	b, storage := getBackend(t)
+	backend := b.(*scalesecSecretStoreBackend)
+	ctx := context.Background()
+
+	assert.Nil(t, storage.Put(ctx, &logical.StorageEntry{Key: "test/b", Value: []byte("b1")}))
+
+	err := backend.transactionalWrite(ctx, storage, []string{"a", "b"}, []storageChange{
+		{Key: "test/a", Value: []byte("a2")},
+		{Key: "test/b", Value: nil},
+	})
+	assert.Nil(t, err)
+
+	entry, err := storage.Get(ctx, "test/a")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a2"), entry.Value)
+	entry, err = storage.Get(ctx, "test/b")
+	assert.Nil(t, err)
+	assert.Nil(t, entry)
+	assert.Empty(t, listWAL(t, storage))
+}
+
+// An interrupted transactional write is rolled back, except the entries changed after it
+func TestWALRollbackStorage(t *testing.T) {
+
+	b, storage := getBackend(t)
+	ctx := context.Background()
+
+	// the write put test/a and test/b and deleted test/c before the plugin died, then
+	// test/b was written again
+	assert.Nil(t, storage.Put(ctx, &logical.StorageEntry{Key: "test/a", Value: []byte("a2")}))
+	assert.Nil(t, storage.Put(ctx, &logical.StorageEntry{Key: "test/b", Value: []byte("b3")}))
+	_, err := framework.PutWAL(ctx, storage, walKindStorage, &storageWAL{
+		LockPaths: []string{"a", "b", "c"},
+		Previous: []storageChange{
+			{Key: "test/a", Value: nil},
+			{Key: "test/b", Value: []byte("b1")},
+			{Key: "test/c", Value: []byte("c1")},
+		},
+		Written: []storageChange{
+			{Key: "test/a", Value: []byte("a2")},
+			{Key: "test/b", Value: []byte("b2")},
+			{Key: "test/c", Value: nil},
+		},
+	})
+	assert.Nil(t, err)
+
+	rollbackWAL(t, b, storage)
+
+	entry, err := storage.Get(ctx, "test/a")
+	assert.Nil(t, err)
+	assert.Nil(t, entry, "test/a did not exist before the write")
+	entry, err = storage.Get(ctx, "test/b")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b3"), entry.Value, "test/b was changed after the write")
+	entry, err = storage.Get(ctx, "test/c")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("c1"), entry.Value)
+	assert.Empty(t, listWAL(t, storage))
+}
+
+// The rollback counts the usage of the quotas again instead of putting back the usage the
+// write saw, which later writes changed
+func TestWALRollbackStorageQuota(t *testing.T) {
+
+	b, storage := getBackend(t)
+	ctx := context.Background()
+
+	sendRequest(t, b, storage, logical.UpdateOperation, "quotas/team-a", map[string]interface{}{"max_secrets": 10})
+	sendRequest(t, b, storage, logical.CreateOperation, "team-a/db", map[string]interface{}{"password": "p1"})
+	secret, err := storage.Get(ctx, "data/team-a/db")
+	assert.Nil(t, err)
+	usage, err := storage.Get(ctx, "quota_usage/team-a")
+	assert.Nil(t, err)
+
+	// the write of team-a/api stored the secret and its usage before the plugin died
+	grown, err := json.Marshal(&quotaUsage{Secrets: 2, Bytes: 2 * int64(len(secret.Value))})
+	assert.Nil(t, err)
+	assert.Nil(t, storage.Put(ctx, &logical.StorageEntry{Key: "data/team-a/api", Value: secret.Value}))
+	assert.Nil(t, storage.Put(ctx, &logical.StorageEntry{Key: "quota_usage/team-a", Value: grown}))
+	_, err = framework.PutWAL(ctx, storage, walKindStorage, &storageWAL{
+		LockPaths: []string{"team-a/api"},
+		Previous: []storageChange{
+			{Key: "data/team-a/api", Value: nil},
+			{Key: "quota_usage/team-a", Value: usage.Value},
+		},
+		Written: []storageChange{
+			{Key: "data/team-a/api", Value: secret.Value},
+			{Key: "quota_usage/team-a", Value: grown},
+		},
+	})
+	assert.Nil(t, err)
+
+	// another secret is written before the rollback
+	sendRequest(t, b, storage, logical.CreateOperation, "team-a/other", map[string]interface{}{"key": "k1"})
+
+	rollbackWAL(t, b, storage)
+
+	assert.Nil(t, sendRequest(t, b, storage, logical.ReadOperation, "team-a/api", nil))
+	response := sendRequest(t, b, storage, logical.ReadOperation, "quotas/team-a", nil)
+	assert.Equal(t, int64(2), response.Data["secrets"], "team-a/db and team-a/other")
+
+	maintained := response.Data["bytes"]
+	assert.Nil(t, storage.Delete(ctx, "quota_usage/team-a"))
+	response = sendRequest(t, b, storage, logical.ReadOperation, "quotas/team-a", nil)
+	assert.Equal(t, maintained, response.Data["bytes"], "the usage matches the stored secrets")
+}
@@ -40,15 +40,49 @@ func getBackend(t *testing.T) (logical.Backend, logical.Storage) {
 		t.Fatalf("unable to create backend: %v", err)
 	}
 
+	// there is no vault to ask for the capabilities of the caller
+	backend.(*scalesecSecretStoreBackend).accessChecker = &staticAccessChecker{capabilities: map[string][]string{}}
+
 	return backend, backendConfig.StorageView
 }
 
+// staticAccessChecker gives the caller every capability on the paths it does not list
+type staticAccessChecker struct {
+	capabilities map[string][]string
+}
+
+func (c *staticAccessChecker) Capabilities(ctx context.Context, req *logical.Request, path string) ([]string, error) {
+	if capabilities, ok := c.capabilities[path]; ok {
+		return capabilities, nil
+	}
+	return []string{"create", "read", "update", "patch", "delete", "list"}, nil
+}
+
+// send a request to the backend and fail the test on error
+func sendRequest(t *testing.T, b logical.Backend, storage logical.Storage, operation logical.Operation, path string, data map[string]interface{}) *logical.Response {
+	request := &logical.Request{
+		Operation:   operation,
+		Path:        path,
+		MountPoint:  MOUNT_POINT,
+		Storage:     storage,
+		ClientToken: "test_token",
+		Data:        data,
+	}
+
+	response, err := b.HandleRequest(context.Background(), request)
+	assert.Nil(t, err, "Response error %s", err)
+	return response
+}
+
 // Test the list command:
 // vault list scalesecsecrets/test
 func TestList(t *testing.T) {
 
 	b, storage := getBackend(t)
 
+	sendRequest(t, b, storage, logical.CreateOperation, BACKEND_PATH+"key1", map[string]interface{}{"secret_key": "secret_value"})
+	sendRequest(t, b, storage, logical.CreateOperation, BACKEND_PATH+"key2", map[string]interface{}{"secret_key": "secret_value"})
+
 	request := &logical.Request{
 		Operation:   logical.ListOperation,
 		Path:        BACKEND_PATH,
@@ -100,6 +134,8 @@ func TestRead(t *testing.T) {
 
 	b, storage := getBackend(t)
 
+	sendRequest(t, b, storage, logical.CreateOperation, BACKEND_PATH, map[string]interface{}{"secret_key": "secret_value"})
+
 	request := &logical.Request{
 		Operation:   logical.ReadOperation,
 		Path:        BACKEND_PATH,
@@ -110,8 +146,8 @@ func TestRead(t *testing.T) {
 
 	response, err := b.HandleRequest(context.Background(), request)
 
-	// in our read with no data we return secretPath=test/
-	assert.Containsf(t, response.Data["secretPath"], BACKEND_PATH, "Vault read response should contain '%s' - %v", BACKEND_PATH, response.Data)
+	// in our read with no data we return all the secrets stored at test/
+	assert.Equalf(t, "secret_value", response.Data["secret_key"], "Vault read response should contain secret_key - %v", response.Data)
 
 	assert.Nil(t, err, "Response error %s", err)
 	assert.NotNil(t, response, "Response should not be null")
@@ -122,6 +158,11 @@ func TestReadWithData(t *testing.T) {
 
 	b, storage := getBackend(t)
 
+	sendRequest(t, b, storage, logical.CreateOperation, BACKEND_PATH, map[string]interface{}{
+		"key_name":  "secret_value",
+		"other_key": "other_value",
+	})
+
 	data := map[string]interface{}{}
 
 	data["secret_key"] = "key_name"
@@ -137,9 +178,8 @@ func TestReadWithData(t *testing.T) {
 
 	response, err := b.HandleRequest(context.Background(), request)
 
-	// in our read with no data we return all_secrets_keys=all_secrets_values and secretPath=test/
-	assert.Containsf(t, response.Data["secretPath"], BACKEND_PATH, "Vault read response should contain '%s' - %v", BACKEND_PATH, response.Data)
-	assert.Containsf(t, response.Data["all_secrets_keys"], "all_secrets_values", "Vault read response should contain all_secrets_values - %v", response.Data)
+	// in our read with data we only return the value of the key named by secret_key
+	assert.Equalf(t, map[string]interface{}{"key_name": "secret_value"}, response.Data, "Vault read response should only contain key_name - %v", response.Data)
 
 	assert.Nil(t, err, "Response error %s", err)
 	assert.NotNil(t, response, "Response should not be null")
@@ -156,6 +196,8 @@ func TestDelete(t *testing.T) {
 
 	b, storage := getBackend(t)
 
+	sendRequest(t, b, storage, logical.CreateOperation, BACKEND_PATH, map[string]interface{}{"secret_key": "secret_value"})
+
 	request := &logical.Request{
 		Operation:   logical.DeleteOperation,
 		Path:        BACKEND_PATH,
@@ -169,6 +211,8 @@ func TestDelete(t *testing.T) {
 	assert.Nil(t, err, "Response error %s", err)
 	b.Logger().Debug("Response Object: %v", response)
 
+	response = sendRequest(t, b, storage, logical.ReadOperation, BACKEND_PATH, nil)
+	assert.Nil(t, response, "Secret should be deleted %v", response)
 }
 
 // vault delete scalesecsecrets/test secret_key=key_name
@@ -176,6 +220,11 @@ func TestDeleteWithData(t *testing.T) {
 
 	b, storage := getBackend(t)
 
+	sendRequest(t, b, storage, logical.CreateOperation, BACKEND_PATH, map[string]interface{}{
+		"key_name":  "secret_value",
+		"other_key": "other_value",
+	})
+
 	data := map[string]interface{}{}
 
 	data["secret_key"] = "key_name"
@@ -194,4 +243,17 @@ func TestDeleteWithData(t *testing.T) {
 	assert.Nil(t, err, "Response error %s", err)
 	b.Logger().Debug("Response Object: %v", response)
 
+	// only the named key is deleted
+	response = sendRequest(t, b, storage, logical.ReadOperation, BACKEND_PATH, nil)
+	assert.Equal(t, map[string]interface{}{"other_key": "other_value"}, response.Data)
+}
+
+// A secret with or without a trailing slash is the same secret and takes the same lock
+func TestSecretLockNormalized(t *testing.T) {
+
+	b, _ := getBackend(t)
+	backend := b.(*scalesecSecretStoreBackend)
+
+	assert.Same(t, backend.secretLock("test"), backend.secretLock("test/"))
+	assert.Equal(t, backend.secretLocksFor([]string{"test/"}), backend.secretLocksFor([]string{"test"}))
 }